@@ -0,0 +1,386 @@
+package main
+
+import "bufio"
+import "errors"
+import "fmt"
+import "regexp"
+import "strconv"
+import "strings"
+import "time"
+
+// Parsers for the load generators other than httperf. Each fills in the
+// PerfData fields its tool reports, and leaves the rest to be listed as
+// missing.
+
+// Parse a number from a line of output, returning a ParseError naming the
+// line if it is invalid.
+func parseNumber(lineno int, line, field, str string) (float64, error) {
+	conv, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+	if err != nil {
+		return 0, &ParseError{lineno, line, field, errors.New(fmt.Sprintf("invalid value %q", str))}
+	}
+	return conv, nil
+}
+
+// Parse a duration such as "635.91us", "1.2ms" or "10.10s" into milliseconds
+func parseMillis(lineno int, line, field, str string) (float64, error) {
+	d, err := time.ParseDuration(strings.TrimSpace(str))
+	if err != nil {
+		return 0, &ParseError{lineno, line, field, errors.New(fmt.Sprintf("invalid duration %q", str))}
+	}
+	return float64(d) / float64(time.Millisecond), nil
+}
+
+var sizeUnits = []struct {
+	suffix string
+	scale  float64
+}{
+	{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1},
+}
+
+// Parse a size such as "30.15MB", returning the number and the unit
+func parseSize(lineno int, line, field, str string) (float64, string, error) {
+	str = strings.TrimSpace(str)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(str, unit.suffix) {
+			conv, err := parseNumber(lineno, line, field, strings.TrimSuffix(str, unit.suffix))
+			return conv, unit.suffix, err
+		}
+	}
+	return 0, "", &ParseError{lineno, line, field, errors.New(fmt.Sprintf("invalid size %q", str))}
+}
+
+var wrkThreads = regexp.MustCompile(`^(\S+) threads and (\S+) connections`)
+var wrkLatency = regexp.MustCompile(`^Latency\s+(\S+)\s+(\S+)\s+(\S+)`)
+var wrkTotal = regexp.MustCompile(`^(\S+) requests in (\S+), (\S+) read`)
+var wrkSocketErrors = regexp.MustCompile(`^Socket errors: connect (\S+), read (\S+), write (\S+), timeout (\S+)`)
+
+// Parse the output of wrk --latency. wrk keeps its connections open, so it
+// reports nothing about connections, and only lists socket errors when there
+// were some.
+func parseWrk(str string, data *PerfData) (map[string]bool, error) {
+	found := make(map[string]bool)
+	var total float64
+	var bytes float64
+
+	scanner := bufio.NewScanner(strings.NewReader(str))
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		if match := wrkThreads.FindStringSubmatch(line); match != nil {
+			conv, err := parseNumber(lineno, line, "ConcurrentConnections", match[2])
+			if err != nil {
+				return nil, err
+			}
+			setField(data, found, "ConcurrentConnections", conv)
+		} else if match := wrkLatency.FindStringSubmatch(line); match != nil {
+			conv, err := parseMillis(lineno, line, "ReplyTimeResponse", match[1])
+			if err != nil {
+				return nil, err
+			}
+			setField(data, found, "ReplyTimeResponse", conv)
+		} else if match := wrkTotal.FindStringSubmatch(line); match != nil {
+			var err error
+			if total, err = parseNumber(lineno, line, "TotalRequests", match[1]); err != nil {
+				return nil, err
+			}
+			duration, err := parseMillis(lineno, line, "TestDuration", match[2])
+			if err != nil {
+				return nil, err
+			}
+			size, unit, err := parseSize(lineno, line, "ReplySizeTotal", match[3])
+			if err != nil {
+				return nil, err
+			}
+			for _, u := range sizeUnits {
+				if u.suffix == unit {
+					bytes = size * u.scale
+				}
+			}
+			setField(data, found, "TotalRequests", total)
+			setField(data, found, "TotalReplies", total)
+			setField(data, found, "TestDuration", duration/1000)
+			if total > 0 {
+				setField(data, found, "ReplySizeTotal", bytes/total)
+			}
+		} else if match := wrkSocketErrors.FindStringSubmatch(line); match != nil {
+			fields := []string{"ErrConnectionRefused", "ErrConnectionReset", "ErrOther", "ErrClientTimeout"}
+			var sum float64
+			for i, field := range fields {
+				conv, err := parseNumber(lineno, line, field, match[i+1])
+				if err != nil {
+					return nil, err
+				}
+				setField(data, found, field, conv)
+				sum += conv
+			}
+			setField(data, found, "ErrTotal", sum)
+		} else if strings.HasPrefix(line, "Requests/sec:") {
+			conv, err := parseNumber(lineno, line, "RequestsPerSecond", strings.TrimPrefix(line, "Requests/sec:"))
+			if err != nil {
+				return nil, err
+			}
+			setField(data, found, "RequestsPerSecond", conv)
+			setField(data, found, "RepliesPerSecAvg", conv)
+			if conv > 0 {
+				setField(data, found, "MsPerRequest", 1000/conv)
+			}
+		} else if strings.HasPrefix(line, "Transfer/sec:") {
+			conv, unit, err := parseSize(lineno, line, "NetIOValue", strings.TrimPrefix(line, "Transfer/sec:"))
+			if err != nil {
+				return nil, err
+			}
+			setField(data, found, "NetIOValue", conv)
+			data.NetIOUnit = unit + "/s"
+			found["NetIOUnit"] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, &ParseError{0, "", "", err}
+	}
+
+	// wrk leaves out the socket errors line when there were none
+	if found["TotalRequests"] && !found["ErrTotal"] {
+		for _, field := range []string{"ErrTotal", "ErrConnectionRefused", "ErrConnectionReset", "ErrOther", "ErrClientTimeout"} {
+			setField(data, found, field, 0)
+		}
+	}
+
+	return found, nil
+}
+
+// The Connection Times table of ab, and the fields of its "Total:" row
+var abTimes = regexp.MustCompile(`^(Connect|Processing|Waiting|Total):\s+(\S+)\s+(\S+)\s+(\S+)\s+(\S+)\s+(\S+)$`)
+var abTotalFields = []string{"ConnectionTimeMin", "ConnectionTimeAvg", "ConnectionTimeStddev", "ConnectionTimeMedian", "ConnectionTimeMax"}
+
+var abPercentile = regexp.MustCompile(`^(50|90|99)%\s+(\S+)`)
+var abPercentileFields = map[string]string{"50": "ConnectionTimeP50", "90": "ConnectionTimeP90", "99": "ConnectionTimeP99"}
+
+// Parse the output of ApacheBench. Unless keep-alive was used every request
+// has a connection of its own, so the connection fields can be filled in
+// from the request ones.
+func parseAB(str string, data *PerfData) (map[string]bool, error) {
+	found := make(map[string]bool)
+	var complete, failed, transferred, html float64
+	keepAlive := false
+	timePerRequest := 0
+
+	// Split "Key: value" lines into their parts
+	value := func(line, key string) string {
+		fields := strings.Fields(strings.TrimPrefix(line, key))
+		if len(fields) == 0 {
+			return ""
+		}
+		return fields[0]
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(str))
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		var err error
+		var conv float64
+
+		switch {
+		case strings.HasPrefix(line, "Concurrency Level:"):
+			if conv, err = parseNumber(lineno, line, "ConcurrentConnections", value(line, "Concurrency Level:")); err == nil {
+				setField(data, found, "ConcurrentConnections", conv)
+			}
+		case strings.HasPrefix(line, "Time taken for tests:"):
+			if conv, err = parseNumber(lineno, line, "TestDuration", value(line, "Time taken for tests:")); err == nil {
+				setField(data, found, "TestDuration", conv)
+			}
+		case strings.HasPrefix(line, "Complete requests:"):
+			complete, err = parseNumber(lineno, line, "TotalRequests", value(line, "Complete requests:"))
+		case strings.HasPrefix(line, "Failed requests:"):
+			failed, err = parseNumber(lineno, line, "ErrTotal", value(line, "Failed requests:"))
+		case strings.HasPrefix(line, "Keep-Alive requests:"):
+			keepAlive = true
+		case strings.HasPrefix(line, "Total transferred:"):
+			transferred, err = parseNumber(lineno, line, "ReplySizeTotal", value(line, "Total transferred:"))
+		case strings.HasPrefix(line, "HTML transferred:"):
+			html, err = parseNumber(lineno, line, "ReplySizeContent", value(line, "HTML transferred:"))
+		case strings.HasPrefix(line, "Requests per second:"):
+			if conv, err = parseNumber(lineno, line, "RequestsPerSecond", value(line, "Requests per second:")); err == nil {
+				setField(data, found, "RequestsPerSecond", conv)
+				setField(data, found, "RepliesPerSecAvg", conv)
+			}
+		case strings.HasPrefix(line, "Time per request:"):
+			// The second of these is the mean across all concurrent requests
+			timePerRequest++
+			if timePerRequest == 2 {
+				if conv, err = parseNumber(lineno, line, "MsPerRequest", value(line, "Time per request:")); err == nil {
+					setField(data, found, "MsPerRequest", conv)
+				}
+			}
+		case strings.HasPrefix(line, "Transfer rate:"):
+			if conv, err = parseNumber(lineno, line, "NetIOValue", value(line, "Transfer rate:")); err == nil {
+				setField(data, found, "NetIOValue", conv)
+				data.NetIOUnit = "KB/s"
+				found["NetIOUnit"] = true
+			}
+		default:
+			if match := abTimes.FindStringSubmatch(line); match != nil {
+				switch match[1] {
+				case "Connect":
+					if conv, err = parseNumber(lineno, line, "ConnectionTimeConnect", match[3]); err == nil {
+						setField(data, found, "ConnectionTimeConnect", conv)
+					}
+				case "Waiting":
+					if conv, err = parseNumber(lineno, line, "ReplyTimeResponse", match[3]); err == nil {
+						setField(data, found, "ReplyTimeResponse", conv)
+					}
+				case "Total":
+					for i, field := range abTotalFields {
+						if conv, err = parseNumber(lineno, line, field, match[i+2]); err != nil {
+							break
+						}
+						setField(data, found, field, conv)
+					}
+				}
+			} else if match := abPercentile.FindStringSubmatch(line); match != nil {
+				field := abPercentileFields[match[1]]
+				if conv, err = parseNumber(lineno, line, field, match[2]); err == nil {
+					setField(data, found, field, conv)
+				}
+			}
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, &ParseError{0, "", "", err}
+	}
+
+	if complete > 0 {
+		setField(data, found, "TotalRequests", complete)
+		setField(data, found, "TotalReplies", complete-failed)
+		setField(data, found, "ErrTotal", failed)
+		setField(data, found, "ReplySizeTotal", transferred/complete)
+		setField(data, found, "ReplySizeContent", html/complete)
+		setField(data, found, "ReplySizeHeader", (transferred-html)/complete)
+
+		if !keepAlive {
+			setField(data, found, "TotalConnections", complete)
+			setField(data, found, "RepliesPerConnection", 1)
+			if found["RequestsPerSecond"] {
+				setField(data, found, "ConnectionsPerSecond", data.RequestsPerSecond)
+			}
+		}
+	}
+
+	return found, nil
+}
+
+// A line of vegeta's text report, e.g.
+// "Requests      [total, rate, throughput]  3000, 100.03, 100.02"
+var vegetaLine = regexp.MustCompile(`^(\S.*?)\s+\[([^\]]+)\]\s+(.*)$`)
+
+// Parse the text report of vegeta. Each metric line lists the names of its
+// values in brackets, which are matched up with the values by position.
+func parseVegeta(str string, data *PerfData) (map[string]bool, error) {
+	found := make(map[string]bool)
+
+	scanner := bufio.NewScanner(strings.NewReader(str))
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		match := vegetaLine.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+
+		names := strings.Split(match[2], ",")
+		values := strings.Split(match[3], ",")
+		get := func(name string) (string, bool) {
+			for i, n := range names {
+				if strings.TrimSpace(n) == name && i < len(values) {
+					return strings.TrimSpace(values[i]), true
+				}
+			}
+			return "", false
+		}
+
+		var err error
+		var conv float64
+
+		switch match[1] {
+		case "Requests":
+			if v, ok := get("total"); ok {
+				if conv, err = parseNumber(lineno, line, "TotalRequests", v); err != nil {
+					return nil, err
+				}
+				setField(data, found, "TotalRequests", conv)
+			}
+			if v, ok := get("rate"); ok {
+				if conv, err = parseNumber(lineno, line, "RequestsPerSecond", v); err != nil {
+					return nil, err
+				}
+				setField(data, found, "RequestsPerSecond", conv)
+				if conv > 0 {
+					setField(data, found, "MsPerRequest", 1000/conv)
+				}
+			}
+			if v, ok := get("throughput"); ok {
+				if conv, err = parseNumber(lineno, line, "RepliesPerSecAvg", v); err != nil {
+					return nil, err
+				}
+				setField(data, found, "RepliesPerSecAvg", conv)
+			}
+		case "Duration":
+			if v, ok := get("total"); ok {
+				if conv, err = parseMillis(lineno, line, "TestDuration", v); err != nil {
+					return nil, err
+				}
+				setField(data, found, "TestDuration", conv/1000)
+			}
+		case "Latencies":
+			if v, ok := get("mean"); ok {
+				if conv, err = parseMillis(lineno, line, "ReplyTimeResponse", v); err != nil {
+					return nil, err
+				}
+				setField(data, found, "ReplyTimeResponse", conv)
+			}
+		case "Bytes In":
+			if v, ok := get("mean"); ok {
+				if conv, err = parseNumber(lineno, line, "ReplySizeContent", v); err != nil {
+					return nil, err
+				}
+				setField(data, found, "ReplySizeContent", conv)
+			}
+		case "Status Codes":
+			// Space separated code:count pairs, where code 0 is an error
+			var status [6]float64
+			var replies, errors float64
+			for _, pair := range strings.Fields(match[3]) {
+				parts := strings.SplitN(pair, ":", 2)
+				if len(parts) != 2 {
+					continue
+				}
+				code, err := strconv.Atoi(parts[0])
+				if err != nil {
+					return nil, &ParseError{lineno, line, "ReplyStatus", fmt.Errorf("invalid status code %q", parts[0])}
+				}
+				if conv, err = parseNumber(lineno, line, "ReplyStatus", parts[1]); err != nil {
+					return nil, err
+				}
+				if code == 0 {
+					errors += conv
+				} else if class := code / 100; class >= 1 && class <= 5 {
+					status[class] += conv
+					replies += conv
+				}
+			}
+			for class := 1; class <= 5; class++ {
+				setField(data, found, fmt.Sprintf("ReplyStatus_%dxx", class), status[class])
+			}
+			setField(data, found, "TotalReplies", replies)
+			setField(data, found, "ErrTotal", errors)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, &ParseError{0, "", "", err}
+	}
+
+	return found, nil
+}
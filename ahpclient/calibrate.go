@@ -0,0 +1,176 @@
+package main
+
+import "errors"
+import "fmt"
+import "io"
+import "log"
+import "net"
+import "net/http"
+import "os"
+import "sort"
+
+import "github.com/SpeedyCoder/autohttperf/ahpproto"
+
+// A step of the calibration is clean when the worker reported a result with
+// no errors, no validation errors and no sign of being saturated.
+func cleanCalibration(worker *Worker, data []*PerfData, ok bool) bool {
+	return ok && len(data) == 1 && data[0].ErrTotal == 0 && !data[0].Untrustworthy() && len(worker.saturated) == 0
+}
+
+// Answers every request with a short fixed reply, so that the sink is never
+// the bottleneck of a calibration
+func sinkHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("OK\n"))
+}
+
+// Start the sink that the workers are calibrated against. With -sinkworker
+// the daemon at that address hosts it, otherwise the coordinator does and the
+// workers reach it through -sinkhost.
+func startCalibrationSink(workers []*Worker) (*Target, error) {
+	if len(*sinkWorker) > 0 {
+		for _, worker := range workers {
+			if worker.addr != *sinkWorker {
+				continue
+			}
+
+			var port int
+			if err := worker.client.Call("HTTPerf.StartSink", *sinkPort, &port); err != nil {
+				return nil, errors.New(fmt.Sprintf("Worker %s could not start a sink: %s", worker.addr, err))
+			}
+			host, _, err := net.SplitHostPort(worker.addr)
+			if err != nil {
+				return nil, err
+			}
+			return &Target{host, port}, nil
+		}
+		return nil, errors.New(fmt.Sprintf("Sink worker %s is not one of the workers", *sinkWorker))
+	}
+
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", *sinkPort))
+	if err != nil {
+		return nil, err
+	}
+	go http.Serve(l, http.HandlerFunc(sinkHandler))
+
+	host := *sinkHost
+	if len(host) == 0 {
+		if host, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+	return &Target{host, l.Addr().(*net.TCPAddr).Port}, nil
+}
+
+// Ramp a single worker against the sink until a step is no longer clean,
+// returning the highest clean connection rate, or 0 if there was none.
+func calibrateWorker(worker *Worker, sink *Target) int {
+	ramp, err := ParseRamp(*rampProfile, *startRate)
+	if err != nil {
+		log.Fatalf("Could not parse ramp profile: %s", err)
+	}
+
+	secs := *duration
+	if secs <= 0 {
+		secs = 10
+	}
+
+	capacity := 0
+	rate := ramp.Start()
+	for {
+		args := &ahpproto.Args{
+			Host:                  sink.Host,
+			Port:                  sink.Port,
+			URL:                   "/",
+			NumConnections:        rate * secs,
+			ConnectionRate:        rate,
+			RequestsPerConnection: 1,
+			Duration:              secs,
+			Timeout:               *timeout,
+			Concurrency:           0,
+			ThinkTime:             0,
+			Verbose:               false,
+			Backend:               *backend,
+		}
+
+		log.Printf("[%s] Calibrating at rate %d", worker.id, rate)
+		data, ok := RunDistributedBenchmark([]*Worker{worker}, args)
+		if !cleanCalibration(worker, data, ok) {
+			break
+		}
+		capacity = rate
+
+		next, more := ramp.Next(rate, false)
+		if !more {
+			break
+		}
+		rate = next
+	}
+
+	return capacity
+}
+
+// Write the capacities in the format of the -capacities file, by address
+func writeCapacities(w io.Writer, capacities map[string]int) {
+	addrs := make([]string, 0, len(capacities))
+	for addr := range capacities {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	fmt.Fprintln(w, "# Written by -calibrate, the highest clean connection rate of each worker")
+	for _, addr := range addrs {
+		fmt.Fprintf(w, "capacity %s %d\n", addr, capacities[addr])
+	}
+}
+
+// Find how much load each worker can generate on its own against a sink
+// server, and add the capacities to the -capacities file. Workers without
+// a weight in the config are weighted by their capacity for the rest of the
+// run, and later runs load the file to do the same.
+func Calibrate(workers []*Worker, config *Config) {
+	sink, err := startCalibrationSink(workers)
+	if err != nil {
+		log.Fatalf("Could not start the calibration sink: %s", err)
+	}
+	log.Printf("Calibrating %d workers against the sink at %s", len(workers), sink)
+
+	for _, worker := range workers {
+		worker.capacity = calibrateWorker(worker, sink)
+		if worker.capacity == 0 {
+			log.Printf("[%s] Not even the starting rate was clean, capacity unknown", worker.id)
+			continue
+		}
+
+		log.Printf("[%s] Capacity %d conn/s", worker.id, worker.capacity)
+		config.capacities[worker.addr] = worker.capacity
+		if _, ok := config.weights[worker.addr]; !ok {
+			worker.weight = float64(worker.capacity)
+		}
+	}
+
+	if err := saveCapacities(*capacitiesFile, workers); err != nil {
+		log.Fatalf("Could not write capacities: %s", err)
+	}
+}
+
+// Add the capacities of the calibrated workers to the file at path, keeping
+// those of any other workers it holds
+func saveCapacities(path string, workers []*Worker) error {
+	saved := NewConfig()
+	if err := saved.Load(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, worker := range workers {
+		if worker.capacity > 0 {
+			saved.capacities[worker.addr] = worker.capacity
+		}
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	writeCapacities(file, saved.capacities)
+	return file.Close()
+}
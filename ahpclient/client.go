@@ -3,41 +3,121 @@ package main
 import "flag"
 import "fmt"
 import "log"
-import "os"
 import "net/rpc"
+import "os"
 import "time"
 import "strings"
 
+import "github.com/SpeedyCoder/autohttperf/ahpproto"
+
 // Runs a benchmark distributed over a set of clients. Returns a slice of the
 // resulting PerfData structures and a boolean flags indicating if all workers
-// successfully reported data, i.e. if the benchmark can be trusted.
-
-func RunDistributedBenchmark(workers []*Worker, args *Args) ([]*PerfData, bool) {
-	// Fairly simple, just split args up over however many client
-	// we're connected to, and perform the benchmark. Don't collate
-	// results or anything at the current time.
+// successfully reported data, i.e. if the benchmark can be trusted. When a
+// worker fails, the step is run again as directed by -onfail.
 
+func RunDistributedBenchmark(workers []*Worker, args *ahpproto.Args) ([]*PerfData, bool) {
 	// Generate a simple UID based on the current time in nanoseconds.
 	nanotime := time.Now().UnixNano()
 	nanoid := fmt.Sprintf("%#v", nanotime)
 
+	available := make([]*Worker, 0, len(workers))
+	for _, worker := range workers {
+		if !worker.dropped {
+			available = append(available, worker)
+		}
+	}
+	if len(available) == 0 {
+		log.Printf("Every worker has been dropped, nothing to run the benchmark on")
+		return nil, false
+	}
+
+	results, failed := runBenchmarkStep(available, args, nanoid)
+
+	// A step that was aborted early failed because of the server, running
+	// it again would only fail the same way
+	if reason := stepAborted(available); len(reason) > 0 {
+		log.Printf("The step was aborted early, not applying -onfail: %s", reason)
+		return results, false
+	}
+
+	// A step that any worker failed in records the policy, even "none"
+	policy := ""
+	if len(failed) > 0 {
+		policy = *onFail
+	}
+	for attempt := 1; len(failed) > 0; attempt++ {
+		available = applyFailPolicy(*onFail, attempt, available, failed)
+		if available == nil {
+			break
+		}
+
+		log.Printf("Running the step again (%s, attempt %d) on %d workers", policy, attempt, len(available))
+		results, failed = runBenchmarkStep(available, args, nanoid)
+	}
+
+	for _, perfdata := range results {
+		perfdata.FailPolicy = policy
+	}
+
+	return results, len(failed) == 0
+}
+
+// Split args up over the given workers by weight and perform the benchmark,
+// returning the results of the workers that succeeded and the workers that
+// did not.
+func runBenchmarkStep(workers []*Worker, args *ahpproto.Args, nanoid string) ([]*PerfData, []*Worker) {
 	numWorkers := len(workers)
 	log.Printf("Distributing benchmark over %d clients", numWorkers)
 	log.Printf("Arguments: %#v", args)
 
-	for _, worker := range workers {
-		wargs := &Args{
-			args.Host,
-			args.Port,
-			args.URL,
-			args.NumConnections / numWorkers,
-			args.ConnectionRate / numWorkers,
-			args.RequestsPerConnection,
-			args.Duration,
-			args.Timeout,
+	// The load is split by weight, so that larger workers take more of it
+	// and workers found to be saturated take less
+	weights := make([]float64, numWorkers)
+	for i, worker := range workers {
+		weights[i] = worker.weight
+	}
+	shares := splitLoad(args, weights)
+
+	// Only the workers given some of the load take part
+	active := make([]*Worker, 0, numWorkers)
+
+	for i, worker := range workers {
+		worker.saturated = ""
+		worker.aborted = ""
+
+		share := shares[i]
+		if share == nil {
+			log.Printf("[%s] Share of the load rounds down to nothing, leaving it out", worker.id)
+			continue
+		}
+		active = append(active, worker)
+
+		if worker.capacity > 0 && share.rate > worker.capacity {
+			log.Printf("[%s] Warning: share of %d conn/s is above its calibrated capacity of %d conn/s",
+				worker.id, share.rate, worker.capacity)
+		}
+
+		wargs := &ahpproto.Args{
+			Host:                  args.Host,
+			Port:                  args.Port,
+			URL:                   args.URL,
+			NumConnections:        share.connections,
+			ConnectionRate:        share.rate,
+			RequestsPerConnection: args.RequestsPerConnection,
+			Duration:              args.Duration,
+			Timeout:               args.Timeout,
+			Concurrency:           share.concurrency,
+			ThinkTime:             args.ThinkTime,
+			Verbose:               args.Verbose,
+			Backend:               args.Backend,
+			Lease:                 *lease,
+			Job:                   fmt.Sprintf("%s-%s", nanoid, worker.id),
+			Owner:                 *owner,
+			QueueWait:             *queueWait,
+			Version:               ahpproto.Version,
 		}
 
-		result := new(Result)
+		result := new(ahpproto.Result)
 
 		call := worker.client.Go("HTTPerf.Benchmark", wargs, &result, nil)
 
@@ -55,28 +135,77 @@ func RunDistributedBenchmark(workers []*Worker, args *Args) ([]*PerfData, bool)
 		}
 	}
 
+	// Show the progress of the workers while waiting for their results
+	watcher := watchStep(active)
+
+	// Every worker is waited on at once, so that each keeps getting its
+	// heartbeats and lease renewals while the others are still running
+	calls := make([]chan *rpc.Call, len(active))
+	for i, worker := range active {
+		if worker.call == nil {
+			continue
+		}
+		calls[i] = make(chan *rpc.Call, 1)
+		go func(worker *Worker, done chan *rpc.Call) {
+			call, err := waitForCall(worker)
+			if err == nil && lostConnection(call.Error) {
+				err = call.Error
+			}
+			if err != nil {
+				log.Printf("[%s] Worker lost: %s", worker.id, err)
+				if call, err = recoverJob(worker); err != nil {
+					log.Printf("[%s] Could not collect job %s: %s", worker.id, worker.args.Job, err)
+					call = nil
+				}
+			}
+			done <- call
+		}(worker, calls[i])
+	}
+
 	// Collect the PerfData into a slice
-	results := make([]*PerfData, 0, len(workers))
-	success := true
+	results := make([]*PerfData, 0, len(active))
+	failed := make([]*Worker, 0, len(active))
 
-	for _, worker := range workers {
+	for i, worker := range active {
 		if worker.call == nil {
 			// This call was not successful
-			success = false
+			failed = append(failed, worker)
 		} else {
-			call := <-worker.call.Done
+			call := <-calls[i]
+			if call == nil {
+				failed = append(failed, worker)
+				continue
+			}
+
 			log.Printf("[%s] Got results", worker.id)
 			if call.Error != nil {
-				log.Printf("[%s] Error state reported: %s", worker.id, call.Error.Error())
-				success = false
+				if busy, ok := ahpproto.AsBusy(call.Error); ok {
+					log.Printf("[%s] Worker is busy with job %s of %s, see -queuewait", worker.id, busy.Job, busy.Owner)
+				} else {
+					log.Printf("[%s] Error state reported: %s", worker.id, call.Error.Error())
+				}
+				failed = append(failed, worker)
 			} else {
-				perfdata, err := ParseResults(worker.result.Stdout, nanoid, worker.date, worker.args)
+				perfdata, err := ParseBackendResults(worker.result.Backend, worker.result.Stdout, nanoid, worker.date, worker.args)
 				if err != nil {
 					// Error parsing, report this
 					log.Printf("[%s] Error parsing perf data: %s\n", worker.id, err.Error())
-					success = false
+					failed = append(failed, worker)
+				} else {
+					perfdata.Labels = ahpproto.FormatLabels(worker.labels)
+					if len(perfdata.Missing) > 0 {
+						log.Printf("[%s] Fields missing from output: %s", worker.id, strings.Join(perfdata.Missing, ", "))
+					}
+					perfdata.Validate()
+					for _, issue := range perfdata.Issues {
+						log.Printf("[%s] Result %s", worker.id, issue)
+					}
+					if reason, saturated := perfdata.ClientSaturated(); saturated {
+						log.Printf("[%s] Worker was the bottleneck: %s", worker.id, reason)
+						worker.saturated = reason
+					}
+					results = append(results, perfdata)
 				}
-				results = append(results, perfdata)
 
 				if len(worker.result.Stderr) > 0 {
 					log.Printf("[%s] Stderr: %s", worker.id, worker.result.Stderr)
@@ -85,121 +214,312 @@ func RunDistributedBenchmark(workers []*Worker, args *Args) ([]*PerfData, bool)
 		}
 	}
 
-	return results, success
+	watcher.Stop()
+	return results, failed
+}
+
+// The state of a connection stress test against a single target. This is
+// kept per target so that several targets can be stepped in turn.
+type connStress struct {
+	target        *Target
+	ramp          Ramp
+	closed        bool // Ramp the closed-loop concurrency rather than the rate
+	rate          int
+	errorState    bool
+	cooldownSteps int
+	done          bool
+	weights       []float64 // The workers' shares for this target once moved off saturated workers
 }
 
-// Stress test a server for maximum number of connections per second
-func StressTestConnections(workers []*Worker) {
-	// A list of stress and steps, these should be sequential
-	var stressRates = map[int]int{
-		0:   100, // Start benchmarking at rate 100
-		100: 100, // Step up 100 rate each round
+func newConnStress(target *Target, closed bool) *connStress {
+	start := *startRate
+	if closed {
+		start = *concurrency
 	}
 
-	// Fetch the starting connection rate from the map
-	rate := *startRate
-	step := stressRates[rate]
-	if step == 0 {
-		step = stressRates[0]
+	// Each target gets its own ramp, since ramps keep state between steps
+	ramp, err := ParseRamp(*rampProfile, start)
+	if err != nil {
+		log.Fatalf("Could not parse ramp profile: %s", err)
 	}
 
-	errorState := false
-	cooldownSteps := *cooldown
+	return &connStress{target, ramp, closed, ramp.Start(), false, *cooldown, false, nil}
+}
 
-	// Output the TSV header
-	WriteTSVHeader(os.Stdout)
+// Run a single step of the stress test at the current rate, and move on to
+// the next rate of the ramp. Sets done once the cooldown steps have been used
+// up or the ramp has no more steps.
+func (s *connStress) Step(workers []*Worker, cmp *Comparison) {
+	// Load moved off a saturated worker stays moved for this target only,
+	// the other targets and later runs start from the configured weights
+	configured := s.loadWeights(workers)
+	defer applyWeights(workers, configured)
+
+	// Calculate the number of connections to request. Since we're distributing
+	// both the rate and the number of connections over several workers, this
+	// does not need to take that into account.
+	//
+	// 10 second duration with 300 connections per second is 3000 connections,
+	// regardless of how many clients are used to distribute that load.
+	numconns := *duration * s.rate
+	if numconns <= 0 {
+		numconns = 60 * s.rate
+	}
 
-	for {
-		// Calculate the number of connections to request. Since we're distributing
-		// both the rate and the number of connections over several workers, this
-		// does not need to take that into account.
-		//
-		// 10 second duration with 300 connections per second is 3000 connections,
-		// regardless of how many clients are used to distribute that load.
-		numconns := *duration * rate
-		if numconns <= 0 {
-			numconns = 60 * rate
+	args := new(ahpproto.Args)
+	args.Host = s.target.Host
+	args.Port = s.target.Port
+	args.URL = *url
+	args.NumConnections = numconns
+	args.ConnectionRate = s.rate
+	args.RequestsPerConnection = *requests
+	args.Verbose = *verbose
+	args.Backend = *backend
+
+	// A closed-loop step runs for a fixed time at the current concurrency
+	if s.closed {
+		args.NumConnections = 0
+		args.ConnectionRate = 0
+		args.Duration = *duration
+		if args.Duration <= 0 {
+			args.Duration = 60
 		}
+		args.Timeout = *timeout
+		args.Concurrency = s.rate
+		args.ThinkTime = *thinkTime
+	}
+
+	// Past -numerrors the step counts as stressed, so there is no point in
+	// letting it run to the end
+	abortErrors = *numErrors
+	data, ok := RunDistributedBenchmark(workers, args)
+	abortErrors = 0
+	if !ok {
+		log.Printf("Stress test of %s for rate %d did not fully succeed", s.target, s.rate)
+	}
+
+	WriteTSVParseDataSet(os.Stdout, data)
+	cmp.Add(s.target, args, data, ok)
+
+	// Check if the data set is over the error threshold
+	hasErrors := SetHasErrors(data, *numErrors)
+
+	// A step that was aborted early was clearly failing
+	if reason := stepAborted(workers); len(reason) > 0 {
+		log.Printf("[%s] Step at rate %d was aborted early: %s", s.target, s.rate, reason)
+		cmp.Note(s.target, fmt.Sprintf("step at rate %d was aborted early: %s", s.rate, reason))
+		hasErrors = true
+	}
 
-		args := new(Args)
-		args.Host = *server
-		args.Port = *port
-		args.URL = *url
-		args.NumConnections = numconns
-		args.ConnectionRate = rate
-		args.RequestsPerConnection = *requests
-
-		data, ok := RunDistributedBenchmark(workers, args)
-		if !ok {
-			log.Printf("Stress test for rate %d did not fully succeed", rate)
+	// The ramp still moves on, but anything decided from this step should
+	// not be taken at face value
+	if AnyUntrustworthy(data) {
+		log.Printf("[%s] Step at rate %d is untrustworthy, see the result errors above", s.target, s.rate)
+		cmp.Note(s.target, fmt.Sprintf("step at rate %d is untrustworthy", s.rate))
+	}
+
+	// When the workers rather than the server were the bottleneck the step
+	// says nothing about the server. Repeat it with the load moved away from
+	// the saturated workers, or stop if there is nowhere to move it to.
+	if saturated := saturatedWorkers(workers); len(saturated) > 0 {
+		if rebalanceWorkers(workers) {
+			s.weights = currentWeights(workers)
+			log.Printf("[%s] Repeating rate %d with less load on %d saturated workers", s.target, s.rate, len(saturated))
+			return
 		}
 
-		WriteTSVParseDataSet(os.Stdout, data)
+		log.Printf("[%s] The workers cannot generate rate %d, not raising it any further", s.target, s.rate)
+		cmp.Note(s.target, fmt.Sprintf("stopped at rate %d, the workers were saturated", s.rate))
+		s.done = true
+		return
+	}
+
+	recovery, selfTerminating := s.ramp.(RecoveryRamp)
 
-		// Check if the data set is over the error threshold
-		hasErrors := SetHasErrors(data, *numErrors)
+	if s.errorState && !hasErrors {
+		log.Printf("[%s] Exiting error state, server seems to have recovered", s.target)
+		s.errorState = false
+		s.cooldownSteps = *cooldown
+	} else if !s.errorState && hasErrors {
+		log.Printf("[%s] Entering an error state, will cooldown for %d rounds", s.target, s.cooldownSteps)
+		s.errorState = true
+	}
+
+	if s.errorState && !selfTerminating {
+		s.cooldownSteps = s.cooldownSteps - 1
+		log.Printf("[%s] In an error state with %d rounds to go", s.target, s.cooldownSteps)
+	}
 
-		if errorState && !hasErrors {
-			log.Printf("Exiting error state, server seems to have recovered")
-			errorState = false
-			cooldownSteps = *cooldown
-		} else if !errorState && hasErrors {
-			log.Printf("Entering an error state, will cooldown for %d rounds", cooldownSteps)
-			errorState = true
+	// Stop benchmarking when we've run out of cooldown steps
+	if s.cooldownSteps < 0 && !selfTerminating {
+		s.done = true
+		return
+	}
+
+	// Move on to the next rate of the ramp profile
+	rate, more := s.ramp.Next(s.rate, hasErrors)
+	if !more {
+		if selfTerminating {
+			s.logRecovery(recovery, cmp)
 		}
+		s.done = true
+		return
+	}
+	s.rate = rate
+
+	log.Printf("[%s] Current rate: %d", s.target, s.rate)
+}
+
+// Report how the server recovered after being overloaded
+func (s *connStress) logRecovery(recovery RecoveryRamp, cmp *Comparison) {
+	overload, recovered, steps, ok := recovery.Recovery()
+
+	var note string
+	if overload == 0 {
+		note = fmt.Sprintf("never overloaded, stopped at rate %d", s.rate)
+	} else if ok {
+		note = fmt.Sprintf("overloaded at rate %d, recovered at rate %d after %d steps down", overload, recovered, steps)
+	} else {
+		note = fmt.Sprintf("overloaded at rate %d, did not recover after %d steps down", overload, steps)
+	}
+
+	log.Printf("[%s] Step-down: %s", s.target, note)
+	cmp.Note(s.target, note)
+}
 
-		if errorState {
-			cooldownSteps = cooldownSteps - 1
-			log.Printf("In an error state with %d rounds to go", cooldownSteps)
+// Perform any sleep between steps, as directed
+func sleepBetweenSteps() {
+	log.Printf("Sleeping for %d seconds", *sleep)
+	var sleeptime time.Duration = time.Duration(int64(*sleep) * 1000000000)
+	time.Sleep(sleeptime)
+	log.Printf("Done sleeping")
+}
+
+// Stress test a set of servers for maximum number of connections per second.
+// The targets are either tested one after another, or with -interleave one
+// step of each target at a time.
+func StressTestConnections(workers []*Worker, targets []*Target, cmp *Comparison) {
+	states := make([]*connStress, 0, len(targets))
+	for _, target := range targets {
+		states = append(states, newConnStress(target, false))
+	}
+
+	runStress(workers, states, cmp)
+}
+
+// Stress test a set of servers for the maximum number of concurrent
+// closed-loop clients, ramping the concurrency from -concurrency.
+func StressTestConcurrency(workers []*Worker, targets []*Target, cmp *Comparison) {
+	states := make([]*connStress, 0, len(targets))
+	for _, target := range targets {
+		states = append(states, newConnStress(target, true))
+	}
+
+	runStress(workers, states, cmp)
+}
+
+func runStress(workers []*Worker, states []*connStress, cmp *Comparison) {
+	// Output the TSV header
+	WriteTSVHeader(os.Stdout)
+
+	if !*interleave {
+		for _, state := range states {
+			for {
+				state.Step(workers, cmp)
+				if state.done {
+					break
+				}
+				sleepBetweenSteps()
+			}
 		}
+		return
+	}
 
-		// Stop benchmarking when we've run out of cooldown steps
-		if cooldownSteps < 0 {
-			break
+	for {
+		remaining := 0
+		for _, state := range states {
+			if state.done {
+				continue
+			}
+			state.Step(workers, cmp)
+			if !state.done {
+				remaining++
+			}
 		}
 
-		// Increment the rate/step accordingly.
-		rate = rate + step
-		if newStep, ok := stressRates[rate]; ok {
-			step = newStep
+		if remaining == 0 {
+			break
 		}
+		sleepBetweenSteps()
+	}
+}
+
+// Run a closed-loop benchmark, with each worker keeping its share of the
+// -concurrency clients busy for the whole duration.
+func RunClosedBenchmark(workers []*Worker, target *Target, cmp *Comparison) {
+	testDuration := *duration
+	if testDuration <= 0 {
+		testDuration = 60
+	}
 
-		log.Printf("Current rate: %d, step: %d", rate, step)
+	args := &ahpproto.Args{
+		Host:                  target.Host,
+		Port:                  target.Port,
+		URL:                   *url,
+		NumConnections:        0,
+		ConnectionRate:        0,
+		RequestsPerConnection: *requests,
+		Duration:              testDuration,
+		Timeout:               *timeout,
+		Concurrency:           *concurrency,
+		ThinkTime:             *thinkTime,
+		Verbose:               *verbose,
+		Backend:               *backend,
+	}
 
-		// Perform any sleep, as directed
-		log.Printf("Sleeping for %d seconds", *sleep)
-		var sleeptime time.Duration = time.Duration(int64(*sleep) * 1000000000)
-		time.Sleep(sleeptime)
-		log.Printf("Done sleeping")
+	data, ok := RunDistributedBenchmark(workers, args)
+	if !ok {
+		log.Printf("Closed-loop benchmark of %s did not fully succeed", target)
 	}
+	cmp.Add(target, args, data, ok)
+
+	if !*skipheader {
+		WriteTSVHeader(os.Stdout)
+	}
+	WriteTSVParseDataSet(os.Stdout, data)
 }
 
 // Stress test a server for maximum number of requests per second
-func StressTestRequests(workers []*Worker) {
+func StressTestRequests(workers []*Worker, targets []*Target, cmp *Comparison) {
 }
 
-func RunManualBenchmark(workers []*Worker) {
+func RunManualBenchmark(workers []*Worker, target *Target, cmp *Comparison) {
 	// Number of connections is rate * duration
 	connections := *numConns
 	if *duration > 0 {
 		connections = *connRate * *duration
 	}
 
-	args := &Args{
-		*server,
-		*port,
-		*url,
-		connections,
-		*connRate,
-		*requests,
-		*duration,
-		*timeout,
+	args := &ahpproto.Args{
+		Host:                  target.Host,
+		Port:                  target.Port,
+		URL:                   *url,
+		NumConnections:        connections,
+		ConnectionRate:        *connRate,
+		RequestsPerConnection: *requests,
+		Duration:              *duration,
+		Timeout:               *timeout,
+		Concurrency:           0,
+		ThinkTime:             0,
+		Verbose:               *verbose,
+		Backend:               *backend,
 	}
 
 	data, ok := RunDistributedBenchmark(workers, args)
 	if !ok {
-		log.Printf("Manual benchmark did not fully succeed")
+		log.Printf("Manual benchmark of %s did not fully succeed", target)
 	}
+	cmp.Add(target, args, data, ok)
 
 
 	// Write the TSV header
@@ -214,7 +534,9 @@ func RunManualBenchmark(workers []*Worker) {
 		}
 		// WriteTSVParseData(os.Stdout, perfdata)	
 	}
-	PrintAggregateStats(data, len(workers))
+	if len(data) > 0 {
+		PrintAggregateStats(data, len(data))
+	}
 
 	if HasClientErrors(data) {
 		log.Println("Client error occurred.")
@@ -228,12 +550,29 @@ func RunManualBenchmark(workers []*Worker) {
 
 // General options that every single mode will require
 var help *bool = flag.Bool("help", false, "Display usage information")
+var configFile *string = flag.String("config", "", "A file of worker settings, e.g. \"weight host:port 2\" lines")
+var probe *bool = flag.Bool("probe", false, "Weight each worker's share of the load by its number of CPUs, unless the config gives a weight")
+var listFields *bool = flag.Bool("fields", false, "List the reported fields with their units and aggregation, then exit")
 var server *string = flag.String("server", "localhost", "The hostname or IP address of the server")
 var port *int = flag.Int("port", 80, "The port on which to bind the server")
 var url *string = flag.String("url", "/", "The URL to be requested")
 var timeout *int = flag.Int("timeout", 5, "Amount of time before a request is considered unfulfilled")
 var repeat *int = flag.Int("repeat", 10, "Number of times the call is repeated")
 var increment *int = flag.Int("increment", 100, "Value that is added to the connection rate after each repeat")
+var targetList *string = flag.String("targets", "", "Comma separated list of \"host:port\" servers to benchmark, overrides -server and -port")
+var verbose *bool = flag.Bool("verbose", false, "Collect reply rate samples and connection lifetime percentiles from the workers")
+var backend *string = flag.String("backend", "", "The load generator the workers should use (httperf, wrk, ab, vegeta or native), empty for each worker's default")
+var onFail *string = flag.String("onfail", "none", "What to do when a worker fails during a step: none, retry (with backoff, up to -retries times), reassign (its share to the other workers) or drop (it for the rest of the run)")
+var retries *int = flag.Int("retries", 3, "The number of times a step is retried with -onfail retry")
+var heartbeat *int = flag.Int("heartbeat", 5, "Seconds between heartbeats sent to each worker while it runs a benchmark, 0 to disable")
+var maxMissed *int = flag.Int("maxmissed", 3, "The number of heartbeats in a row a worker may miss before it is declared lost")
+var lease *int = flag.Int("lease", 30, "Seconds a worker keeps running a benchmark without hearing from the coordinator, 0 to disable")
+var progressInterval *int = flag.Int("progress", 5, "Seconds between live progress reports from each worker during a step, 0 to run blind without early aborts")
+var earlyAbort *bool = flag.Bool("earlyabort", true, "Abort a step as soon as a worker gets no replies for two samples in a row, or reaches -numerrors errors in a stress test")
+var owner *string = flag.String("owner", defaultOwner(), "Who the benchmarks are run for, named to anyone finding the workers busy")
+var queueWait *int = flag.Int("queuewait", 0, "Seconds a step may wait for a worker busy with someone else's benchmark, 0 to fail the worker at once")
+var grace *int = flag.Int("grace", 30, "Seconds a worker may take beyond the benchmark duration and timeouts before it is declared lost")
+var interleave *bool = flag.Bool("interleave", false, "Alternate between the targets on every step, rather than running each in turn")
 
 // Flags that can be used to turn a mode on or off, these are combined and
 // will be executed in the order they are specified here, not the order they
@@ -241,6 +580,28 @@ var increment *int = flag.Int("increment", 100, "Value that is added to the conn
 var modeStressConn *bool = flag.Bool("stressconn", false, "Perform a connection stress test")
 var modeStressReqs *bool = flag.Bool("stressreqs", false, "Perform a request stress test")
 var modeManual *bool = flag.Bool("manual", false, "Perform a manual benchmark")
+var modeSweep *bool = flag.Bool("sweep", false, "Perform a parameter sweep over every combination of the sweep values")
+var modeSoak *bool = flag.Bool("soak", false, "Perform a soak test, repeating the manual benchmark and checking for drift")
+var modeClosed *bool = flag.Bool("closed", false, "Perform a closed-loop benchmark with a fixed number of concurrent clients")
+var modeStressConc *bool = flag.Bool("stressconc", false, "Perform a closed-loop stress test, ramping the number of concurrent clients")
+var modeCalibrate *bool = flag.Bool("calibrate", false, "Find the capacity of each worker against a sink server before any other mode")
+
+// Security options, which must match those of the worker daemons
+var token *string = flag.String("token", "", "The pre-shared token the worker daemons expect")
+var useTLS *bool = flag.Bool("tls", false, "Connect to the worker daemons over TLS")
+var tlsCA *string = flag.String("tlsca", "", "CA the worker daemons' certificates are signed by, defaults to the system roots")
+var tlsCert *string = flag.String("tlscert", "", "Client certificate to present to the worker daemons, for mutual TLS")
+var tlsKey *string = flag.String("tlskey", "", "Private key of the -tlscert certificate")
+
+// Worker registration options, for daemons started with -coordinator
+var listenAddr *string = flag.String("listen", "", "Address to accept worker daemons registering on, e.g. \":7000\", in addition to any given as arguments")
+var waitWorkers *int = flag.Int("waitworkers", 1, "The number of registered workers to wait for (with -listen)")
+var waitLabels *string = flag.String("waitlabels", "", "Only use registered workers with all of these key=value labels (with -listen)")
+var waitTimeout *int = flag.Int("waittimeout", 0, "Seconds to wait for workers to register, 0 to wait forever (with -listen)")
+
+// Worker selection options
+var selectLabels *string = flag.String("select", "", "Only use the workers whose labels match this selector, e.g. \"zone=eu,size!=small\"")
+var pool *string = flag.String("pool", "", "Only use the workers in this pool, as defined by a \"pool <name> <selector>\" line in the -config file")
 
 // Manual mode options
 var numConns *int = flag.Int("numconns", 6000, "The number of connections to be opened (manual only)")
@@ -249,13 +610,37 @@ var requests *int = flag.Int("requests", 5, "The number of requests sent per con
 var duration *int= flag.Int("duration", 0, "The duration of the test to be performed")
 var skipheader *bool = flag.Bool("skipheader", false, "Do not print the CSV header")
 
+// Closed-loop options
+var concurrency *int = flag.Int("concurrency", 10, "The number of concurrent clients, or the starting number when stress testing (closed-loop only)")
+var thinkTime *int = flag.Int("thinktime", 0, "Milliseconds each client waits between requests on a connection (closed-loop only)")
+
 // Stress test options
 var numErrors *int = flag.Int("numerrors", 500, "The maximum acceptable number of errors to indicate 'stressed' (stress only)")
 var cooldown *int = flag.Int("cooldown", 3, "The number of steps to take following an 'error state' (stress only)")
 var sleep *int = flag.Int("sleeptime", 30, "The amount of time (in seconds) to sleep between each round (stress only)")
 var startRate *int = flag.Int("startrate", 100, "The connection start rate for the stress test")
+var rampProfile *string = flag.String("ramp", "linear:step=100", "The stress test ramp profile, one of linear:step=N, geometric:k=F, list:R1,R2,..., spike:base=N,burst=N,step=N,count=N or stepdown:step=N,down=N (stress only)")
 var dumpraw *bool = flag.Bool("dumpraw", false, "Dump the raw client output to stderr")
 
+// Sweep options
+var sweepRates *string = flag.String("sweeprates", "100-500:100", "Connection rates to sweep, as a list of values or start-end:step ranges (sweep only)")
+var sweepRequests *string = flag.String("sweeprequests", "1", "Requests per connection to sweep, as a list of values or start-end:step ranges (sweep only)")
+var sweepURLs *string = flag.String("sweepurls", "/", "Comma separated list of URLs to sweep (sweep only)")
+var sweepOrder *string = flag.String("sweeporder", "target,url,requests,rate", "The order in which the sweep dimensions are varied, slowest first (sweep only)")
+var sweepRandom *bool = flag.Bool("sweeprandom", false, "Run the sweep combinations in a random order (sweep only)")
+var sweepOut *string = flag.String("sweepout", "sweep.csv", "File the sweep results are appended to, existing combinations are skipped (sweep only)")
+
+// Soak test options, the window length is taken from -duration and the load
+// from -connrate and -requests
+var soakDuration *int = flag.Int("soakduration", 3600, "The total duration of the soak test in seconds (soak only)")
+
+// Calibration options, the ramp is taken from -ramp and -startrate and the
+// length of each step from -duration
+var capacitiesFile *string = flag.String("capacities", "capacities.conf", "File the worker capacities are written to by -calibrate, and loaded from when it exists")
+var sinkWorker *string = flag.String("sinkworker", "", "The worker daemon that hosts the sink server, rather than the coordinator (calibrate only)")
+var sinkHost *string = flag.String("sinkhost", "", "The name the workers reach the coordinator's sink server by, defaults to the hostname (calibrate only)")
+var sinkPort *int = flag.Int("sinkport", 0, "The port the sink server listens on, 0 for any free port (calibrate only)")
+
 var PrintUsage = func() {
 	fmt.Fprintf(os.Stderr, "Usage of %s: \"host1:port1\" ...\n", os.Args[0])
 	flag.PrintDefaults()
@@ -267,7 +652,7 @@ func main() {
 	if err != nil {
 		log.Println("Error with output file:", err)
 	}
-	f.WriteString(strings.Join(iFieldNames, "|") + "\n")
+	f.WriteString(strings.Join(metricNames(perfSchema.aggregates), "|") + "\n")
 	f.Close()
 
 	if *help {
@@ -275,42 +660,142 @@ func main() {
 		return
 	}
 
+	if *listFields {
+		WriteSchema(os.Stdout)
+		return
+	}
+
+	if *modeSoak && *soakDuration < soakWindowLength() {
+		log.Fatalf("The -soakduration of %ds is shorter than a single soak window of %ds", *soakDuration, soakWindowLength())
+	}
+
+	// Settings in the config take precedence over the calibrated capacities
+	config := NewConfig()
+	if _, err := os.Stat(*capacitiesFile); err == nil {
+		if err := config.Load(*capacitiesFile); err != nil {
+			log.Fatalf("Could not read capacities: %s", err)
+		}
+	}
+	if len(*configFile) > 0 {
+		if err := config.Load(*configFile); err != nil {
+			log.Fatalf("Could not read config: %s", err)
+		}
+	}
+	selector := runSelector(config)
+
 	// Build a slice of RPC clients, as specified by the user as arguments
 	workers := make([]*Worker, 0, 5)
 
 	for idx, arg := range flag.Args() {
 		log.Printf("Opening RPC connection to %s", arg)
-		client, err := rpc.DialHTTP("tcp", arg)
+		client, err := dialWorker(arg)
 		log.Printf("New RPC connection %p", client)
 
 		if err != nil {
-			log.Fatalf("Could not connect to client %s: %s", arg, err)
+			log.Printf("Could not connect to client %s, leaving it out: %s", arg, err)
+			continue
+		}
+		if err := handshake(client); err != nil {
+			log.Printf("Incompatible client %s, leaving it out: %s", arg, err)
+			client.Close()
+			continue
 		}
 
 		id := fmt.Sprintf("%s:%d", arg, idx)
-		worker := &Worker{arg, id, client, nil, nil, 0, nil}
+		worker := &Worker{arg, id, client, nil, nil, 0, nil, 1, "", 0, false, nil, ""}
 		workers = append(workers, worker)
 	}
 
-	if !*modeStressConn && !*modeStressReqs && !*modeManual {
-		log.Fatalf("No mode selected, please supply one of -stressconn, -stressreqs or -manual")
+	fetchLabels(workers)
+	workers = selectWorkers(workers, selector)
+
+	if len(*listenAddr) > 0 {
+		workers = append(workers, waitForWorkers(len(flag.Args()), selector)...)
+	}
+	if len(workers) == 0 {
+		log.Fatalf("No workers to run the benchmark on, give their addresses as arguments or use -listen")
+	}
+
+	if !validFailPolicy(*onFail) {
+		log.Fatalf("Unknown -onfail policy %q, expected one of %s", *onFail, strings.Join(failPolicies, ", "))
+	}
+
+	setWorkerWeights(workers, config, *probe)
+
+	if !*modeStressConn && !*modeStressReqs && !*modeManual && !*modeSweep && !*modeSoak &&
+		!*modeClosed && !*modeStressConc && !*modeCalibrate {
+		log.Fatalf("No mode selected, please supply one of -calibrate, -stressconn, -stressreqs, -stressconc, -manual, -closed, -sweep or -soak")
+	}
+
+	if *modeCalibrate {
+		Calibrate(workers, config)
 	}
 
+	targets := []*Target{&Target{*server, *port}}
+	if len(*targetList) > 0 {
+		targets, err = ParseTargets(*targetList, *port)
+		if err != nil {
+			log.Fatalf("Could not parse targets: %s", err)
+		}
+	}
+
+	cmp := NewComparison()
+
 	if *modeManual {
-		for i := 0; i < *repeat; i++ {
-			log.Println("Connection Rate:", *connRate)
-			RunManualBenchmark(workers)
-			*connRate += *increment
-			time.Sleep(time.Second*time.Duration(*sleep))
+		if *interleave {
+			for i := 0; i < *repeat; i++ {
+				log.Println("Connection Rate:", *connRate)
+				for _, target := range targets {
+					RunManualBenchmark(workers, target, cmp)
+				}
+				*connRate += *increment
+				time.Sleep(time.Second*time.Duration(*sleep))
+			}
+		} else {
+			startConnRate := *connRate
+			for _, target := range targets {
+				*connRate = startConnRate
+				for i := 0; i < *repeat; i++ {
+					log.Println("Connection Rate:", *connRate)
+					RunManualBenchmark(workers, target, cmp)
+					*connRate += *increment
+					time.Sleep(time.Second*time.Duration(*sleep))
+				}
+			}
 		}
 	}
 
 	if *modeStressConn {
-		StressTestConnections(workers)
+		StressTestConnections(workers, targets, cmp)
 	}
 
 	if *modeStressReqs {
-		StressTestRequests(workers)
+		StressTestRequests(workers, targets, cmp)
+	}
+
+	if *modeClosed {
+		for _, target := range targets {
+			RunClosedBenchmark(workers, target, cmp)
+		}
+	}
+
+	if *modeStressConc {
+		StressTestConcurrency(workers, targets, cmp)
+	}
+
+	if *modeSweep {
+		RunSweep(workers, targets, cmp)
+	}
+
+	if *modeSoak {
+		for _, target := range targets {
+			RunSoak(workers, target, cmp)
+		}
+	}
+
+	// Only worth comparing when there is more than one target
+	if len(targets) > 1 {
+		cmp.Write(os.Stderr)
 	}
 
 }
@@ -0,0 +1,120 @@
+package main
+
+import "fmt"
+import "io"
+import "sort"
+import "text/tabwriter"
+
+import "github.com/SpeedyCoder/autohttperf/ahpproto"
+
+// A single step of a benchmark against one target, summarised over all of
+// the workers that took part in it.
+type comparisonRow struct {
+	target        string
+	rate          int
+	concurrency   int
+	requests      int
+	connPerSec    float64
+	replyPerSec   float64
+	connTimeAvg   float64
+	errors        float64
+	workers       int
+	incomplete    bool   // Not every worker reported a result
+	untrustworthy bool   // A result failed validation
+	policy        string // The -onfail policy applied, if a worker failed
+}
+
+// Collects the results of benchmarking several targets so that they can be
+// printed side by side once all of the modes have finished.
+type Comparison struct {
+	rows  []*comparisonRow
+	notes []string
+}
+
+func NewComparison() *Comparison {
+	return &Comparison{make([]*comparisonRow, 0, 16), nil}
+}
+
+// Add a free form note about a target, printed below the table
+func (c *Comparison) Note(target *Target, note string) {
+	c.notes = append(c.notes, fmt.Sprintf("%s: %s", target, note))
+}
+
+// Add the results of one distributed benchmark against a target. The ok flag
+// is the one returned from RunDistributedBenchmark.
+func (c *Comparison) Add(target *Target, args *ahpproto.Args, data []*PerfData, ok bool) {
+	row := &comparisonRow{
+		target:        target.String(),
+		rate:          args.ConnectionRate,
+		concurrency:   args.Concurrency,
+		requests:      args.RequestsPerConnection,
+		workers:       len(data),
+		incomplete:    !ok,
+		untrustworthy: AnyUntrustworthy(data),
+	}
+
+	for _, perfdata := range data {
+		row.policy = perfdata.FailPolicy
+		row.connPerSec += perfdata.ConnectionsPerSecond
+		row.replyPerSec += perfdata.RepliesPerSecAvg
+		row.connTimeAvg += perfdata.ConnectionTimeAvg
+		row.errors += perfdata.ErrTotal
+	}
+
+	if len(data) > 0 {
+		row.connTimeAvg = row.connTimeAvg / float64(len(data))
+	}
+
+	c.rows = append(c.rows, row)
+}
+
+// Write the comparison table, one row per target for each rate so that the
+// targets benchmarked at the same load end up next to each other.
+func (c *Comparison) Write(w io.Writer) {
+	rows := make([]*comparisonRow, len(c.rows))
+	copy(rows, c.rows)
+
+	// Keep the order the targets were given in for rows with equal rates
+	order := make(map[string]int)
+	for _, row := range c.rows {
+		if _, ok := order[row.target]; !ok {
+			order[row.target] = len(order)
+		}
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool {
+		if rows[i].rate != rows[j].rate {
+			return rows[i].rate < rows[j].rate
+		}
+		if rows[i].concurrency != rows[j].concurrency {
+			return rows[i].concurrency < rows[j].concurrency
+		}
+		if rows[i].requests != rows[j].requests {
+			return rows[i].requests < rows[j].requests
+		}
+		return order[rows[i].target] < order[rows[j].target]
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "RATE\tCONC\tREQS/CONN\tTARGET\tCONN/S\tREPLY/S\tCONNTIME[ms]\tERRORS\tWORKERS\t")
+	for _, row := range rows {
+		flag := ""
+		if row.incomplete {
+			flag += " (incomplete)"
+		}
+		if row.untrustworthy {
+			flag += " (untrustworthy)"
+		}
+		if len(row.policy) > 0 {
+			flag += fmt.Sprintf(" (%s)", row.policy)
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%s\t%.1f\t%.1f\t%.1f\t%.0f\t%d%s\t\n", row.rate, row.concurrency, row.requests,
+			row.target, row.connPerSec, row.replyPerSec, row.connTimeAvg, row.errors,
+			row.workers, flag)
+	}
+	tw.Flush()
+
+	for _, note := range c.notes {
+		fmt.Fprintln(w, note)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import "bytes"
+import "reflect"
+import "strings"
+import "testing"
+
+import "github.com/SpeedyCoder/autohttperf/ahpproto"
+
+func TestParseTargets(t *testing.T) {
+	tests := []struct {
+		list     string
+		expected []Target
+	}{
+		{"localhost", []Target{{"localhost", 80}}},
+		{"a:8080, b ,c:81", []Target{{"a", 8080}, {"b", 80}, {"c", 81}}},
+		{"a,,b,", []Target{{"a", 80}, {"b", 80}}},
+		{"[::1]:8080", []Target{{"::1", 8080}}},
+		{"[::1], ::1", []Target{{"::1", 80}, {"::1", 80}}},
+	}
+	for _, test := range tests {
+		targets, err := ParseTargets(test.list, 80)
+		if err != nil {
+			t.Errorf("%q: failed to parse: %s", test.list, err)
+			continue
+		}
+		parsed := make([]Target, len(targets))
+		for i, target := range targets {
+			parsed[i] = *target
+		}
+		if !reflect.DeepEqual(parsed, test.expected) {
+			t.Errorf("%q: expected %v, got %v", test.list, test.expected, parsed)
+		}
+	}
+
+	for _, bad := range []string{"", " , ", "a:http", "a:0", "a:-1"} {
+		if _, err := ParseTargets(bad, 80); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestTargetString(t *testing.T) {
+	tests := []struct {
+		target   Target
+		expected string
+	}{
+		{Target{"localhost", 80}, "localhost:80"},
+		{Target{"::1", 8080}, "[::1]:8080"},
+	}
+	for _, test := range tests {
+		if s := test.target.String(); s != test.expected {
+			t.Errorf("Expected %q, got %q", test.expected, s)
+		}
+	}
+}
+
+// Read the comparison table back as one map of column to value per row,
+// with anything beyond the last column under "FLAGS"
+func readComparison(t *testing.T, table string) []map[string]string {
+	lines := strings.Split(strings.TrimRight(table, "\n"), "\n")
+	header := strings.Fields(lines[0])
+
+	rows := make([]map[string]string, 0, len(lines)-1)
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < len(header) {
+			break
+		}
+		row := make(map[string]string)
+		for i, name := range header {
+			row[name] = fields[i]
+		}
+		row["FLAGS"] = strings.Join(fields[len(header):], " ")
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func comparisonData(cps, replies, connTime, errors float64) *PerfData {
+	return &PerfData{ConnectionsPerSecond: cps, RepliesPerSecAvg: replies, ConnectionTimeAvg: connTime, ErrTotal: errors}
+}
+
+func TestComparison(t *testing.T) {
+	a := &Target{"a", 80}
+	b := &Target{"b", 80}
+	cmp := NewComparison()
+
+	// Added out of order, b before a at the same rate
+	cmp.Add(b, &ahpproto.Args{ConnectionRate: 200, RequestsPerConnection: 1},
+		[]*PerfData{comparisonData(100, 100, 2, 0), comparisonData(90, 95, 4, 3)}, true)
+	cmp.Add(a, &ahpproto.Args{ConnectionRate: 200, RequestsPerConnection: 1},
+		[]*PerfData{comparisonData(180, 180, 1, 0)}, false)
+	cmp.Add(b, &ahpproto.Args{ConnectionRate: 100, RequestsPerConnection: 1},
+		[]*PerfData{comparisonData(100, 100, 1, 0)}, true)
+
+	// A step with a result that failed validation, recorded despite a failed
+	// worker
+	failed := comparisonData(50, 50, 1, 0)
+	failed.FailPolicy = "drop"
+	failed.Issues = []*Issue{{Severity: Error}}
+	cmp.Add(a, &ahpproto.Args{ConnectionRate: 300, RequestsPerConnection: 1}, []*PerfData{failed}, true)
+	cmp.Note(a, "saturated at 200")
+
+	var out bytes.Buffer
+	cmp.Write(&out)
+	rows := readComparison(t, out.String())
+
+	// The targets keep the order they were first added in at equal rates
+	expected := []map[string]string{
+		{"RATE": "100", "TARGET": "b:80", "CONN/S": "100.0", "REPLY/S": "100.0", "CONNTIME[ms]": "1.0", "ERRORS": "0", "WORKERS": "1", "FLAGS": ""},
+		{"RATE": "200", "TARGET": "b:80", "CONN/S": "190.0", "REPLY/S": "195.0", "CONNTIME[ms]": "3.0", "ERRORS": "3", "WORKERS": "2", "FLAGS": ""},
+		{"RATE": "200", "TARGET": "a:80", "CONN/S": "180.0", "REPLY/S": "180.0", "CONNTIME[ms]": "1.0", "ERRORS": "0", "WORKERS": "1", "FLAGS": "(incomplete)"},
+		{"RATE": "300", "TARGET": "a:80", "CONN/S": "50.0", "REPLY/S": "50.0", "CONNTIME[ms]": "1.0", "ERRORS": "0", "WORKERS": "1", "FLAGS": "(untrustworthy) (drop)"},
+	}
+	if len(rows) != len(expected) {
+		t.Fatalf("Expected %d rows, got:\n%s", len(expected), out.String())
+	}
+	for i, fields := range expected {
+		for name, value := range fields {
+			if rows[i][name] != value {
+				t.Errorf("Row %d: expected %s %q, got %q", i, name, value, rows[i][name])
+			}
+		}
+	}
+
+	// Notes follow the table
+	lines := strings.Split(strings.TrimRight(out.String(), "\n"), "\n")
+	if note := lines[len(lines)-1]; note != "a:80: saturated at 200" {
+		t.Errorf("Unexpected note %q", note)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import "bufio"
+import "errors"
+import "fmt"
+import "io"
+import "os"
+import "strconv"
+import "strings"
+
+// Settings for the workers, read from the -capacities and -config files.
+// Each line is a directive followed by its arguments, and everything after a
+// '#' is a comment:
+//
+//	weight <addr> <value>     give the worker at addr a share of the load
+//	                          proportional to value, rather than probing it
+//	capacity <addr> <rate>    the highest connection rate the worker at addr
+//	                          can generate, as found by -calibrate
+//	pool <name> <selector>    the workers whose labels match selector, e.g.
+//	                          "zone=eu,size!=small", chosen with -pool name
+type Config struct {
+	weights    map[string]float64
+	capacities map[string]int
+	pools      map[string]Selector
+}
+
+func NewConfig() *Config {
+	return &Config{make(map[string]float64), make(map[string]int), make(map[string]Selector)}
+}
+
+func ParseConfig(r io.Reader) (*Config, error) {
+	config := NewConfig()
+	if err := config.parse(r); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Add the settings in a file to the config, replacing any for the same
+// workers that were loaded before
+func (config *Config) Load(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return config.parse(file)
+}
+
+func (config *Config) parse(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = line[:idx]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "weight":
+			if len(fields) != 3 {
+				return errors.New(fmt.Sprintf("line %d: expected \"weight <addr> <value>\"", lineno))
+			}
+			weight, err := strconv.ParseFloat(fields[2], 64)
+			if err != nil || weight <= 0 {
+				return errors.New(fmt.Sprintf("line %d: invalid weight %q", lineno, fields[2]))
+			}
+			config.weights[fields[1]] = weight
+		case "capacity":
+			if len(fields) != 3 {
+				return errors.New(fmt.Sprintf("line %d: expected \"capacity <addr> <rate>\"", lineno))
+			}
+			capacity, err := strconv.Atoi(fields[2])
+			if err != nil || capacity <= 0 {
+				return errors.New(fmt.Sprintf("line %d: invalid capacity %q", lineno, fields[2]))
+			}
+			config.capacities[fields[1]] = capacity
+		case "pool":
+			if len(fields) != 3 {
+				return errors.New(fmt.Sprintf("line %d: expected \"pool <name> <selector>\"", lineno))
+			}
+			selector, err := ParseSelector(fields[2])
+			if err != nil {
+				return errors.New(fmt.Sprintf("line %d: %s", lineno, err))
+			}
+			config.pools[fields[1]] = selector
+		default:
+			return errors.New(fmt.Sprintf("line %d: unknown directive %q", lineno, fields[0]))
+		}
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,112 @@
+package main
+
+import "bufio"
+import "crypto/tls"
+import "crypto/x509"
+import "errors"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "net"
+import "net/http"
+import "net/rpc"
+import "os"
+import "strings"
+
+import "github.com/SpeedyCoder/autohttperf/ahpproto"
+
+// The status line net/rpc answers a successful CONNECT with
+const rpcConnected = "200 Connected to Go RPC"
+
+// The TLS settings for talking to the workers, built from the flags
+func workerTLSConfig() (*tls.Config, error) {
+	config := new(tls.Config)
+
+	if len(*tlsCA) > 0 {
+		pem, err := ioutil.ReadFile(*tlsCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New(fmt.Sprintf("No certificates found in %s", *tlsCA))
+		}
+		config.RootCAs = pool
+	}
+
+	if len(*tlsCert) > 0 {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// Open an RPC connection to a worker daemon. This is rpc.DialHTTP, except
+// that it can use TLS and presents the -token on the CONNECT request.
+func dialWorker(addr string) (*rpc.Client, error) {
+	var conn net.Conn
+	var err error
+
+	if *useTLS {
+		var config *tls.Config
+		if config, err = workerTLSConfig(); err != nil {
+			return nil, err
+		}
+		conn, err = tls.Dial("tcp", addr, config)
+	} else {
+		conn, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	connect := fmt.Sprintf("CONNECT %s HTTP/1.0\r\n", rpc.DefaultRPCPath)
+	if len(*token) > 0 {
+		connect += fmt.Sprintf("Authorization: Bearer %s\r\n", *token)
+	}
+	io.WriteString(conn, connect+"\r\n")
+
+	// Require a successful HTTP response before switching to RPC
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status == rpcConnected {
+		return rpc.NewClient(conn), nil
+	}
+	if err == nil {
+		// Pass on the daemon's reason, e.g. an invalid token
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		err = errors.New(fmt.Sprintf("worker refused the connection: %s: %s", resp.Status, strings.TrimSpace(string(body))))
+	}
+	conn.Close()
+	return nil, err
+}
+
+// Check that a worker speaks the same version of the protocol. Daemons from
+// before the handshake do not have the Hello call, and are refused as well.
+func handshake(client *rpc.Client) error {
+	reply := new(ahpproto.Hello)
+	err := client.Call("HTTPerf.Hello", &ahpproto.Hello{Version: ahpproto.Version}, reply)
+	if _, ok := err.(rpc.ServerError); ok && strings.Contains(err.Error(), "can't find method") {
+		return ahpproto.CheckVersion("coordinator", "daemon", 0)
+	}
+	if err != nil {
+		return err
+	}
+	return ahpproto.CheckVersion("coordinator", "daemon", reply.Version)
+}
+
+// Who the benchmarks are run for by default, e.g. "alice@bench1 (pid 42)", so
+// that someone finding a worker busy knows who to ask
+func defaultOwner() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	if user := os.Getenv("USER"); len(user) > 0 {
+		host = user + "@" + host
+	}
+	return fmt.Sprintf("%s (pid %d)", host, os.Getpid())
+}
@@ -0,0 +1,121 @@
+package main
+
+import "log"
+import "math"
+import "sort"
+
+import "github.com/SpeedyCoder/autohttperf/ahpproto"
+
+// Split total into whole shares proportional to weights. Every share is
+// rounded down, and the units that leaves over go to the shares with the
+// largest remainders, so the shares always add up to exactly total.
+func distribute(total int, weights []float64) []int {
+	shares := make([]int, len(weights))
+
+	var sum float64
+	for _, weight := range weights {
+		sum += weight
+	}
+	if total <= 0 || sum <= 0 {
+		return shares
+	}
+
+	order := make([]int, len(weights))
+	remainders := make([]float64, len(weights))
+	assigned := 0
+	for i, weight := range weights {
+		exact := float64(total) * weight / sum
+		shares[i] = int(math.Floor(exact))
+		remainders[i] = exact - float64(shares[i])
+		assigned += shares[i]
+		order[i] = i
+	}
+
+	// Ties go to the earlier worker, so the split is repeatable
+	sort.SliceStable(order, func(a, b int) bool {
+		return remainders[order[a]] > remainders[order[b]]
+	})
+	for i := 0; assigned < total; i++ {
+		shares[order[i%len(order)]]++
+		assigned++
+	}
+
+	return shares
+}
+
+// A worker's share of the load of a benchmark
+type loadShare struct {
+	connections int
+	rate        int
+	concurrency int
+}
+
+// Split the load of a benchmark over workers by weight. A worker without any
+// clients of a closed-loop benchmark would fall back to running httperf, and
+// one without a rate would run httperf as fast as it can, so the workers
+// whose share rounds down to nothing are left out first, with a nil share,
+// and the load is split over the rest. The shares add up to the totals.
+func splitLoad(args *ahpproto.Args, weights []float64) []*loadShare {
+	weights = append([]float64(nil), weights...)
+	for {
+		rates := distribute(args.ConnectionRate, weights)
+		concurrency := distribute(args.Concurrency, weights)
+
+		left := false
+		for i := range weights {
+			if weights[i] > 0 && ((args.Concurrency > 0 && concurrency[i] == 0) ||
+				(args.Concurrency == 0 && args.ConnectionRate > 0 && rates[i] == 0)) {
+				weights[i] = 0
+				left = true
+			}
+		}
+		if left {
+			continue
+		}
+
+		connections := distribute(args.NumConnections, weights)
+		shares := make([]*loadShare, len(weights))
+		for i := range weights {
+			if weights[i] > 0 {
+				shares[i] = &loadShare{connections[i], rates[i], concurrency[i]}
+			}
+		}
+		return shares
+	}
+}
+
+// The number of cores a probed worker generates load with: those its httperf
+// processes can use, since a single httperf runs on one core however many
+// the worker has
+func probedCores(info *ahpproto.Info) int {
+	if info.Procs > 0 && info.Procs < info.NumCPU {
+		return info.Procs
+	}
+	return info.NumCPU
+}
+
+// Set the share of the load each worker takes. A weight given in the config
+// is used as is, then a calibrated capacity, otherwise with -probe the worker
+// is asked for the number of cores it generates load with. Workers that cannot be probed, such as
+// older daemons without the Info call, keep a weight of 1.
+func setWorkerWeights(workers []*Worker, config *Config, probe bool) {
+	for _, worker := range workers {
+		worker.weight = 1
+		worker.capacity = config.capacities[worker.addr]
+
+		if weight, ok := config.weights[worker.addr]; ok {
+			worker.weight = weight
+		} else if worker.capacity > 0 {
+			worker.weight = float64(worker.capacity)
+		} else if probe {
+			info := new(ahpproto.Info)
+			if err := worker.client.Call("HTTPerf.Info", 0, info); err != nil {
+				log.Printf("[%s] Could not probe worker, using a weight of 1: %s", worker.id, err)
+			} else if cores := probedCores(info); cores > 0 {
+				worker.weight = float64(cores)
+			}
+		}
+
+		log.Printf("[%s] Load weight %.3g", worker.id, worker.weight)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import "bufio"
+import "io"
+import "io/ioutil"
+import "net"
+import "net/http"
+import "path/filepath"
+import "reflect"
+import "strings"
+import "testing"
+
+import "github.com/SpeedyCoder/autohttperf/ahpproto"
+
+func TestDistribute(t *testing.T) {
+	tests := []struct {
+		total    int
+		weights  []float64
+		expected []int
+	}{
+		{10, []float64{1, 1, 1}, []int{4, 3, 3}},
+		{100, []float64{16, 2}, []int{89, 11}},
+		{7, []float64{1, 0.5, 0.5}, []int{3, 2, 2}},
+		{1, []float64{1, 1, 1}, []int{1, 0, 0}},
+		{0, []float64{1, 1}, []int{0, 0}},
+	}
+
+	for _, test := range tests {
+		shares := distribute(test.total, test.weights)
+		if !reflect.DeepEqual(shares, test.expected) {
+			t.Errorf("distribute(%d, %v): expected %v, got %v", test.total, test.weights, test.expected, shares)
+		}
+	}
+}
+
+func TestSplitLoad(t *testing.T) {
+	tests := []struct {
+		args     *ahpproto.Args
+		weights  []float64
+		expected []*loadShare
+	}{
+		// The whole of the load goes to the workers that take part
+		{&ahpproto.Args{NumConnections: 60, ConnectionRate: 1}, []float64{1, 1, 1},
+			[]*loadShare{{60, 1, 0}, nil, nil}},
+		{&ahpproto.Args{NumConnections: 100, ConnectionRate: 2}, []float64{1, 1, 1},
+			[]*loadShare{{50, 1, 0}, {50, 1, 0}, nil}},
+		{&ahpproto.Args{Concurrency: 2, Duration: 60}, []float64{1, 1, 1},
+			[]*loadShare{{0, 0, 1}, {0, 0, 1}, nil}},
+		{&ahpproto.Args{NumConnections: 90, ConnectionRate: 30}, []float64{1, 1, 1},
+			[]*loadShare{{30, 10, 0}, {30, 10, 0}, {30, 10, 0}}},
+		// Without a rate, httperf runs every worker as fast as it can
+		{&ahpproto.Args{NumConnections: 3}, []float64{1, 1, 1, 1},
+			[]*loadShare{{1, 0, 0}, {1, 0, 0}, {1, 0, 0}, {0, 0, 0}}},
+	}
+
+	for _, test := range tests {
+		shares := splitLoad(test.args, test.weights)
+		if !reflect.DeepEqual(shares, test.expected) {
+			t.Errorf("splitLoad(%+v, %v): expected %v, got %v", test.args, test.weights, test.expected, shares)
+		}
+	}
+}
+
+// A worker running a single httperf is worth one core however many it has
+func TestProbedCores(t *testing.T) {
+	tests := []struct {
+		info     ahpproto.Info
+		expected int
+	}{
+		{ahpproto.Info{NumCPU: 8, Procs: 1}, 1},
+		{ahpproto.Info{NumCPU: 8, Procs: 4}, 4},
+		{ahpproto.Info{NumCPU: 2, Procs: 4}, 2},
+		{ahpproto.Info{NumCPU: 8}, 8},
+	}
+	for _, test := range tests {
+		if cores := probedCores(&test.info); cores != test.expected {
+			t.Errorf("%+v: expected %d cores, got %d", test.info, test.expected, cores)
+		}
+	}
+}
+
+// Load moved off a saturated worker for one target is not moved for another
+func TestRebalancePerTarget(t *testing.T) {
+	workers := []*Worker{{id: "a", weight: 1}, {id: "b", weight: 1}}
+	first, second := &connStress{}, &connStress{}
+
+	configured := first.loadWeights(workers)
+	workers[0].saturated = "client CPU at 100%"
+	if !rebalanceWorkers(workers) {
+		t.Fatalf("Expected the load to be moved")
+	}
+	first.weights = currentWeights(workers)
+	applyWeights(workers, configured)
+	workers[0].saturated = ""
+
+	for _, test := range []struct {
+		state    *connStress
+		expected []float64
+	}{
+		{second, []float64{1, 1}},
+		{first, []float64{0.5, 1}},
+		{second, []float64{1, 1}},
+	} {
+		configured := test.state.loadWeights(workers)
+		if weights := currentWeights(workers); !reflect.DeepEqual(weights, test.expected) {
+			t.Errorf("Expected weights %v, got %v", test.expected, weights)
+		}
+		applyWeights(workers, configured)
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	config, err := ParseConfig(strings.NewReader("# Workers\nweight big:1717 16\n\nweight small:1717 2 # laptop\ncapacity small:1717 800\n"))
+	if err != nil {
+		t.Fatalf("Failed to parse: %s", err)
+	}
+	if config.weights["big:1717"] != 16 || config.weights["small:1717"] != 2 {
+		t.Errorf("Unexpected weights %v", config.weights)
+	}
+	if config.capacities["small:1717"] != 800 {
+		t.Errorf("Unexpected capacities %v", config.capacities)
+	}
+
+	for _, bad := range []string{"weight big:1717", "weight big:1717 -1", "speed big:1717 2", "capacity big:1717 fast"} {
+		if _, err := ParseConfig(strings.NewReader(bad)); err == nil {
+			t.Errorf("Expected an error for %q", bad)
+		}
+	}
+}
+
+// Calibrating some workers keeps the capacities of the others in the file
+func TestSaveCapacities(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capacities.conf")
+	if err := ioutil.WriteFile(path, []byte("capacity a:1717 100\ncapacity b:1717 200\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	workers := []*Worker{
+		{addr: "b:1717", capacity: 250},
+		{addr: "c:1717", capacity: 300},
+		{addr: "d:1717", capacity: 0},
+	}
+	if err := saveCapacities(path, workers); err != nil {
+		t.Fatalf("Failed to save: %s", err)
+	}
+
+	config := NewConfig()
+	if err := config.Load(path); err != nil {
+		t.Fatalf("Failed to load: %s", err)
+	}
+	expected := map[string]int{"a:1717": 100, "b:1717": 250, "c:1717": 300}
+	if !reflect.DeepEqual(config.capacities, expected) {
+		t.Errorf("Expected capacities %v, got %v", expected, config.capacities)
+	}
+
+	// A file that is not there yet is created
+	path = filepath.Join(t.TempDir(), "new.conf")
+	if err := saveCapacities(path, workers[1:]); err != nil {
+		t.Fatalf("Failed to save: %s", err)
+	}
+	if err := config.Load(path); err != nil {
+		t.Fatalf("Failed to load: %s", err)
+	}
+}
+
+func TestSelector(t *testing.T) {
+	labels := map[string]string{"zone": "eu", "size": "large"}
+	tests := []struct {
+		selector string
+		expected bool
+	}{
+		{"", true},
+		{"zone=eu", true},
+		{"zone=eu,size=large", true},
+		{"zone=eu,size=small", false},
+		{"size!=small", true},
+		{"zone!=eu", false},
+		{"rack=1", false},
+		{"rack!=1", true},
+	}
+
+	for _, test := range tests {
+		selector, err := ParseSelector(test.selector)
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %s", test.selector, err)
+		}
+		if selector.Matches(labels) != test.expected {
+			t.Errorf("%q matching %v: expected %v", test.selector, labels, test.expected)
+		}
+	}
+
+	for _, bad := range []string{"zone", "=eu", "!=eu"} {
+		if _, err := ParseSelector(bad); err == nil {
+			t.Errorf("Expected an error for %q", bad)
+		}
+	}
+
+	config, err := ParseConfig(strings.NewReader("pool eu zone=eu,size!=small\n"))
+	if err != nil {
+		t.Fatalf("Failed to parse: %s", err)
+	}
+	if config.pools["eu"].String() != "zone=eu,size!=small" {
+		t.Errorf("Unexpected pools %v", config.pools)
+	}
+	if _, err := ParseConfig(strings.NewReader("pool eu zone")); err == nil {
+		t.Errorf("Expected an error for an invalid pool")
+	}
+}
+
+func TestFailing(t *testing.T) {
+	abortErrors = 500
+	defer func() { abortErrors = 0 }()
+
+	tests := []struct {
+		samples []float64
+		errors  int
+		failing bool
+	}{
+		{nil, -1, false},
+		{[]float64{120, 0}, -1, false},
+		{[]float64{120, 0, 0}, -1, true},
+		{[]float64{0, 80}, 10, false},
+		{[]float64{120}, 499, false},
+		{[]float64{120}, 500, true},
+	}
+	for _, test := range tests {
+		report := &ahpproto.Progress{Samples: test.samples, Errors: test.errors}
+		if reason := failing(report); (len(reason) > 0) != test.failing {
+			t.Errorf("failing(%v, %d errors) = %q, want failing %v", test.samples, test.errors, reason, test.failing)
+		}
+	}
+
+	abortErrors = 0
+	if reason := failing(&ahpproto.Progress{Errors: 10000}); len(reason) > 0 {
+		t.Errorf("Errors outside a stress test should not fail a step, got %q", reason)
+	}
+}
+
+// A worker registering once the coordinator stopped waiting is turned away
+// rather than told it registered
+func TestAcceptWorkerAfterWait(t *testing.T) {
+	coordinator, worker := net.Pipe()
+	defer worker.Close()
+
+	done := make(chan bool)
+	close(done)
+	errs := make(chan error, 1)
+	go func() {
+		_, err := acceptWorker(coordinator, done)
+		coordinator.Close()
+		errs <- err
+	}()
+
+	io.WriteString(worker, "REGISTER / HTTP/1.0\r\nX-Worker-Name: late:1717\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(worker), nil)
+	if err != nil {
+		t.Fatalf("Failed to read the answer: %s", err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503, got %s", resp.Status)
+	}
+	if err := <-errs; err == nil {
+		t.Errorf("Expected the registration to fail")
+	}
+}
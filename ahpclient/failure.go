@@ -0,0 +1,69 @@
+package main
+
+import "log"
+import "time"
+
+// The policies for -onfail
+var failPolicies = []string{"none", "retry", "reassign", "drop"}
+
+func validFailPolicy(policy string) bool {
+	for _, p := range failPolicies {
+		if p == policy {
+			return true
+		}
+	}
+	return false
+}
+
+// The workers in available that are not in failed
+func healthyWorkers(available, failed []*Worker) []*Worker {
+	healthy := make([]*Worker, 0, len(available))
+	for _, worker := range available {
+		ok := true
+		for _, f := range failed {
+			ok = ok && f != worker
+		}
+		if ok {
+			healthy = append(healthy, worker)
+		}
+	}
+	return healthy
+}
+
+// Decide how to run a step again after some of its workers failed, returning
+// the workers to run it on or nil to give up. The attempt counts from 1.
+//
+//	none      give up straight away, the step has less load than asked for
+//	retry     wait 1, 2, 4... seconds and run it on the same workers
+//	reassign  run it on the healthy workers, which share out the whole load
+//	drop      as reassign, and leave the failed workers out of later steps
+func applyFailPolicy(policy string, attempt int, available, failed []*Worker) []*Worker {
+	switch policy {
+	case "retry":
+		if attempt > *retries {
+			log.Printf("Giving up on the step after %d retries", *retries)
+			return nil
+		}
+		backoff := time.Duration(1<<uint(attempt-1)) * time.Second
+		log.Printf("%d workers failed, retrying in %s", len(failed), backoff)
+		time.Sleep(backoff)
+		return available
+
+	case "reassign", "drop":
+		if policy == "drop" {
+			for _, worker := range failed {
+				log.Printf("[%s] Dropping the worker for the rest of the run", worker.id)
+				worker.dropped = true
+			}
+		}
+
+		healthy := healthyWorkers(available, failed)
+		if len(healthy) == 0 {
+			log.Printf("No healthy workers left to take on the step")
+			return nil
+		}
+		return healthy
+	}
+
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import "errors"
+import "fmt"
+import "log"
+import "net/rpc"
+import "time"
+
+import "github.com/SpeedyCoder/autohttperf/ahpproto"
+
+// How long a benchmark is allowed to take before the worker is declared lost:
+// the time the benchmark should run for, plus time for the last connections
+// to time out, plus any time it may wait for a busy worker, plus -grace for
+// starting and reporting.
+func callDeadline(args *ahpproto.Args) time.Duration {
+	secs := args.Duration
+	if secs <= 0 && args.ConnectionRate > 0 {
+		secs = (args.NumConnections + args.ConnectionRate - 1) / args.ConnectionRate
+	}
+	return time.Duration(secs+2*args.Timeout+args.QueueWait+*grace) * time.Second
+}
+
+// Send a single heartbeat, failing if there is no answer within the interval
+func ping(client *rpc.Client, seq int, interval time.Duration) error {
+	var reply int
+	call := client.Go("HTTPerf.Ping", seq, &reply, make(chan *rpc.Call, 1))
+
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			return call.Error
+		}
+		if reply != seq {
+			return errors.New(fmt.Sprintf("heartbeat %d answered with %d", seq, reply))
+		}
+		return nil
+	case <-time.After(interval):
+		return errors.New("no answer to heartbeat")
+	}
+}
+
+// Renew the lease of a worker's pending benchmark, failing if there is no
+// answer within the interval
+func renew(client *rpc.Client, job string, interval time.Duration) (bool, error) {
+	var renewed bool
+	call := client.Go("HTTPerf.Renew", job, &renewed, make(chan *rpc.Call, 1))
+
+	select {
+	case <-call.Done:
+		return renewed, call.Error
+	case <-time.After(interval):
+		return false, errors.New("no answer to lease renewal")
+	}
+}
+
+// Wait for the pending benchmark of a worker to finish, while polling it
+// with heartbeats every -heartbeat seconds and renewing its lease three
+// times per lease period. Returns an error, and the worker is taken to be
+// lost, if the call outlives its deadline or -maxmissed heartbeats in a row
+// go unanswered. The deadline runs from when the call was made. The call is
+// abandoned rather than cancelled, since net/rpc has no way to do so, but
+// the worker stops once its lease lapses.
+func waitForCall(worker *Worker) (*rpc.Call, error) {
+	deadline := time.NewTimer(time.Until(time.Unix(worker.date, 0).Add(callDeadline(worker.args))))
+	defer deadline.Stop()
+
+	// A nil channel never fires, which disables the heartbeat
+	var beats <-chan time.Time
+	interval := time.Duration(*heartbeat) * time.Second
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		beats = ticker.C
+	}
+
+	var renewals <-chan time.Time
+	renewEvery := time.Duration(worker.args.Lease) * time.Second / 3
+	if worker.args.Lease > 0 {
+		if renewEvery < time.Second {
+			renewEvery = time.Second
+		}
+		ticker := time.NewTicker(renewEvery)
+		defer ticker.Stop()
+		renewals = ticker.C
+	}
+
+	missed := 0
+	for seq := 1; ; seq++ {
+		select {
+		case call := <-worker.call.Done:
+			return call, nil
+
+		case <-deadline.C:
+			return nil, errors.New(fmt.Sprintf("no result within %s", callDeadline(worker.args)))
+
+		case <-beats:
+			err := ping(worker.client, seq, interval)
+			if _, old := err.(rpc.ServerError); old {
+				// The daemon answered, but is too old to know about heartbeats
+				log.Printf("[%s] Worker does not support heartbeats: %s", worker.id, err)
+				beats = nil
+			} else if err != nil {
+				missed++
+				log.Printf("[%s] Missed heartbeat %d of %d: %s", worker.id, missed, *maxMissed, err)
+				if missed >= *maxMissed {
+					return nil, errors.New(fmt.Sprintf("%d heartbeats missed", missed))
+				}
+			} else {
+				missed = 0
+			}
+
+		case <-renewals:
+			renewed, err := renew(worker.client, worker.args.Job, renewEvery)
+			if _, old := err.(rpc.ServerError); old {
+				// Older daemons ignore the lease, so there is nothing to renew
+				log.Printf("[%s] Worker does not support leases: %s", worker.id, err)
+				renewals = nil
+			} else if err != nil {
+				log.Printf("[%s] Could not renew the lease of job %s: %s", worker.id, worker.args.Job, err)
+			} else if !renewed {
+				log.Printf("[%s] Lease of job %s has already lapsed or finished", worker.id, worker.args.Job)
+			}
+		}
+	}
+}
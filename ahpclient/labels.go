@@ -0,0 +1,114 @@
+package main
+
+import "errors"
+import "fmt"
+import "log"
+import "strings"
+
+import "github.com/SpeedyCoder/autohttperf/ahpproto"
+
+// One condition of a selector, that a label has (or with negate, does not
+// have) the given value
+type labelTerm struct {
+	key    string
+	value  string
+	negate bool
+}
+
+// A label selector such as "zone=eu,size!=small", which a worker matches when
+// it meets every condition. The empty selector matches every worker.
+type Selector []labelTerm
+
+func ParseSelector(list string) (Selector, error) {
+	selector := make(Selector, 0, 4)
+	for _, term := range strings.Split(list, ",") {
+		term = strings.TrimSpace(term)
+		if len(term) == 0 {
+			continue
+		}
+
+		negate := false
+		kv := strings.SplitN(term, "!=", 2)
+		if len(kv) == 2 {
+			negate = true
+		} else {
+			kv = strings.SplitN(term, "=", 2)
+		}
+		if len(kv) != 2 || len(strings.TrimSpace(kv[0])) == 0 {
+			return nil, errors.New(fmt.Sprintf("Invalid selector %q, expected key=value or key!=value", term))
+		}
+		selector = append(selector, labelTerm{strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]), negate})
+	}
+	return selector, nil
+}
+
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, term := range s {
+		if (labels[term.key] == term.value) == term.negate {
+			return false
+		}
+	}
+	return true
+}
+
+func (s Selector) String() string {
+	terms := make([]string, len(s))
+	for i, term := range s {
+		op := "="
+		if term.negate {
+			op = "!="
+		}
+		terms[i] = term.key + op + term.value
+	}
+	return strings.Join(terms, ",")
+}
+
+// The selector for this run, from -select and the -pool named in the config.
+// A worker must match both.
+func runSelector(config *Config) Selector {
+	selector, err := ParseSelector(*selectLabels)
+	if err != nil {
+		log.Fatalf("Could not parse -select: %s", err)
+	}
+
+	if len(*pool) > 0 {
+		poolSelector, ok := config.pools[*pool]
+		if !ok {
+			log.Fatalf("Unknown -pool %q, pools are defined in the -config file", *pool)
+		}
+		selector = append(selector, poolSelector...)
+	}
+
+	return selector
+}
+
+// Ask each worker for its labels. Registered workers already gave them, and
+// older daemons without the Info call are left without any.
+func fetchLabels(workers []*Worker) {
+	for _, worker := range workers {
+		if worker.labels != nil {
+			continue
+		}
+
+		info := new(ahpproto.Info)
+		if err := worker.client.Call("HTTPerf.Info", 0, info); err != nil {
+			log.Printf("[%s] Could not ask worker for its labels: %s", worker.id, err)
+		}
+		worker.labels = info.Labels
+	}
+}
+
+// The workers that match the selector. Those that do not are closed, since
+// they take no part in the run.
+func selectWorkers(workers []*Worker, selector Selector) []*Worker {
+	selected := make([]*Worker, 0, len(workers))
+	for _, worker := range workers {
+		if selector.Matches(worker.labels) {
+			selected = append(selected, worker)
+			continue
+		}
+		log.Printf("[%s] Labels %q do not match %q, leaving it out", worker.id, ahpproto.FormatLabels(worker.labels), selector)
+		worker.client.Close()
+	}
+	return selected
+}
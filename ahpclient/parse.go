@@ -1,43 +1,73 @@
 package main
 
+import "bufio"
+import "errors"
 import "fmt"
-import "regexp"
+import "reflect"
 import "strconv"
-import "errors"
-
-var resultPattern = `Maximum connect burst length: ([0-9]*)
+import "strings"
 
-Total: connections ([0-9]*) requests ([0-9]*) replies ([0-9]*) test-duration ([0-9]*\.?[0-9]*) s
+import "github.com/SpeedyCoder/autohttperf/ahpproto"
 
-Connection rate: ([0-9]*\.?[0-9]*) conn/s \(([0-9]*\.?[0-9]*) ms/conn, <=([0-9]*) concurrent connections\)
-Connection time \[ms\]: min ([0-9]*\.?[0-9]*) avg ([0-9]*\.?[0-9]*) max ([0-9]*\.?[0-9]*) median ([0-9]*\.?[0-9]*) stddev ([0-9]*\.?[0-9]*)
-Connection time \[ms\]: connect ([0-9]*\.?[0-9]*)
-Connection length \[replies/conn\]: ([0-9]*\.?[0-9]*)
+// The header of the histogram printed by httperf --verbose --verbose. Each
+// following line is a bucket, with ":" marking a run of empty buckets.
+const lifetimeHistogram = "Connection lifetime histogram"
 
-Request rate: ([0-9]*\.?[0-9]*) req/s \(([0-9]*\.?[0-9]*) ms/req\)
-Request size \[B\]: ([0-9]*\.?[0-9]*)
+// The reply rate samples printed by httperf --verbose while it runs
+const replyRateSample = "reply-rate ="
 
-Reply rate \[replies/s\]: min ([0-9]*\.?[0-9]*) avg ([0-9]*\.?[0-9]*) max ([0-9]*\.?[0-9]*) stddev ([0-9]*\.?[0-9]*) \(([0-9])* samples\)
-Reply time \[ms\]: response ([0-9]*\.?[0-9]*) transfer ([0-9]*\.?[0-9]*)
-Reply size \[B\]: header ([0-9]*\.?[0-9]*) content ([0-9]*\.?[0-9]*) footer ([0-9]*\.?[0-9]*) \(total ([0-9]*\.?[0-9]*)\)
-Reply status: 1xx=([0-9]*) 2xx=([0-9]*) 3xx=([0-9]*) 4xx=([0-9]*) 5xx=([0-9]*)
-
-CPU time \[s\]: user ([0-9]*\.?[0-9]*) system ([0-9]*\.?[0-9]*) \(user ([0-9]*\.?[0-9]*)\% system ([0-9]*\.?[0-9]*)\% total ([0-9]*\.?[0-9]*)\%\)
-Net I/O: ([0-9]*\.?[0-9]*) (.*) \((.*) bps\)
+// An error found while parsing benchmark output. Line is the 1-based number
+// of the offending line, or 0 when the problem is with the output as a whole.
+type ParseError struct {
+	Line  int
+	Text  string
+	Field string
+	Err   error
+}
 
-Errors: total ([0-9]*) client-timo ([0-9]*) socket-timo ([0-9]*) connrefused ([0-9]*) connreset ([0-9]*)
-Errors: fd-unavail ([0-9]*) addrunavail ([0-9]*) ftab-full ([0-9]*) other ([0-9]*)`
+func (e *ParseError) Error() string {
+	if e.Line == 0 {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("line %d: %s: %s (%q)", e.Line, e.Field, e.Err.Error(), e.Text)
+}
 
-var resultRegexp = regexp.MustCompile(resultPattern)
+// Parses the output of one load generator into data, returning the names of
+// the PerfData fields that were found in it.
+type outputParser func(str string, data *PerfData) (map[string]bool, error)
+
+// The parser for each load generator a worker can report in Result.Backend.
+// Older daemons do not report one at all, and always run httperf.
+var outputParsers = map[string]outputParser{
+	"":        parseHTTPerf,
+	"httperf": parseHTTPerf,
+	"native":  parseHTTPerf,
+	"wrk":     parseWrk,
+	"ab":      parseAB,
+	"vegeta":  parseVegeta,
+}
 
-const NUM_RESULTS = 52
+// The fields only expected when the benchmark was run with Verbose set
+var verboseFields = []string{"ReplyRateSamples", "ConnectionLifetimes"}
 
-func ParseResultsRaw(str string) []string {
-	return resultRegexp.FindStringSubmatch(str)
+// Parse the output of httperf, see ParseBackendResults
+func ParseResults(str string, id string, date int64, args *ahpproto.Args) (*PerfData, error) {
+	return ParseBackendResults("httperf", str, id, date, args)
 }
 
-func ParseResults(str string, id string, date int64, args *Args) (*PerfData, error) {
-	results := ParseResultsRaw(str)
+// Parse the output of the given load generator. Any field the generator did
+// not provide is listed in Missing rather than treated as an error. An error
+// is returned only when a value is present but cannot be parsed, or when the
+// output contains no results.
+func ParseBackendResults(backend string, str string, id string, date int64, args *ahpproto.Args) (*PerfData, error) {
+	parser, ok := outputParsers[backend]
+	if !ok {
+		return nil, &ParseError{0, "", "", errors.New(fmt.Sprintf("no parser for load generator %q", backend))}
+	}
+	if len(backend) == 0 {
+		backend = "httperf"
+	}
+
 	data := new(PerfData)
 
 	data.BenchmarkId = id
@@ -49,281 +79,139 @@ func ParseResults(str string, id string, date int64, args *Args) (*PerfData, err
 	data.ArgConnectionRate = args.ConnectionRate
 	data.ArgRequestsPerConnection = args.RequestsPerConnection
 	data.ArgDuration = args.Duration
+	data.ArgConcurrency = args.Concurrency
+	data.Backend = backend
+	data.Raw = str
 
-	var conv float64
-	var err error
-	data.All = make([]float64, 49)
-	i := 0
-
-	data.Raw = results[0]
-	if conv, err = strconv.ParseFloat(results[1], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 1, err.Error()))
-	}
-	data.ConnectionBurstLength = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[2], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 2, err.Error()))
-	}
-	data.TotalConnections = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[3], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 3, err.Error()))
-	}
-	data.TotalRequests = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[4], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 4, err.Error()))
-	}
-	data.TotalReplies = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[5], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 5, err.Error()))
-	}
-	data.TestDuration = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[6], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 6, err.Error()))
-	}
-	data.ConnectionsPerSecond = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[7], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 7, err.Error()))
-	}
-	data.MsPerConnection = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[8], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 8, err.Error()))
-	}
-	data.ConcurrentConnections = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[9], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 9, err.Error()))
-	}
-	data.ConnectionTimeMin = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[10], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 10, err.Error()))
-	}
-	data.ConnectionTimeAvg = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[11], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 11, err.Error()))
-	}
-	data.ConnectionTimeMax = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[12], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 12, err.Error()))
-	}
-	data.ConnectionTimeMedian = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[13], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 13, err.Error()))
-	}
-	data.ConnectionTimeStddev = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[14], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 14, err.Error()))
-	}
-	data.ConnectionTimeConnect = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[15], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 15, err.Error()))
-	}
-	data.RepliesPerConnection = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[16], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 16, err.Error()))
-	}
-	data.RequestsPerSecond = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[17], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 17, err.Error()))
-	}
-	data.MsPerRequest = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[18], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 18, err.Error()))
-	}
-	data.RequestSize = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[19], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 19, err.Error()))
-	}
-	data.RepliesPerSecMin = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[20], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 20, err.Error()))
-	}
-	data.RepliesPerSecAvg = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[21], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 21, err.Error()))
-	}
-	data.RepliesPerSecMax = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[22], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 22, err.Error()))
-	}
-	data.RepliesPerSecStddev = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[23], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 23, err.Error()))
+	found, err := parser(str, data)
+	if err != nil {
+		return nil, err
 	}
-	data.RepliesPerSecNumSamples = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[24], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 24, err.Error()))
-	}
-	data.ReplyTimeResponse = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[25], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 25, err.Error()))
-	}
-	data.ReplyTimeTransfer = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[26], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 26, err.Error()))
-	}
-	data.ReplySizeHeader = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[27], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 27, err.Error()))
-	}
-	data.ReplySizeContent = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[28], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 28, err.Error()))
-	}
-	data.ReplySizeFooter = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[29], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 29, err.Error()))
-	}
-	data.ReplySizeTotal = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[30], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 30, err.Error()))
-	}
-	data.ReplyStatus_1xx = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[31], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 31, err.Error()))
-	}
-	data.ReplyStatus_2xx = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[32], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 32, err.Error()))
-	}
-	data.ReplyStatus_3xx = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[33], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 33, err.Error()))
-	}
-	data.ReplyStatus_4xx = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[34], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 34, err.Error()))
-	}
-	data.ReplyStatus_5xx = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[35], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 35, err.Error()))
-	}
-	data.CpuTimeUser = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[36], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 36, err.Error()))
-	}
-	data.CpuTimeSystem = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[37], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 37, err.Error()))
-	}
-	data.CpuPercUser = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[38], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 38, err.Error()))
-	}
-	data.CpuPercSystem = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[39], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 39, err.Error()))
-	}
-	data.CpuPercTotal = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[40], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 40, err.Error()))
-	}
-	data.NetIOValue = conv
-	data.All[i] = conv; i++
-	data.NetIOUnit = results[41]
-	data.NetIOBytesPerSecond = results[42]
-	if conv, err = strconv.ParseFloat(results[43], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 43, err.Error()))
-	}
-	data.ErrTotal = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[44], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 44, err.Error()))
-	}
-	data.ErrClientTimeout = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[45], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 45, err.Error()))
-	}
-	data.ErrSocketTimeout = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[46], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 46, err.Error()))
-	}
-	data.ErrConnectionRefused = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[47], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 47, err.Error()))
-	}
-	data.ErrConnectionReset = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[48], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 48, err.Error()))
+
+	if len(found) == 0 {
+		return nil, &ParseError{0, "", "", errors.New(fmt.Sprintf("no %s results found in output", backend))}
 	}
-	data.ErrFdUnavail = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[49], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 49, err.Error()))
+
+	for _, m := range perfSchema.httperf {
+		if !found[m.name] {
+			data.Missing = append(data.Missing, m.name)
+		}
 	}
-	data.ErrAddRunAvail = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[50], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 50, err.Error()))
+
+	if args.Verbose {
+		for _, field := range verboseFields {
+			if !found[field] {
+				data.Missing = append(data.Missing, field)
+			}
+		}
 	}
-	data.ErrFtabFull = conv
-	data.All[i] = conv; i++
-	if conv, err = strconv.ParseFloat(results[51], 64); err != nil {
-		return nil, errors.New(fmt.Sprintf("Error parsing field %d:%s", 51, err.Error()))
+
+	if len(data.ConnectionLifetimes) > 0 {
+		data.ConnectionTimeP50 = data.LifetimePercentile(50)
+		data.ConnectionTimeP90 = data.LifetimePercentile(90)
+		data.ConnectionTimeP99 = data.LifetimePercentile(99)
 	}
-	data.ErrOther = conv
-	data.All[i] = conv; i++
+
+	data.All = aggregateValues(data)
 
 	return data, nil
 }
 
-/* The following Lua script was used to generate the above code:
+// Set a numeric PerfData field by name, recording that it was found
+func setField(data *PerfData, found map[string]bool, field string, value float64) {
+	reflect.ValueOf(data).Elem().FieldByName(field).SetFloat(value)
+	found[field] = true
+}
 
-local fields = {"Raw", "ConnectionBurstLength", "TotalConnections", "TotalRequests", "TotalReplies", "TestDuration", "ConnectionsPerSecond", "MsPerConnection", "ConcurrentConnections", "ConnectionTimeMin", "ConnectionTimeAvg", "ConnectionTimeMax", "ConnectionTimeMedian", "ConnectionTimeStddev", "ConnectionTimeConnect", "RepliesPerConnection", "RequestsPerSecond", "MsPerRequest", "RequestSize", "RepliesPerSecMin", "RepliesPerSecAvg", "RepliesPerSecMax", "RepliesPerSecStddev", "RepliesPerSecNumSamples", "ReplyTimeResponse", "ReplyTimeTransfer", "ReplySizeHeader", "ReplySizeContent", "ReplySizeFooter", "ReplySizeTotal", "ReplyStatus_1xx", "ReplyStatus_2xx", "ReplyStatus_3xx", "ReplyStatus_4xx", "ReplyStatus_5xx",
-"CpuTimeUser", "CpuTimeSystem", "CpuPercUser", "CpuPercSystem", "CpuPercTotal", "NetIOValue", "NetIOUnit", "NetIOBytesPerSecond", "ErrTotal", "ErrClientTimeout", "ErrSocketTimeout", "ErrConnectionRefused", "ErrConnectionReset", "ErrFdUnavail", "ErrAddRunAvail", "ErrFtabFull", "ErrOther"}
+// Parse the output of httperf line by line. Lines that are not recognised
+// are ignored.
+func parseHTTPerf(str string, data *PerfData) (map[string]bool, error) {
+	val := reflect.ValueOf(data).Elem()
+	found := make(map[string]bool)
+	inHistogram := false
+
+	scanner := bufio.NewScanner(strings.NewReader(str))
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		if inHistogram {
+			bucket, ok, err := parseHistogramLine(line)
+			if err != nil {
+				return nil, &ParseError{lineno, line, "ConnectionLifetimes", err}
+			}
+			if ok {
+				data.ConnectionLifetimes = append(data.ConnectionLifetimes, bucket)
+				continue
+			}
+			inHistogram = line == ":"
+			if inHistogram || len(line) == 0 {
+				continue
+			}
+		}
+
+		if strings.HasPrefix(line, lifetimeHistogram) {
+			inHistogram = true
+			found["ConnectionLifetimes"] = true
+			continue
+		}
+
+		if strings.HasPrefix(line, replyRateSample) {
+			sample := strings.TrimSpace(strings.TrimPrefix(line, replyRateSample))
+			conv, err := strconv.ParseFloat(sample, 64)
+			if err != nil {
+				return nil, &ParseError{lineno, line, "ReplyRateSamples", errors.New(fmt.Sprintf("invalid value %q", sample))}
+			}
+			data.ReplyRateSamples = append(data.ReplyRateSamples, conv)
+			found["ReplyRateSamples"] = true
+			continue
+		}
+
+		for _, m := range perfSchema.httperf {
+			if !strings.HasPrefix(line, m.prefix) || found[m.name] {
+				continue
+			}
+
+			match := m.regexp.FindStringSubmatch(line)
+			if match == nil {
+				continue
+			}
+
+			field := val.Field(m.index)
+			if m.kind == reflect.String {
+				field.SetString(match[1])
+			} else {
+				conv, err := strconv.ParseFloat(match[1], 64)
+				if err != nil {
+					return nil, &ParseError{lineno, line, m.name, errors.New(fmt.Sprintf("invalid value %q", match[1]))}
+				}
+				field.SetFloat(conv)
+			}
+			found[m.name] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, &ParseError{0, "", "", err}
+	}
+
+	return found, nil
+}
 
-local strings = {Raw = true, NetIOUnit = true, NetIOBytesPerSecond = true}
+// Parse a single "<ms> <count>" line of the lifetime histogram. Returns false
+// if the line is not a histogram bucket at all.
+func parseHistogramLine(line string) (HistogramBucket, bool, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 {
+		return HistogramBucket{}, false, nil
+	}
 
-for idx, field in ipairs(fields) do
-	if strings[field] then
-		print(string.format("data.%s = results[%d]", field, idx - 1))
-	else
-		print(string.format("if conv, err = strconv.ParseFloat(results[%d], 64); err != nil {", idx - 1))
-		print(string.format([[	return nil, errors.New(fmt.Sprintf("Error parsing field %%d:%%s", %d, err.Error()))]], idx - 1))
-		print(string.format("}"))
-		print(string.format("data.%s = conv
-		data.All[i] = conv; i++", field))
-	end
-end
+	ms, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return HistogramBucket{}, false, nil
+	}
+	count, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return HistogramBucket{}, false, errors.New(fmt.Sprintf("invalid bucket count %q", fields[1]))
+	}
 
-*/
+	return HistogramBucket{ms, count}, true, nil
+}
@@ -1,9 +1,12 @@
 package main
 
+import "io/ioutil"
 import "reflect"
-import "strconv"
+import "strings"
 import "testing"
 
+import "github.com/SpeedyCoder/autohttperf/ahpproto"
+
 var testData = `Maximum connect burst length: 1
 
 Total: connections 10000 requests 10000 replies 10000 test-duration 6.964 s
@@ -27,109 +30,473 @@ Net I/O: 6101.1 KB/s (50.0*10^6 bps)
 Errors: total 0 client-timo 0 socket-timo 0 connrefused 0 connreset 0
 Errors: fd-unavail 0 addrunavail 0 ftab-full 0 other 0`
 
-var expectedNums = map[int]float64{
-	// Index 0 will contain the entire match
-	1: 1,
-	2: 10000, 3: 10000, 4: 10000, 5: 6.964,
+var expectedNums = map[string]float64{
+	"ConnectionBurstLength": 1,
+	"TotalConnections":      10000, "TotalRequests": 10000, "TotalReplies": 10000, "TestDuration": 6.964,
 
-	6: 1435.9, 7: 0.7, 8: 1,
-	9: 0.2, 10: 0.7, 11: 27.4, 12: 0.5, 13: 0.7,
-	14: 0.1,
-	15: 1.0,
+	"ConnectionsPerSecond": 1435.9, "MsPerConnection": 0.7, "ConcurrentConnections": 1,
+	"ConnectionTimeMin": 0.2, "ConnectionTimeAvg": 0.7, "ConnectionTimeMax": 27.4,
+	"ConnectionTimeMedian": 0.5, "ConnectionTimeStddev": 0.7,
+	"ConnectionTimeConnect": 0.1,
+	"RepliesPerConnection":  1.0,
 
-	16: 1435.9, 17: 0.7,
-	18: 72.0,
+	"RequestsPerSecond": 1435.9, "MsPerRequest": 0.7,
+	"RequestSize": 72.0,
 
-	19: 1444.8, 20: 1444.8, 21: 1444.8, 22: 0.0, 23: 1,
-	24: 0.5, 25: 0.1,
-	26: 170, 27: 4109, 28: 2.0, 29: 4281,
-	30: 0, 31: 10000, 32: 0, 33: 0, 34: 0,
+	"RepliesPerSecMin": 1444.8, "RepliesPerSecAvg": 1444.8, "RepliesPerSecMax": 1444.8,
+	"RepliesPerSecStddev": 0.0, "RepliesPerSecNumSamples": 1,
+	"ReplyTimeResponse": 0.5, "ReplyTimeTransfer": 0.1,
+	"ReplySizeHeader": 170, "ReplySizeContent": 4109, "ReplySizeFooter": 2.0, "ReplySizeTotal": 4281,
+	"ReplyStatus_1xx": 0, "ReplyStatus_2xx": 10000, "ReplyStatus_3xx": 0, "ReplyStatus_4xx": 0, "ReplyStatus_5xx": 0,
 
-	35: 1.28, 36: 5.22, 37: 18.4, 38: 75.0, 39: 93.5,
-	40: 6101.1,
+	"CpuTimeUser": 1.28, "CpuTimeSystem": 5.22, "CpuPercUser": 18.4, "CpuPercSystem": 75.0, "CpuPercTotal": 93.5,
+	"NetIOValue": 6101.1,
 
-	43: 0, 44: 0, 45: 0, 46: 0, 47: 0,
-	48: 0, 49: 0, 50: 0, 51: 0,
+	"ErrTotal": 0, "ErrClientTimeout": 0, "ErrSocketTimeout": 0, "ErrConnectionRefused": 0, "ErrConnectionReset": 0,
+	"ErrFdUnavail": 0, "ErrAddRunAvail": 0, "ErrFtabFull": 0, "ErrOther": 0,
 }
 
-var expectedStrings = map[int]string{
-	0:  testData,
-	41: "KB/s",
-	42: "50.0*10^6",
+var expectedStrings = map[string]string{
+	"Raw":                 testData,
+	"NetIOUnit":           "KB/s",
+	"NetIOBytesPerSecond": "50.0*10^6",
 }
 
-func TestParseRaw(t *testing.T) {
-	results := ParseResultsRaw(testData)
-	if len(results) != 52 {
-		t.Errorf("Got %d results, was expecting 51", len(results))
+var testArgs = &ahpproto.Args{Host: "localhost", Port: 80, URL: "/"}
+
+func checkFields(t *testing.T, data *PerfData, nums map[string]float64, strs map[string]string) {
+	val := reflect.ValueOf(data).Elem()
+
+	for name, expected := range nums {
+		if result := val.FieldByName(name).Float(); result != expected {
+			t.Errorf("Expected %f for result %s, got %f", expected, name, result)
+		}
 	}
 
-	for idx, value := range expectedNums {
-		conv, err := strconv.Atof64(results[idx])
-		if err != nil {
-			t.Errorf("Unable to convert capture %d to a float: %q", idx, results[idx])
-		} else {
-			if conv != value {
-				t.Errorf("Expected %f for result %d, got %f", value, idx, conv)
-			}
+	for name, expected := range strs {
+		if result := val.FieldByName(name).String(); result != expected {
+			t.Errorf("Expected %q for result %s, got %q", expected, name, result)
 		}
 	}
+}
+
+func TestParse(t *testing.T) {
+	results, err := ParseResults(testData, "id", 0, testArgs)
+	if err != nil {
+		t.Fatalf("Failed to parse: %s", err)
+	}
 
-	for idx, value := range expectedStrings {
-		if value != results[idx] {
-			t.Errorf("Expected %s for result %d, got %s", value, idx, results[idx])
+	checkFields(t, results, expectedNums, expectedStrings)
+
+	if len(results.Missing) != 0 {
+		t.Errorf("Expected no missing fields, got %v", results.Missing)
+	}
+	if len(results.All) != len(perfSchema.aggregates) {
+		t.Errorf("Expected %d aggregate values, got %d", len(perfSchema.aggregates), len(results.All))
+	}
+}
+
+func TestParseMissingSection(t *testing.T) {
+	// Drop the CPU time line entirely
+	lines := strings.Split(testData, "\n")
+	kept := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "CPU time") {
+			kept = append(kept, line)
 		}
 	}
+
+	results, err := ParseResults(strings.Join(kept, "\n"), "id", 0, testArgs)
+	if err != nil {
+		t.Fatalf("Failed to parse: %s", err)
+	}
+
+	expected := []string{"CpuTimeUser", "CpuTimeSystem", "CpuPercUser", "CpuPercSystem", "CpuPercTotal"}
+	if !reflect.DeepEqual(results.Missing, expected) {
+		t.Errorf("Expected missing fields %v, got %v", expected, results.Missing)
+	}
+	if results.TotalConnections != 10000 {
+		t.Errorf("Expected the remaining fields to be parsed, got %f connections", results.TotalConnections)
+	}
 }
 
-var fields = []string{"Raw", "ConnectionBurstLength", "TotalConnections", "TotalRequests", "TotalReplies", "TestDuration", "ConnectionsPerSecond", "MsPerConnection", "ConcurrentConnections", "ConnectionTimeMin", "ConnectionTimeAvg", "ConnectionTimeMax", "ConnectionTimeMedian", "ConnectionTimeStddev", "ConnectionTimeConnect", "RepliesPerConnection", "RequestsPerSecond", "MsPerRequest", "RequestSize", "RepliesPerSecMin", "RepliesPerSecAvg", "RepliesPerSecMax", "RepliesPerSecStddev", "RepliesPerSecNumSamples", "ReplyTimeResponse", "ReplyTimeTransfer", "ReplySizeHeader", "ReplySizeContent", "ReplySizeFooter", "ReplySizeTotal", "ReplyStatus_1xx", "ReplyStatus_2xx", "ReplyStatus_3xx", "ReplyStatus_4xx", "ReplyStatus_5xx", "CpuTimeUser", "CpuTimeSystem", "CpuPercUser", "CpuPercSystem", "CpuPercTotal", "NetIOValue", "NetIOUnit", "NetIOBytesPerSecond", "ErrTotal", "ErrClientTimeout", "ErrSocketTimeout", "ErrConnectionRefused", "ErrConnectionReset", "ErrFdUnavail", "ErrAddRunAvail", "ErrFtabFull", "ErrOther"}
+func TestParseExtraLines(t *testing.T) {
+	extra := "httperf --verbose --server localhost\nreply-rate = 1444.8\nSession rate [sess/s]: min 0.00\n" +
+		testData + "\nSome trailing line"
 
-func TestParse(t *testing.T) {
-	results, err := ParseResults(testData)
+	results, err := ParseResults(extra, "id", 0, testArgs)
 	if err != nil {
-		t.Errorf("Failed to parse: %s", err.String())
-		return
+		t.Fatalf("Failed to parse: %s", err)
 	}
 
-	// Turn the struct into a Type so we can use reflection
-	ptr, ok := reflect.NewValue(results).(*reflect.PtrValue)
-	if !ok {
-		t.Errorf("Could not convert results into a pointer value")
-		return
+	checkFields(t, results, expectedNums, nil)
+}
+
+func TestParseScientific(t *testing.T) {
+	str := strings.Replace(testData, "requests 10000", "requests 1.0e+04", 1)
+
+	results, err := ParseResults(str, "id", 0, testArgs)
+	if err != nil {
+		t.Fatalf("Failed to parse: %s", err)
+	}
+	if results.TotalRequests != 10000 {
+		t.Errorf("Expected 10000 requests, got %f", results.TotalRequests)
 	}
+}
+
+func TestParseBadValue(t *testing.T) {
+	str := strings.Replace(testData, "median 0.5", "median bogus", 1)
 
-	val, ok := ptr.Elem().(*reflect.StructValue)
+	_, err := ParseResults(str, "id", 0, testArgs)
+	perr, ok := err.(*ParseError)
 	if !ok {
-		t.Errorf("Failed when reflecting on struct")
-		return
+		t.Fatalf("Expected a *ParseError, got %#v", err)
 	}
+	if perr.Line != 6 || perr.Field != "ConnectionTimeMedian" {
+		t.Errorf("Expected an error for ConnectionTimeMedian on line 6, got %s", perr)
+	}
+}
 
-	for idx, expected := range expectedNums {
-		// We need to grab the field by name, using the reflect package
-		result := val.FieldByName(fields[idx])
-		if result == nil {
-			t.Errorf("Failed when reflecting field %s", fields[idx])
-		}
+func TestParseEmpty(t *testing.T) {
+	_, err := ParseResults("httperf: command not found", "id", 0, testArgs)
+	if _, ok := err.(*ParseError); !ok {
+		t.Errorf("Expected a *ParseError for output without results, got %#v", err)
+	}
+}
+
+var verboseData = `reply-rate = 1400.2
+reply-rate = 1480.6
+` + testData + `
+
+Connection lifetime histogram (time in ms):
+             0.5 6000
+             1.5 3000
+             :
+             5.5 900
+            27.5 100
+`
+
+func TestParseVerbose(t *testing.T) {
+	args := &ahpproto.Args{Host: "localhost", Port: 80, URL: "/", Verbose: true}
+	results, err := ParseResults(verboseData, "id", 0, args)
+	if err != nil {
+		t.Fatalf("Failed to parse: %s", err)
+	}
+
+	checkFields(t, results, expectedNums, nil)
+
+	if !reflect.DeepEqual(results.ReplyRateSamples, []float64{1400.2, 1480.6}) {
+		t.Errorf("Unexpected reply rate samples %v", results.ReplyRateSamples)
+	}
+
+	expected := []HistogramBucket{{0.5, 6000}, {1.5, 3000}, {5.5, 900}, {27.5, 100}}
+	if !reflect.DeepEqual(results.ConnectionLifetimes, expected) {
+		t.Errorf("Unexpected histogram %v", results.ConnectionLifetimes)
+	}
 
-		fvalue := result.(*reflect.FloatValue)
-		fresult := fvalue.Get()
+	if results.ConnectionTimeP50 != 0.5 || results.ConnectionTimeP90 != 1.5 || results.ConnectionTimeP99 != 5.5 {
+		t.Errorf("Unexpected percentiles %f %f %f", results.ConnectionTimeP50,
+			results.ConnectionTimeP90, results.ConnectionTimeP99)
+	}
+	if len(results.Missing) != 0 {
+		t.Errorf("Expected no missing fields, got %v", results.Missing)
+	}
+}
 
-		if expected != fresult {
-			t.Errorf("Expected %f for result %s, got %f", expected, fields[idx], fresult)
+// The percentiles of all workers together are bounded by the largest of theirs
+func TestAggregatePercentiles(t *testing.T) {
+	a := &PerfData{All: make([]float64, len(perfSchema.aggregates))}
+	b := &PerfData{All: make([]float64, len(perfSchema.aggregates))}
+	found := 0
+	for i, m := range perfSchema.aggregates {
+		switch m.name {
+		case "ConnectionTimeP50", "ConnectionTimeP90", "ConnectionTimeP99":
+			a.All[i], b.All[i] = 5, 9
+			found++
 		}
 	}
+	if found != 3 {
+		t.Fatalf("Expected the 3 percentiles to be aggregated, found %d", found)
+	}
 
-	for idx, expected := range expectedStrings {
-		result := val.FieldByName(fields[idx])
-		if result == nil {
-			t.Errorf("Failed when reflecting field %s", fields[idx])
+	res := AggregatePerfData([]*PerfData{a, b}, 2)
+	for i, m := range perfSchema.aggregates {
+		if a.All[i] == 5 && res[i] != 9 {
+			t.Errorf("Expected %s to aggregate to 9, got %f", m.name, res[i])
 		}
+	}
+}
+
+func TestParseVerboseMissing(t *testing.T) {
+	args := &ahpproto.Args{Host: "localhost", Port: 80, URL: "/", Verbose: true}
+	results, err := ParseResults(testData, "id", 0, args)
+	if err != nil {
+		t.Fatalf("Failed to parse: %s", err)
+	}
+
+	if !reflect.DeepEqual(results.Missing, []string{"ReplyRateSamples", "ConnectionLifetimes"}) {
+		t.Errorf("Expected the verbose fields to be missing, got %v", results.Missing)
+	}
+}
+
+var wrkData = `Running 10s test @ http://localhost:80/
+  1 threads and 50 connections
+  Thread Stats   Avg      Stdev     Max   +/- Stdev
+    Latency     2.50ms  635.91us  12.02ms   80.12%
+    Req/Sec    20.10k     1.21k   22.90k    71.00%
+  Latency Distribution
+     50%    2.40ms
+     90%    3.10ms
+     99%    4.80ms
+  200000 requests in 10.00s, 800.00MB read
+  Socket errors: connect 1, read 2, write 3, timeout 4
+Requests/sec:  20000.00
+Transfer/sec:     80.00MB
+`
 
-		fvalue := result.(*reflect.StringValue)
-		sresult := fvalue.Get()
+func TestParseWrk(t *testing.T) {
+	results, err := ParseBackendResults("wrk", wrkData, "id", 0, testArgs)
+	if err != nil {
+		t.Fatalf("Failed to parse: %s", err)
+	}
+
+	checkFields(t, results, map[string]float64{
+		"ConcurrentConnections": 50, "ReplyTimeResponse": 2.5,
+		"TotalRequests": 200000, "TotalReplies": 200000, "TestDuration": 10, "ReplySizeTotal": 4194.304,
+		"ErrConnectionRefused": 1, "ErrConnectionReset": 2, "ErrOther": 3, "ErrClientTimeout": 4, "ErrTotal": 10,
+		"RequestsPerSecond": 20000, "RepliesPerSecAvg": 20000, "MsPerRequest": 0.05, "NetIOValue": 80,
+	}, map[string]string{"NetIOUnit": "MB/s", "Backend": "wrk"})
+
+	if len(results.Missing) == 0 {
+		t.Errorf("Expected the connection fields to be missing")
+	}
+}
 
-		if expected != sresult {
-			t.Errorf("Expected %s for result %s, got %s", expected, fields[idx], sresult)
+func TestParseWrkNoErrors(t *testing.T) {
+	str := strings.Replace(wrkData, "  Socket errors: connect 1, read 2, write 3, timeout 4\n", "", 1)
+
+	results, err := ParseBackendResults("wrk", str, "id", 0, testArgs)
+	if err != nil {
+		t.Fatalf("Failed to parse: %s", err)
+	}
+	for _, field := range results.Missing {
+		if field == "ErrTotal" {
+			t.Errorf("Expected ErrTotal to be zero rather than missing")
 		}
 	}
 }
+
+var abData = `This is ApacheBench, Version 2.3 <$Revision: 1879490 $>
+
+Benchmarking localhost (be patient)
+
+
+Server Software:        nginx
+Server Hostname:        localhost
+Server Port:            80
+
+Document Path:          /
+Document Length:        612 bytes
+
+Concurrency Level:      10
+Time taken for tests:   2.000 seconds
+Complete requests:      1000
+Failed requests:        10
+Total transferred:      845000 bytes
+HTML transferred:       612000 bytes
+Requests per second:    500.00 [#/sec] (mean)
+Time per request:       20.000 [ms] (mean)
+Time per request:       2.000 [ms] (mean, across all concurrent requests)
+Transfer rate:          412.60 [Kbytes/sec] received
+
+Connection Times (ms)
+              min  mean[+/-sd] median   max
+Connect:        0    1   0.5      1       3
+Processing:     2   19   4.1     18      40
+Waiting:        1   17   4.0     16      38
+Total:          3   20   4.2     19      42
+
+Percentage of the requests served within a certain time (ms)
+  50%     19
+  66%     21
+  75%     22
+  80%     23
+  90%     25
+  95%     28
+  98%     33
+  99%     36
+ 100%     42 (longest request)
+`
+
+func TestParseAB(t *testing.T) {
+	results, err := ParseBackendResults("ab", abData, "id", 0, testArgs)
+	if err != nil {
+		t.Fatalf("Failed to parse: %s", err)
+	}
+
+	checkFields(t, results, map[string]float64{
+		"ConcurrentConnections": 10, "TestDuration": 2,
+		"TotalRequests": 1000, "TotalReplies": 990, "ErrTotal": 10, "TotalConnections": 1000,
+		"ReplySizeTotal": 845, "ReplySizeContent": 612, "ReplySizeHeader": 233,
+		"RequestsPerSecond": 500, "ConnectionsPerSecond": 500, "MsPerRequest": 2, "NetIOValue": 412.6,
+		"ConnectionTimeConnect": 1, "ReplyTimeResponse": 17,
+		"ConnectionTimeMin": 3, "ConnectionTimeAvg": 20, "ConnectionTimeStddev": 4.2,
+		"ConnectionTimeMedian": 19, "ConnectionTimeMax": 42,
+		"ConnectionTimeP50": 19, "ConnectionTimeP90": 25, "ConnectionTimeP99": 36,
+	}, map[string]string{"NetIOUnit": "KB/s", "Backend": "ab"})
+}
+
+var vegetaData = `Requests      [total, rate, throughput]         3000, 100.03, 99.80
+Duration      [total, attack, wait]             30.06s, 29.99s, 70.5ms
+Latencies     [min, mean, 50, 90, 95, 99, max]  1.2ms, 4.5ms, 3.9ms, 6.1ms, 7.3ms, 12ms, 140ms
+Bytes In      [total, mean]                     1836000, 612.00
+Bytes Out     [total, mean]                     0, 0.00
+Success       [ratio]                           99.00%
+Status Codes  [code:count]                      0:30  200:2940  404:30
+Error Set:
+Get "http://localhost:80/": dial tcp: connection refused
+`
+
+func TestParseVegeta(t *testing.T) {
+	results, err := ParseBackendResults("vegeta", vegetaData, "id", 0, testArgs)
+	if err != nil {
+		t.Fatalf("Failed to parse: %s", err)
+	}
+
+	checkFields(t, results, map[string]float64{
+		"TotalRequests": 3000, "RequestsPerSecond": 100.03, "RepliesPerSecAvg": 99.8,
+		"TestDuration": 30.06, "ReplyTimeResponse": 4.5, "ReplySizeContent": 612,
+		"ReplyStatus_2xx": 2940, "ReplyStatus_4xx": 30, "TotalReplies": 2970, "ErrTotal": 30,
+	}, map[string]string{"Backend": "vegeta"})
+}
+
+func TestParseUnknownBackend(t *testing.T) {
+	if _, err := ParseBackendResults("siege", testData, "id", 0, testArgs); err == nil {
+		t.Errorf("Expected an error for an unknown load generator")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	args := &ahpproto.Args{Host: "localhost", Port: 80, URL: "/", NumConnections: 10000, ConnectionRate: 1500}
+	results, err := ParseResults(testData, "id", 0, args)
+	if err != nil {
+		t.Fatalf("Failed to parse: %s", err)
+	}
+
+	// 1435.9 of 1500 conn/s over 6.964 of 6.7 seconds is close enough
+	results.Validate()
+	if len(results.Issues) != 0 {
+		t.Errorf("Expected no issues, got %v", results.Issues)
+	}
+
+	results.ArgConnectionRate = 2000
+	results.Validate()
+	if len(results.Issues) != 1 || results.Issues[0].Severity != Warning || results.Untrustworthy() {
+		t.Errorf("Expected a rate warning, got %v", results.Issues)
+	}
+
+	results.ArgConnectionRate = 1500
+	results.ArgDuration = 60
+	results.TotalReplies = 10001
+	results.Validate()
+	if len(results.Issues) != 2 || !results.Untrustworthy() {
+		t.Errorf("Expected duration and reply errors, got %v", results.Issues)
+	}
+}
+
+func TestValidateMissing(t *testing.T) {
+	args := &ahpproto.Args{Host: "localhost", Port: 80, URL: "/", Duration: 60, ConnectionRate: 5000}
+	results, err := ParseBackendResults("wrk", wrkData, "id", 0, args)
+	if err != nil {
+		t.Fatalf("Failed to parse: %s", err)
+	}
+
+	// wrk reports no connection rate, so only the duration can be checked
+	results.Validate()
+	if len(results.Issues) != 1 || results.Issues[0].Field != "TestDuration" {
+		t.Errorf("Expected only a duration issue, got %v", results.Issues)
+	}
+}
+
+func TestClientSaturated(t *testing.T) {
+	args := &ahpproto.Args{Host: "localhost", Port: 80, URL: "/", NumConnections: 10000, ConnectionRate: 1500}
+	results, err := ParseResults(testData, "id", 0, args)
+	if err != nil {
+		t.Fatalf("Failed to parse: %s", err)
+	}
+	if reason, saturated := results.ClientSaturated(); saturated {
+		t.Errorf("Expected the client not to be saturated, got %q", reason)
+	}
+
+	// httperf --hog uses all of its CPU even when it keeps up with the rate
+	results.CpuPercTotal = 99.5
+	if reason, saturated := results.ClientSaturated(); saturated {
+		t.Errorf("Expected high CPU at the requested rate not to count, got %q", reason)
+	}
+
+	// but not when it also fell short of the rate
+	results.ArgConnectionRate = 1700
+	results.ErrTotal = 10
+	if _, saturated := results.ClientSaturated(); !saturated {
+		t.Errorf("Expected the client to be saturated at 99.5%% CPU and short of the rate")
+	}
+
+	results.ArgConnectionRate = 1500
+	results.ErrTotal = 0
+	results.CpuPercTotal = 50
+	results.ErrFdUnavail = 3
+	if _, saturated := results.ClientSaturated(); !saturated {
+		t.Errorf("Expected the client to be saturated with fd-unavail errors")
+	}
+
+	results.ErrFdUnavail = 0
+	results.ArgConnectionRate = 5000
+	if _, saturated := results.ClientSaturated(); !saturated {
+		t.Errorf("Expected the client to be saturated at under half the rate")
+	}
+
+	// The server refusing connections explains the low rate instead
+	results.ErrTotal = 100
+	results.ErrConnectionRefused = 100
+	if reason, saturated := results.ClientSaturated(); saturated {
+		t.Errorf("Expected the server to be blamed for the low rate, got %q", reason)
+	}
+}
+
+// The output a worker merges from several httperf processes has to parse
+// like that of a single httperf
+func TestParseMerged(t *testing.T) {
+	merged, err := ioutil.ReadFile("../ahpserver/testdata/merged.txt")
+	if err != nil {
+		t.Fatalf("Failed to read the merged output: %s", err)
+	}
+	args := &ahpproto.Args{Host: "localhost", Port: 80, URL: "/", Verbose: true}
+	results, err := ParseResults(string(merged), "id", 0, args)
+	if err != nil {
+		t.Fatalf("Failed to parse: %s", err)
+	}
+
+	checkFields(t, results, map[string]float64{
+		"ConnectionBurstLength": 2,
+		"TotalConnections":      1000, "TotalRequests": 1000, "TotalReplies": 1000, "TestDuration": 10.5,
+		"ConnectionsPerSecond": 100, "ConcurrentConnections": 5,
+		"ConnectionTimeMin": 0.5, "ConnectionTimeAvg": 3.0, "ConnectionTimeMax": 20.0,
+		"ConnectionTimeMedian": 2.1, "ConnectionTimeStddev": 1.9,
+		"RepliesPerSecMin": 90, "RepliesPerSecAvg": 100, "RepliesPerSecMax": 110,
+		"RepliesPerSecStddev": 14.1, "RepliesPerSecNumSamples": 2,
+		"ReplyStatus_2xx": 990, "ReplyStatus_5xx": 10,
+		"CpuPercTotal": 50, "NetIOValue": 400,
+		"ErrTotal": 12, "ErrClientTimeout": 11, "ErrConnectionRefused": 1,
+	}, nil)
+
+	if !reflect.DeepEqual(results.ReplyRateSamples, []float64{90, 110}) {
+		t.Errorf("Unexpected reply rate samples %v", results.ReplyRateSamples)
+	}
+	expected := []HistogramBucket{{1.5, 400}, {2.5, 300}, {5.5, 300}}
+	if !reflect.DeepEqual(results.ConnectionLifetimes, expected) {
+		t.Errorf("Unexpected histogram %v", results.ConnectionLifetimes)
+	}
+	if len(results.Missing) != 0 {
+		t.Errorf("Expected no missing fields, got %v", results.Missing)
+	}
+}
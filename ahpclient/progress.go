@@ -0,0 +1,154 @@
+package main
+
+import "fmt"
+import "log"
+import "net/rpc"
+import "strings"
+import "sync"
+import "time"
+
+import "github.com/SpeedyCoder/autohttperf/ahpproto"
+
+// The errors at which a worker's step is aborted early, set while a stress
+// test runs a step and 0 otherwise
+var abortErrors = 0
+
+// Watches the progress of every worker in a step while it runs, printing it
+// every -progress seconds, and aborts the whole step once a worker shows it
+// is clearly failing.
+type stepProgress struct {
+	workers []*Worker
+	clients map[*Worker]*rpc.Client // Taken before the step, as recoverJob replaces worker.client
+	stop    chan bool
+	abort   sync.Once
+	wg      sync.WaitGroup
+}
+
+func watchStep(workers []*Worker) *stepProgress {
+	s := &stepProgress{workers: workers, clients: make(map[*Worker]*rpc.Client), stop: make(chan bool)}
+	for _, worker := range workers {
+		s.clients[worker] = worker.client
+	}
+	if *progressInterval <= 0 {
+		return s
+	}
+
+	for _, worker := range workers {
+		if worker.call == nil {
+			continue
+		}
+		s.wg.Add(1)
+		go func(worker *Worker) {
+			defer s.wg.Done()
+			s.watch(worker)
+		}(worker)
+	}
+	return s
+}
+
+// Stop watching, once the results of the step are in
+func (s *stepProgress) Stop() {
+	close(s.stop)
+	s.wg.Wait()
+}
+
+// Why a worker's step is clearly failing, or "" if it is not. A worker that
+// stopped getting replies, or that has already made so many errors that the
+// step is going to count as failed, will not get any better by waiting.
+func failing(report *ahpproto.Progress) string {
+	n := len(report.Samples)
+	if n >= 2 && report.Samples[n-1] == 0 && report.Samples[n-2] == 0 {
+		return "no replies for two samples in a row"
+	}
+	if abortErrors > 0 && report.Errors >= abortErrors {
+		return fmt.Sprintf("%d errors, beyond -numerrors %d", report.Errors, abortErrors)
+	}
+	return ""
+}
+
+func (s *stepProgress) watch(worker *Worker) {
+	interval := time.Duration(*progressInterval) * time.Second
+	since, samples := 0, 0
+
+	for {
+		req := &ahpproto.ProgressRequest{Job: worker.args.Job, Since: since, Wait: int(interval / time.Millisecond)}
+		report := new(ahpproto.Progress)
+		call := s.clients[worker].Go("HTTPerf.Progress", req, report, make(chan *rpc.Call, 1))
+
+		select {
+		case <-s.stop:
+			return
+		case <-call.Done:
+		}
+
+		if err, ok := call.Error.(rpc.ServerError); ok {
+			if strings.Contains(err.Error(), "can't find method") {
+				// Older daemons cannot report progress, the step runs blind
+				return
+			}
+
+			// The job may not have been submitted yet
+			select {
+			case <-s.stop:
+				return
+			case <-time.After(interval):
+			}
+			continue
+		} else if call.Error != nil {
+			// Losing the worker is up to waitForCall to deal with
+			return
+		}
+
+		for _, line := range report.Lines {
+			log.Printf("[%s] | %s", worker.id, line)
+		}
+		since = report.Next
+
+		// Only report when there is something new besides output lines
+		if len(report.Lines) == 0 || len(report.Samples) != samples {
+			samples = len(report.Samples)
+			rate := "no samples yet"
+			if samples > 0 {
+				rate = fmt.Sprintf("%.1f replies/s", report.Samples[samples-1])
+			}
+			errors := "errors unknown"
+			if report.Errors >= 0 {
+				errors = fmt.Sprintf("%d errors", report.Errors)
+			}
+			log.Printf("[%s] %s %.0fs, %s, %s", worker.id, report.State, report.Elapsed, rate, errors)
+		}
+
+		if reason := failing(report); len(reason) > 0 && *earlyAbort {
+			s.abortStep(worker, reason)
+			return
+		}
+		if report.State != ahpproto.JOB_QUEUED && report.State != ahpproto.JOB_RUNNING {
+			return
+		}
+	}
+}
+
+// Abort the jobs of every worker in the step, noting the reason on the
+// worker that was failing
+func (s *stepProgress) abortStep(failed *Worker, reason string) {
+	s.abort.Do(func() {
+		log.Printf("[%s] Aborting the step early: %s", failed.id, reason)
+		failed.aborted = reason
+
+		for _, worker := range s.workers {
+			if worker.call != nil {
+				s.clients[worker].Go("HTTPerf.Abort", worker.args.Job, new(bool), make(chan *rpc.Call, 1))
+			}
+		}
+	})
+}
+
+// Why the last step of the workers was aborted early, or "" if it was not
+func stepAborted(workers []*Worker) string {
+	for _, worker := range workers {
+		if len(worker.aborted) > 0 {
+			return fmt.Sprintf("[%s] %s", worker.id, worker.aborted)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,211 @@
+package main
+
+import "errors"
+import "fmt"
+import "math"
+import "strconv"
+import "strings"
+
+// A ramp profile decides the rate of each step of a stress test. Next is
+// given the rate of the step that was just run and whether the server was
+// overloaded by it, and returns the rate of the following step. It returns
+// false once the profile has no further steps.
+type Ramp interface {
+	Start() int
+	Next(rate int, overloaded bool) (int, bool)
+}
+
+// A ramp that ends the stress test by itself once the server has recovered
+// from being overloaded, so the -cooldown steps do not apply to it.
+type RecoveryRamp interface {
+	Ramp
+	Recovery() (overload int, recovered int, steps int, ok bool)
+}
+
+// rate = rate + step
+type linearRamp struct {
+	start, step int
+}
+
+func (r *linearRamp) Start() int { return r.start }
+
+func (r *linearRamp) Next(rate int, overloaded bool) (int, bool) {
+	return rate + r.step, true
+}
+
+// rate = rate * k, always increasing by at least one
+type geometricRamp struct {
+	start  int
+	factor float64
+}
+
+func (r *geometricRamp) Start() int { return r.start }
+
+func (r *geometricRamp) Next(rate int, overloaded bool) (int, bool) {
+	next := int(math.Ceil(float64(rate) * r.factor))
+	if next <= rate {
+		next = rate + 1
+	}
+	return next, true
+}
+
+// An explicit list of rates, run in order
+type listRamp struct {
+	rates []int
+	idx   int
+}
+
+func (r *listRamp) Start() int { return r.rates[0] }
+
+func (r *listRamp) Next(rate int, overloaded bool) (int, bool) {
+	r.idx++
+	if r.idx >= len(r.rates) {
+		return 0, false
+	}
+	return r.rates[r.idx], true
+}
+
+// Alternates a base rate with bursts, growing the burst by step after each
+// one, for a fixed number of bursts.
+type spikeRamp struct {
+	base, burst, step, count int
+	bursts                   int
+}
+
+func (r *spikeRamp) Start() int { return r.base }
+
+func (r *spikeRamp) Next(rate int, overloaded bool) (int, bool) {
+	if rate != r.base {
+		// Just had a burst, go back to the base rate
+		r.bursts++
+		r.burst += r.step
+		return r.base, true
+	}
+
+	if r.bursts >= r.count {
+		return 0, false
+	}
+	return r.burst, true
+}
+
+// Ramps up linearly until the server is overloaded, then steps the rate back
+// down until the server has recovered, recording where that happened.
+type stepDownRamp struct {
+	start, step, down int
+	overload          int
+	recovered         int
+	steps             int
+}
+
+func (r *stepDownRamp) Start() int { return r.start }
+
+func (r *stepDownRamp) Next(rate int, overloaded bool) (int, bool) {
+	if r.overload == 0 {
+		if !overloaded {
+			return rate + r.step, true
+		}
+		r.overload = rate
+	} else if !overloaded {
+		r.recovered = rate
+		return 0, false
+	}
+
+	next := rate - r.down
+	if next <= 0 {
+		// Never recovered, even at the lowest rate
+		return 0, false
+	}
+	r.steps++
+	return next, true
+}
+
+func (r *stepDownRamp) Recovery() (int, int, int, bool) {
+	return r.overload, r.recovered, r.steps, r.recovered > 0
+}
+
+// Parse a ramp profile of the form "name:key=value,..." where the start rate
+// defaults to the one given. The "list" profile takes a plain list of rates
+// instead, e.g. "list:100,200,500".
+func ParseRamp(spec string, start int) (Ramp, error) {
+	name, params := spec, ""
+	if idx := strings.Index(spec, ":"); idx >= 0 {
+		name, params = spec[:idx], spec[idx+1:]
+	}
+
+	if name == "list" {
+		rates := make([]int, 0, 8)
+		for _, entry := range strings.Split(params, ",") {
+			rate, err := strconv.Atoi(strings.TrimSpace(entry))
+			if err != nil || rate <= 0 {
+				return nil, errors.New(fmt.Sprintf("Invalid rate %q in ramp list", entry))
+			}
+			rates = append(rates, rate)
+		}
+		return &listRamp{rates, 0}, nil
+	}
+
+	values := map[string]float64{"start": float64(start)}
+	for _, entry := range strings.Split(params, ",") {
+		if len(strings.TrimSpace(entry)) == 0 {
+			continue
+		}
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New(fmt.Sprintf("Invalid ramp parameter %q", entry))
+		}
+		value, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+		if err != nil || value < 0 {
+			return nil, errors.New(fmt.Sprintf("Invalid value for ramp parameter %q", entry))
+		}
+		values[strings.TrimSpace(kv[0])] = value
+	}
+
+	// Fetch an integer parameter, falling back to the given default
+	param := func(key string, def int) int {
+		if value, ok := values[key]; ok {
+			return int(value)
+		}
+		return def
+	}
+
+	if param("start", start) <= 0 {
+		return nil, errors.New("The ramp start rate must be greater than 0")
+	}
+
+	switch name {
+	case "linear":
+		step := param("step", 100)
+		if step <= 0 {
+			return nil, errors.New("The linear ramp step must be greater than 0")
+		}
+		return &linearRamp{param("start", start), step}, nil
+	case "geometric":
+		factor, ok := values["k"]
+		if !ok {
+			factor = 2
+		}
+		if factor <= 1 {
+			return nil, errors.New("The geometric ramp factor k must be greater than 1")
+		}
+		return &geometricRamp{param("start", start), factor}, nil
+	case "spike":
+		base := param("base", param("start", start))
+		burst := param("burst", base*10)
+		if burst <= base {
+			return nil, errors.New("The spike burst rate must be greater than the base rate")
+		}
+		return &spikeRamp{base, burst, param("step", 0), param("count", 10), 0}, nil
+	case "stepdown":
+		step := param("step", 100)
+		if step <= 0 {
+			return nil, errors.New("The stepdown ramp step must be greater than 0")
+		}
+		down := param("down", step/2)
+		if down <= 0 {
+			down = 1
+		}
+		return &stepDownRamp{start: param("start", start), step: step, down: down}, nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("Unknown ramp profile %q", name))
+}
@@ -0,0 +1,96 @@
+package main
+
+import "reflect"
+import "testing"
+
+// Run a ramp, reporting the server as overloaded at and above overloadAt (0
+// for never), and return the rates of its steps, stopping after max steps
+func rampRates(r Ramp, overloadAt int, max int) []int {
+	rates := []int{r.Start()}
+	for len(rates) < max {
+		rate := rates[len(rates)-1]
+		next, more := r.Next(rate, overloadAt > 0 && rate >= overloadAt)
+		if !more {
+			break
+		}
+		rates = append(rates, next)
+	}
+	return rates
+}
+
+func TestRampSequences(t *testing.T) {
+	tests := []struct {
+		spec       string
+		overloadAt int
+		expected   []int
+	}{
+		{"linear", 0, []int{50, 150, 250, 350}},
+		{"linear:start=10,step=5", 0, []int{10, 15, 20, 25}},
+		{"geometric", 0, []int{50, 100, 200, 400}},
+		{"geometric:start=1,k=1.2", 0, []int{1, 2, 3, 4}},
+		{"list:100,200,500", 0, []int{100, 200, 500}},
+		{"spike:base=10,burst=100,step=50,count=2", 0, []int{10, 100, 10, 150, 10}},
+		{"stepdown:step=100,down=30", 250, []int{50, 150, 250, 220, 190, 160}},
+		{"stepdown:start=100,step=100", 200, []int{100, 200, 150}},
+	}
+
+	for _, test := range tests {
+		ramp, err := ParseRamp(test.spec, 50)
+		if err != nil {
+			t.Errorf("%s: failed to parse: %s", test.spec, err)
+			continue
+		}
+		if rates := rampRates(ramp, test.overloadAt, 4); !reflect.DeepEqual(rates, test.expected[:min(4, len(test.expected))]) {
+			t.Errorf("%s: expected rates %v, got %v", test.spec, test.expected, rates)
+		}
+	}
+}
+
+func TestStepDownRecovery(t *testing.T) {
+	ramp, err := ParseRamp("stepdown:start=100,step=100,down=50", 100)
+	if err != nil {
+		t.Fatalf("Failed to parse: %s", err)
+	}
+
+	// Overloaded from 300 until back at 200
+	rates := []int{ramp.Start()}
+	for {
+		rate := rates[len(rates)-1]
+		next, more := ramp.Next(rate, rate >= 250)
+		if !more {
+			break
+		}
+		rates = append(rates, next)
+	}
+	if expected := []int{100, 200, 300, 250, 200}; !reflect.DeepEqual(rates, expected) {
+		t.Errorf("Expected rates %v, got %v", expected, rates)
+	}
+
+	overload, recovered, steps, ok := ramp.(RecoveryRamp).Recovery()
+	if !ok || overload != 300 || recovered != 200 || steps != 2 {
+		t.Errorf("Expected recovery from 300 at 200 after 2 steps, got %d, %d, %d, %v", overload, recovered, steps, ok)
+	}
+}
+
+func TestParseRampInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"unknown",
+		"linear:step=0",
+		"linear:step=-5",
+		"linear:start=0",
+		"linear:step",
+		"linear:step=abc",
+		"geometric:k=1",
+		"spike:base=100,burst=50",
+		"stepdown:step=0",
+		"stepdown:step=0.5",
+		"stepdown:step=-100",
+		"list:",
+		"list:100,0",
+		"list:100,fast",
+	} {
+		if _, err := ParseRamp(spec, 50); err == nil {
+			t.Errorf("Expected ramp %q to be rejected", spec)
+		}
+	}
+}
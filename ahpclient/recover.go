@@ -0,0 +1,96 @@
+package main
+
+import "errors"
+import "io"
+import "log"
+import "net"
+import "net/rpc"
+import "time"
+
+import "github.com/SpeedyCoder/autohttperf/ahpproto"
+
+// How often a recovered job is polled until it finishes
+const JOB_POLL_INTERVAL = time.Second
+
+// The longest wait between attempts to reconnect to a lost worker
+const MAX_RECONNECT_BACKOFF = 10 * time.Second
+
+// Whether a call failed because the connection to the worker went away,
+// rather than because the worker reported an error
+func lostConnection(err error) bool {
+	if err == rpc.ErrShutdown || err == io.ErrUnexpectedEOF || err == io.EOF {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// Reconnect to a worker that was lost while running a benchmark and collect
+// the result of its job, which the daemon keeps for -retain seconds after it
+// finishes. Gives up once the call's deadline has passed. The returned call
+// stands in for the one that was lost, with worker.result set when it
+// succeeded.
+func recoverJob(worker *Worker) (*rpc.Call, error) {
+	deadline := time.Unix(worker.date, 0).Add(callDeadline(worker.args))
+	backoff := time.Second
+
+	for time.Now().Before(deadline) {
+		client, err := dialWorker(worker.addr)
+		if err == nil {
+			if err = handshake(client); err != nil {
+				client.Close()
+			}
+		}
+		if err != nil {
+			log.Printf("[%s] Could not reconnect, trying again in %s: %s", worker.id, backoff, err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > MAX_RECONNECT_BACKOFF {
+				backoff = MAX_RECONNECT_BACKOFF
+			}
+			continue
+		}
+
+		worker.client.Close()
+		worker.client = client
+		log.Printf("[%s] Reconnected, collecting job %s", worker.id, worker.args.Job)
+
+		call, err := collectJob(worker, deadline)
+		if _, answered := err.(rpc.ServerError); err == nil || answered {
+			return call, err
+		}
+		log.Printf("[%s] Lost the worker again: %s", worker.id, err)
+	}
+
+	return nil, errors.New("no result before the deadline")
+}
+
+// Poll a job until it finishes, renewing its lease in the meantime
+func collectJob(worker *Worker, deadline time.Time) (*rpc.Call, error) {
+	for {
+		status := new(ahpproto.JobStatus)
+		if err := worker.client.Call("HTTPerf.Status", worker.args.Job, status); err != nil {
+			return nil, err
+		}
+
+		switch status.State {
+		case ahpproto.JOB_DONE:
+			result := new(ahpproto.Result)
+			if err := worker.client.Call("HTTPerf.Result", worker.args.Job, result); err != nil {
+				return nil, err
+			}
+			worker.result = result
+			return &rpc.Call{Reply: result}, nil
+		case ahpproto.JOB_FAILED, ahpproto.JOB_ABORTED:
+			return &rpc.Call{Error: rpc.ServerError(status.Error)}, nil
+		}
+
+		if time.Now().After(deadline) {
+			return nil, errors.New("job still " + status.State + " at the deadline")
+		}
+		if worker.args.Lease > 0 {
+			var renewed bool
+			worker.client.Call("HTTPerf.Renew", worker.args.Job, &renewed)
+		}
+		time.Sleep(JOB_POLL_INTERVAL)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import "bufio"
+import "crypto/subtle"
+import "crypto/tls"
+import "crypto/x509"
+import "errors"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "log"
+import "net"
+import "net/http"
+import "net/rpc"
+import "strings"
+import "time"
+
+import "github.com/SpeedyCoder/autohttperf/ahpproto"
+
+// Listen for workers registering, over TLS with -tls. With -tlsca the
+// workers must present a certificate signed by it.
+func listenForWorkers(addr string) (net.Listener, error) {
+	if !*useTLS {
+		return net.Listen("tcp", addr)
+	}
+
+	cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if len(*tlsCA) > 0 {
+		pem, err := ioutil.ReadFile(*tlsCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New(fmt.Sprintf("No certificates found in %s", *tlsCA))
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tls.Listen("tcp", addr, config)
+}
+
+// Read the registration of a worker that dialled in, and answer it. The
+// connection then carries RPC calls from here to the worker, as if the
+// coordinator had dialled the worker instead. A worker is turned away once
+// done is closed, when the coordinator no longer waits for workers.
+func acceptWorker(conn net.Conn, done <-chan bool) (*Worker, error) {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		return nil, err
+	}
+	if req.Method != "REGISTER" {
+		io.WriteString(conn, "HTTP/1.0 405 Method Not Allowed\r\n\r\n")
+		return nil, errors.New(fmt.Sprintf("unexpected %s request", req.Method))
+	}
+
+	if len(*token) > 0 {
+		given := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(*token)) != 1 {
+			io.WriteString(conn, "HTTP/1.0 401 Unauthorized\r\n\r\n")
+			return nil, errors.New("missing or invalid token")
+		}
+	}
+
+	name := req.Header.Get("X-Worker-Name")
+	if len(name) == 0 {
+		name = conn.RemoteAddr().String()
+	}
+	labels, err := ahpproto.ParseLabels(req.Header.Get("X-Worker-Labels"))
+	if err != nil {
+		io.WriteString(conn, "HTTP/1.0 400 Bad Request\r\n\r\n")
+		return nil, err
+	}
+
+	select {
+	case <-done:
+		io.WriteString(conn, "HTTP/1.0 503 Service Unavailable\r\n\r\n")
+		return nil, errors.New("no longer waiting for workers")
+	default:
+	}
+
+	// The worker serves the calls over this connection, so it checks the
+	// token in the answer instead of on a CONNECT
+	answer := "HTTP/1.0 200 Registered\r\n"
+	if len(*token) > 0 {
+		answer += fmt.Sprintf("Authorization: Bearer %s\r\n", *token)
+	}
+	io.WriteString(conn, answer+"\r\n")
+	conn.SetDeadline(time.Time{})
+
+	client := rpc.NewClient(conn)
+	if err := handshake(client); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return &Worker{name, name, client, nil, nil, 0, nil, 1, "", 0, false, labels, ""}, nil
+}
+
+// Accept workers registering on -listen until -waitworkers of them match the
+// -waitlabels and the selector of the run, or -waittimeout seconds have
+// passed. Only the matching workers are returned, and workers registering
+// afterwards are turned away.
+func waitForWorkers(first int, selector Selector) []*Worker {
+	want, err := ParseSelector(*waitLabels)
+	if err != nil {
+		log.Fatalf("Could not parse -waitlabels: %s", err)
+	}
+	want = append(want, selector...)
+
+	l, err := listenForWorkers(*listenAddr)
+	if err != nil {
+		log.Fatalf("Could not listen for workers: %s", err)
+	}
+	defer l.Close()
+	log.Printf("Waiting for %d workers to register on %s", *waitWorkers, l.Addr())
+
+	// Closed on return, so that registrations still in progress give up
+	// rather than wait for the loop below forever
+	done := make(chan bool)
+	defer close(done)
+
+	arrived := make(chan *Worker)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				worker, err := acceptWorker(conn, done)
+				if err != nil {
+					log.Printf("Rejected worker registration from %s: %s", conn.RemoteAddr(), err)
+					conn.Close()
+					return
+				}
+				select {
+				case arrived <- worker:
+				case <-done:
+					log.Printf("Worker %s registered after the wait ended", worker.addr)
+					worker.client.Close()
+				}
+			}()
+		}
+	}()
+
+	var timeout <-chan time.Time
+	if *waitTimeout > 0 {
+		timeout = time.After(time.Duration(*waitTimeout) * time.Second)
+	}
+
+	workers := make([]*Worker, 0, *waitWorkers)
+	for len(workers) < *waitWorkers {
+		select {
+		case worker := <-arrived:
+			if !want.Matches(worker.labels) {
+				log.Printf("Worker %s registered with labels %v, which do not match", worker.addr, worker.labels)
+				worker.client.Close()
+				continue
+			}
+			worker.id = fmt.Sprintf("%s:%d", worker.addr, first+len(workers))
+			log.Printf("[%s] Worker registered with labels %v", worker.id, worker.labels)
+			workers = append(workers, worker)
+
+		case <-timeout:
+			log.Printf("Gave up waiting after %d seconds, %d of %d workers registered", *waitTimeout, len(workers), *waitWorkers)
+			return workers
+		}
+	}
+
+	return workers
+}
@@ -0,0 +1,104 @@
+package main
+
+import "fmt"
+import "log"
+
+// httperf's own CPU use at which the worker, rather than the server, may be
+// the bottleneck. httperf --hog busy-loops at close to 100% whether or not it
+// keeps up, so this only counts together with a shortfall in the rate.
+const SATURATED_CPU_PERCENT = 95
+
+// The smallest share of the load a saturated worker is cut down to, relative
+// to an unsaturated one. Below this there is no point in keeping it.
+const MIN_WORKER_WEIGHT = 1.0 / 16
+
+// The errors httperf reports when the client runs out of resources
+func (d *PerfData) clientErrors() float64 {
+	return d.ErrFdUnavail + d.ErrAddRunAvail + d.ErrFtabFull
+}
+
+// Whether the load generator itself was the bottleneck of a benchmark,
+// with the reason why. A rate far below the one requested only counts when
+// the server reported no errors, since otherwise the server is to blame, or
+// when the client's CPU was used up as well.
+func (d *PerfData) ClientSaturated() (string, bool) {
+	if errors := d.clientErrors(); errors > 0 {
+		return fmt.Sprintf("%.0f file descriptor or address errors", errors), true
+	}
+
+	if d.ArgConnectionRate == 0 || d.isMissing("ConnectionsPerSecond") {
+		return "", false
+	}
+	requested := float64(d.ArgConnectionRate)
+
+	if !d.isMissing("CpuPercTotal") && d.CpuPercTotal >= SATURATED_CPU_PERCENT &&
+		d.ConnectionsPerSecond < requested*SHORTFALL_WARNING {
+		return fmt.Sprintf("client CPU at %.1f%% and achieved %.1f conn/s of the %d requested",
+			d.CpuPercTotal, d.ConnectionsPerSecond, d.ArgConnectionRate), true
+	}
+
+	if d.ErrTotal == 0 && d.ConnectionsPerSecond < requested*SHORTFALL_ERROR {
+		return fmt.Sprintf("achieved %.1f conn/s of the %d requested", d.ConnectionsPerSecond, d.ArgConnectionRate), true
+	}
+
+	return "", false
+}
+
+// Return the workers that were saturated in their last benchmark
+func saturatedWorkers(workers []*Worker) []*Worker {
+	saturated := make([]*Worker, 0, len(workers))
+	for _, worker := range workers {
+		if len(worker.saturated) > 0 {
+			saturated = append(saturated, worker)
+		}
+	}
+	return saturated
+}
+
+// Halve the share of the load given to each saturated worker, so that the
+// others take on more of it in the next benchmark. Returns false when the
+// load cannot be moved, because every worker was saturated or the saturated
+// ones are already down to their minimum share.
+func rebalanceWorkers(workers []*Worker) bool {
+	saturated := saturatedWorkers(workers)
+	if len(saturated) == 0 || len(saturated) == len(workers) {
+		return false
+	}
+
+	shifted := false
+	for _, worker := range saturated {
+		if worker.weight/2 < MIN_WORKER_WEIGHT {
+			continue
+		}
+		worker.weight = worker.weight / 2
+		shifted = true
+		log.Printf("[%s] Saturated (%s), reducing its share of the load to %.3g", worker.id, worker.saturated, worker.weight)
+	}
+
+	return shifted
+}
+
+// The share of the load of each worker
+func currentWeights(workers []*Worker) []float64 {
+	weights := make([]float64, len(workers))
+	for i, worker := range workers {
+		weights[i] = worker.weight
+	}
+	return weights
+}
+
+func applyWeights(workers []*Worker, weights []float64) {
+	for i, worker := range workers {
+		worker.weight = weights[i]
+	}
+}
+
+// Give the workers the shares of the load this target left them with, and
+// return the shares they had before
+func (s *connStress) loadWeights(workers []*Worker) []float64 {
+	previous := currentWeights(workers)
+	if s.weights != nil {
+		applyWeights(workers, s.weights)
+	}
+	return previous
+}
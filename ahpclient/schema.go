@@ -0,0 +1,119 @@
+package main
+
+import "fmt"
+import "io"
+import "reflect"
+import "regexp"
+import "strings"
+import "text/tabwriter"
+
+// A single value within a line, as printed by httperf. This is deliberately
+// loose so that unexpected values (e.g. "-nan") are reported as parse errors
+// rather than silently treated as missing.
+const value = `([^\s%(),]+)`
+
+// A field of PerfData, as described by its struct tags:
+//
+//	unit:"ms"                   the unit the value is measured in
+//	agg:"sum"                   how the values of several workers are combined,
+//	                            one of sum, avg, min or max. Only fields with an
+//	                            aggregation are included in PerfData.All
+//	httperf:"<prefix>|<text>"   where httperf prints the value: on a line
+//	                            starting with prefix, at the %v in text
+//	tsv:"-"                     leave the field out of the TSV output
+type metric struct {
+	name   string
+	index  int
+	kind   reflect.Kind
+	unit   string
+	agg    string
+	prefix string         // The httperf line the value is on, if any
+	regexp *regexp.Regexp // Captures the value on that line
+}
+
+type schema struct {
+	columns    []*metric // Written to the TSV output
+	aggregates []*metric // Combined across workers, in the order of PerfData.All
+	httperf    []*metric // Parsed from httperf's output
+}
+
+var perfSchema = buildSchema(reflect.TypeOf(PerfData{}))
+
+// Build the schema from the struct tags of PerfData. Slices cannot be written
+// as a column, so are only included if they are parsed.
+func buildSchema(t reflect.Type) *schema {
+	s := new(schema)
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		m := &metric{
+			name:  field.Name,
+			index: i,
+			kind:  field.Type.Kind(),
+			unit:  field.Tag.Get("unit"),
+			agg:   field.Tag.Get("agg"),
+		}
+
+		if m.kind != reflect.Slice && field.Tag.Get("tsv") != "-" {
+			s.columns = append(s.columns, m)
+		}
+
+		switch m.agg {
+		case "":
+		case "sum", "avg", "min", "max":
+			if m.kind != reflect.Float64 {
+				panic(fmt.Sprintf("PerfData.%s: only float64 fields can be aggregated", m.name))
+			}
+			s.aggregates = append(s.aggregates, m)
+		default:
+			panic(fmt.Sprintf("PerfData.%s: unknown aggregation %q", m.name, m.agg))
+		}
+
+		if source := field.Tag.Get("httperf"); len(source) > 0 {
+			parts := strings.SplitN(source, "|", 2)
+			if len(parts) != 2 || !strings.Contains(parts[1], "%v") {
+				panic(fmt.Sprintf("PerfData.%s: invalid httperf tag %q", m.name, source))
+			}
+
+			capture := value
+			if m.kind == reflect.String {
+				capture = `(\S+)`
+			}
+			text := strings.SplitN(parts[1], "%v", 2)
+			m.prefix = parts[0]
+			m.regexp = regexp.MustCompile(regexp.QuoteMeta(text[0]) + capture + regexp.QuoteMeta(text[1]))
+			s.httperf = append(s.httperf, m)
+		}
+	}
+
+	return s
+}
+
+func metricNames(metrics []*metric) []string {
+	names := make([]string, len(metrics))
+	for i, m := range metrics {
+		names[i] = m.name
+	}
+	return names
+}
+
+// The values of the aggregated fields of data, in schema order
+func aggregateValues(data *PerfData) []float64 {
+	val := reflect.ValueOf(data).Elem()
+	values := make([]float64, len(perfSchema.aggregates))
+	for i, m := range perfSchema.aggregates {
+		values[i] = val.Field(m.index).Float()
+	}
+	return values
+}
+
+// Describe every metric written to the TSV output
+func WriteSchema(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tUNIT\tAGGREGATE\tHTTPERF LINE")
+
+	for _, m := range perfSchema.columns {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", m.name, m.unit, m.agg, m.prefix)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,166 @@
+package main
+
+import "fmt"
+import "io"
+import "log"
+import "os"
+import "text/tabwriter"
+import "time"
+
+import "github.com/SpeedyCoder/autohttperf/ahpproto"
+
+// The metrics of a single soak window, summed or averaged over the workers
+type soakWindow struct {
+	elapsed   float64 // Seconds since the start of the soak when the window began
+	connTime  float64
+	replyRate float64
+	errorRate float64
+	complete  bool
+}
+
+// The metrics checked for drift, with a function to fetch each from a window
+var soakMetrics = []struct {
+	name  string
+	value func(w *soakWindow) float64
+}{
+	{"ConnectionTimeAvg[ms]", func(w *soakWindow) float64 { return w.connTime }},
+	{"RepliesPerSecAvg", func(w *soakWindow) float64 { return w.replyRate }},
+	{"ErrorRate[err/conn]", func(w *soakWindow) float64 { return w.errorRate }},
+}
+
+func newSoakWindow(elapsed float64, data []*PerfData, ok bool) *soakWindow {
+	window := &soakWindow{elapsed: elapsed, complete: ok && !AnyUntrustworthy(data)}
+
+	var connections, errors float64
+	for _, perfdata := range data {
+		window.connTime += perfdata.ConnectionTimeAvg
+		window.replyRate += perfdata.RepliesPerSecAvg
+		connections += perfdata.TotalConnections
+		errors += perfdata.ErrTotal
+	}
+
+	if len(data) > 0 {
+		window.connTime = window.connTime / float64(len(data))
+	}
+	if connections > 0 {
+		window.errorRate = errors / connections
+	}
+
+	return window
+}
+
+// The length of a soak window in seconds, taken from -duration
+func soakWindowLength() int {
+	if *duration <= 0 {
+		return 60
+	}
+	return *duration
+}
+
+// Run back to back windows of the same benchmark against a target for the
+// total soak duration, then check each metric for a statistically
+// significant trend over time.
+func RunSoak(workers []*Worker, target *Target, cmp *Comparison) {
+	window := soakWindowLength()
+
+	args := &ahpproto.Args{
+		Host:                  target.Host,
+		Port:                  target.Port,
+		URL:                   *url,
+		NumConnections:        *connRate * window,
+		ConnectionRate:        *connRate,
+		RequestsPerConnection: *requests,
+		Duration:              window,
+		Timeout:               *timeout,
+		Concurrency:           0,
+		ThinkTime:             0,
+		Verbose:               *verbose,
+		Backend:               *backend,
+	}
+
+	// Output the TSV header
+	WriteTSVHeader(os.Stdout)
+
+	windows := make([]*soakWindow, 0, 64)
+	start := time.Now()
+
+	for i := 0; i < *soakDuration/window; i++ {
+		begun := time.Now()
+		elapsed := begun.Sub(start).Seconds()
+		log.Printf("[%s] Soak window %d at %.0fs of %ds", target, i+1, elapsed, *soakDuration)
+
+		data, ok := RunDistributedBenchmark(workers, args)
+		if !ok {
+			log.Printf("[%s] Soak window %d did not fully succeed", target, i+1)
+
+			// A window that failed early, e.g. because the target is down,
+			// still takes its full length rather than hammering the target
+			time.Sleep(time.Until(begun.Add(time.Duration(window) * time.Second)))
+		}
+
+		WriteTSVParseDataSet(os.Stdout, data)
+		cmp.Add(target, args, data, ok)
+
+		if len(data) > 0 {
+			windows = append(windows, newSoakWindow(elapsed, data, ok))
+		}
+	}
+
+	WriteSoakSummary(os.Stderr, target, windows)
+}
+
+// Print the trend of each soak metric, flagging those that drifted
+func WriteSoakSummary(w io.Writer, target *Target, windows []*soakWindow) {
+	x := make([]float64, 0, len(windows))
+	for _, window := range windows {
+		x = append(x, window.elapsed/3600)
+	}
+
+	fmt.Fprintf(w, "Soak test of %s: %d windows\n", target, len(windows))
+	if len(windows) < 3 {
+		fmt.Fprintf(w, "Not enough windows to detect drift, at least 3 are needed\n")
+		return
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "METRIC\tFIRST\tLAST\tSLOPE/HOUR\tCHANGE\tTREND\t")
+	for _, metric := range soakMetrics {
+		y := make([]float64, 0, len(windows))
+		for _, window := range windows {
+			y = append(y, metric.value(window))
+		}
+
+		reg := LinearRegression(x, y)
+
+		// The change over the whole run, relative to the fitted start value
+		fitted := reg.Slope * (x[len(x)-1] - x[0])
+		change := "n/a"
+		if start := reg.Intercept + reg.Slope*x[0]; start != 0 {
+			change = fmt.Sprintf("%+.1f%%", 100*fitted/start)
+		}
+
+		trend := "stable"
+		if reg.Significant() {
+			trend = "DRIFT"
+			if reg.Slope > 0 {
+				trend += " (increasing)"
+			} else {
+				trend += " (decreasing)"
+			}
+		}
+
+		fmt.Fprintf(tw, "%s\t%.4g\t%.4g\t%+.4g\t%s\t%s\t\n", metric.name, y[0], y[len(y)-1],
+			reg.Slope, change, trend)
+	}
+	tw.Flush()
+
+	incomplete := 0
+	for _, window := range windows {
+		if !window.complete {
+			incomplete++
+		}
+	}
+	if incomplete > 0 {
+		fmt.Fprintf(w, "%d windows did not fully succeed\n", incomplete)
+	}
+}
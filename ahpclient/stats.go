@@ -0,0 +1,88 @@
+package main
+
+import "math"
+
+// Two-tailed critical values of Student's t distribution at the 5% level,
+// indexed by degrees of freedom. Beyond the end of the table the normal
+// approximation is used.
+var tCritical05 = []float64{
+	0, 12.706, 4.303, 3.182, 2.776, 2.571, 2.447, 2.365, 2.306, 2.262,
+	2.228, 2.201, 2.179, 2.160, 2.145, 2.131, 2.120, 2.110, 2.101, 2.093,
+	2.086, 2.080, 2.074, 2.069, 2.064, 2.060, 2.056, 2.052, 2.048, 2.045,
+	2.042,
+}
+
+func TCritical05(df int) float64 {
+	if df <= 0 {
+		return math.Inf(1)
+	}
+	if df < len(tCritical05) {
+		return tCritical05[df]
+	}
+	return 1.96
+}
+
+// The result of fitting y = Intercept + Slope * x by least squares
+type Regression struct {
+	Slope     float64
+	Intercept float64
+	SlopeErr  float64 // The standard error of the slope
+	N         int
+}
+
+// Fit a straight line through the given points. With fewer than three points
+// the standard error cannot be estimated and is left as +Inf.
+func LinearRegression(x, y []float64) *Regression {
+	n := len(x)
+	reg := &Regression{N: n, SlopeErr: math.Inf(1)}
+	if n < 2 {
+		if n == 1 {
+			reg.Intercept = y[0]
+		}
+		return reg
+	}
+
+	var meanX, meanY float64
+	for i := 0; i < n; i++ {
+		meanX += x[i]
+		meanY += y[i]
+	}
+	meanX /= float64(n)
+	meanY /= float64(n)
+
+	var sxx, sxy float64
+	for i := 0; i < n; i++ {
+		sxx += (x[i] - meanX) * (x[i] - meanX)
+		sxy += (x[i] - meanX) * (y[i] - meanY)
+	}
+	if sxx == 0 {
+		reg.Intercept = meanY
+		return reg
+	}
+
+	reg.Slope = sxy / sxx
+	reg.Intercept = meanY - reg.Slope*meanX
+
+	if n > 2 {
+		var sse float64
+		for i := 0; i < n; i++ {
+			residual := y[i] - (reg.Intercept + reg.Slope*x[i])
+			sse += residual * residual
+		}
+		reg.SlopeErr = math.Sqrt(sse/float64(n-2)) / math.Sqrt(sxx)
+	}
+
+	return reg
+}
+
+// Whether the slope is significantly different from zero at the 5% level
+func (r *Regression) Significant() bool {
+	if r.N < 3 || math.IsInf(r.SlopeErr, 1) {
+		return false
+	}
+	if r.SlopeErr == 0 {
+		// A perfect fit, any slope at all is significant
+		return r.Slope != 0
+	}
+	return math.Abs(r.Slope/r.SlopeErr) > TCritical05(r.N-2)
+}
@@ -0,0 +1,66 @@
+package main
+
+import "math"
+import "testing"
+
+func TestTCritical05(t *testing.T) {
+	tests := []struct {
+		df       int
+		expected float64
+	}{
+		{0, math.Inf(1)},
+		{-1, math.Inf(1)},
+		{1, 12.706},
+		{3, 3.182},
+		{30, 2.042},
+		{31, 1.96},
+		{1000, 1.96},
+	}
+	for _, test := range tests {
+		if got := TCritical05(test.df); got != test.expected {
+			t.Errorf("TCritical05(%d) = %g, expected %g", test.df, got, test.expected)
+		}
+	}
+}
+
+func TestLinearRegression(t *testing.T) {
+	inf := math.Inf(1)
+	tests := []struct {
+		name        string
+		x, y        []float64
+		slope       float64
+		intercept   float64
+		slopeErr    float64
+		significant bool
+	}{
+		{"no points", nil, nil, 0, 0, inf, false},
+		{"one point", []float64{1}, []float64{5}, 0, 5, inf, false},
+		{"two points", []float64{0, 1}, []float64{1, 3}, 2, 1, inf, false},
+		{"same x", []float64{2, 2, 2}, []float64{1, 2, 3}, 0, 2, inf, false},
+		{"perfect fit", []float64{1, 2, 3}, []float64{3, 5, 7}, 2, 1, 0, true},
+		{"flat", []float64{1, 2, 3, 4}, []float64{5, 5, 5, 5}, 0, 5, 0, false},
+		// sse 2.4, so the error is sqrt(2.4/3)/sqrt(10), t = 2.12 < 3.182
+		{"noisy", []float64{1, 2, 3, 4, 5}, []float64{2, 4, 5, 4, 5}, 0.6, 2.2, math.Sqrt(0.8) / math.Sqrt(10), false},
+		{"decreasing", []float64{1, 2, 3, 4, 5, 6}, []float64{60.1, 49.9, 40.2, 29.8, 20.1, 9.9}, -10.0229, 70.08, 0.0398, true},
+	}
+
+	close := func(a, b float64) bool {
+		if math.IsInf(a, 1) || math.IsInf(b, 1) {
+			return math.IsInf(a, 1) && math.IsInf(b, 1)
+		}
+		return math.Abs(a-b) < 1e-3
+	}
+	for _, test := range tests {
+		reg := LinearRegression(test.x, test.y)
+		if reg.N != len(test.x) {
+			t.Errorf("%s: expected N %d, got %d", test.name, len(test.x), reg.N)
+		}
+		if !close(reg.Slope, test.slope) || !close(reg.Intercept, test.intercept) || !close(reg.SlopeErr, test.slopeErr) {
+			t.Errorf("%s: expected slope %g, intercept %g and error %g, got %g, %g and %g", test.name,
+				test.slope, test.intercept, test.slopeErr, reg.Slope, reg.Intercept, reg.SlopeErr)
+		}
+		if reg.Significant() != test.significant {
+			t.Errorf("%s: expected significant %v, got %v", test.name, test.significant, reg.Significant())
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import "bufio"
+import "errors"
+import "fmt"
+import "io"
+import "log"
+import "math/rand"
+import "os"
+import "strconv"
+import "strings"
+
+import "github.com/SpeedyCoder/autohttperf/ahpproto"
+
+// The dimensions that can be swept, in the default order (outermost first)
+var sweepDimensions = []string{"target", "url", "requests", "rate"}
+
+// A single combination of the swept parameters
+type sweepPoint struct {
+	target   *Target
+	url      string
+	requests int
+	rate     int
+}
+
+// The key used to recognise a combination that was already completed by an
+// earlier, interrupted, run of the same sweep.
+func (p *sweepPoint) Key() string {
+	return fmt.Sprintf("%s,%d,%d,%s", p.target, p.rate, p.requests, p.url)
+}
+
+// Parse a list of integers for a sweep. Each comma separated entry is either a
+// single value or a range of the form "start-end:step", where the step
+// defaults to 1 and the end is inclusive.
+func ParseSweepValues(list string) ([]int, error) {
+	values := make([]int, 0, 8)
+
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		if !strings.Contains(entry, "-") {
+			value, err := strconv.Atoi(entry)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Invalid sweep value %q", entry))
+			}
+			values = append(values, value)
+			continue
+		}
+
+		bounds, sstep := entry, "1"
+		if idx := strings.Index(entry, ":"); idx >= 0 {
+			bounds, sstep = entry[:idx], entry[idx+1:]
+		}
+		parts := strings.SplitN(bounds, "-", 2)
+
+		start, err1 := strconv.Atoi(parts[0])
+		end, err2 := strconv.Atoi(parts[1])
+		step, err3 := strconv.Atoi(sstep)
+		if err1 != nil || err2 != nil || err3 != nil || step <= 0 || end < start {
+			return nil, errors.New(fmt.Sprintf("Invalid sweep range %q", entry))
+		}
+
+		for value := start; value <= end; value += step {
+			values = append(values, value)
+		}
+	}
+
+	if len(values) == 0 {
+		return nil, errors.New("Empty sweep value list")
+	}
+
+	return values, nil
+}
+
+// Build every combination of the swept values, varying the dimensions in the
+// given order with the first dimension changing slowest.
+func buildSweep(order []string, targets []*Target, urls []string, requests, rates []int) []*sweepPoint {
+	points := []*sweepPoint{&sweepPoint{}}
+
+	for _, dim := range order {
+		next := make([]*sweepPoint, 0, len(points))
+		for _, point := range points {
+			switch dim {
+			case "target":
+				for _, target := range targets {
+					p := *point
+					p.target = target
+					next = append(next, &p)
+				}
+			case "url":
+				for _, u := range urls {
+					p := *point
+					p.url = u
+					next = append(next, &p)
+				}
+			case "requests":
+				for _, r := range requests {
+					p := *point
+					p.requests = r
+					next = append(next, &p)
+				}
+			case "rate":
+				for _, r := range rates {
+					p := *point
+					p.rate = r
+					next = append(next, &p)
+				}
+			}
+		}
+		points = next
+	}
+
+	return points
+}
+
+// Check a user supplied sweep order, filling in any dimensions that were not
+// mentioned in their default position after the given ones.
+func parseSweepOrder(list string) ([]string, error) {
+	order := make([]string, 0, len(sweepDimensions))
+	seen := make(map[string]bool)
+
+	for _, dim := range strings.Split(list, ",") {
+		dim = strings.TrimSpace(dim)
+		if len(dim) == 0 {
+			continue
+		}
+
+		known := false
+		for _, d := range sweepDimensions {
+			known = known || d == dim
+		}
+		if !known || seen[dim] {
+			return nil, errors.New(fmt.Sprintf("Invalid sweep dimension %q", dim))
+		}
+
+		seen[dim] = true
+		order = append(order, dim)
+	}
+
+	for _, dim := range sweepDimensions {
+		if !seen[dim] {
+			order = append(order, dim)
+		}
+	}
+
+	return order, nil
+}
+
+// Read the keys of the combinations already present in a sweep output file
+func readCompletedSweep(path string) (map[string]bool, error) {
+	done := make(map[string]bool)
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return done, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	first := true
+	for scanner.Scan() {
+		if first {
+			// Skip the header
+			first = false
+			continue
+		}
+
+		columns := strings.SplitN(scanner.Text(), ",", 5)
+		if len(columns) < 4 {
+			continue
+		}
+		done[strings.Join(columns[:4], ",")] = true
+	}
+
+	return done, scanner.Err()
+}
+
+func writeSweepHeader(w io.Writer) {
+	columns := append([]string{"Target", "ArgConnectionRate", "ArgRequestsPerConnection", "ArgURL"}, metricNames(perfSchema.aggregates)...)
+	io.WriteString(w, strings.Join(columns, ","))
+	io.WriteString(w, "\n")
+}
+
+func writeSweepRow(w io.Writer, point *sweepPoint, values []float64) {
+	columns := make([]string, 0, len(values)+1)
+	columns = append(columns, point.Key())
+	for _, value := range values {
+		columns = append(columns, strconv.FormatFloat(value, 'f', -1, 64))
+	}
+
+	io.WriteString(w, strings.Join(columns, ","))
+	io.WriteString(w, "\n")
+}
+
+// Run every combination of the swept connection rates, requests per
+// connection, URLs and targets, writing one aggregated row per combination
+// to the sweep output file. Combinations that are already in the output file
+// are skipped, so an interrupted or partially failed sweep can be resumed by
+// running the same command again.
+func RunSweep(workers []*Worker, targets []*Target, cmp *Comparison) {
+	rates, err := ParseSweepValues(*sweepRates)
+	if err != nil {
+		log.Fatalf("Could not parse -sweeprates: %s", err)
+	}
+	reqs, err := ParseSweepValues(*sweepRequests)
+	if err != nil {
+		log.Fatalf("Could not parse -sweeprequests: %s", err)
+	}
+	urls := strings.Split(*sweepURLs, ",")
+	order, err := parseSweepOrder(*sweepOrder)
+	if err != nil {
+		log.Fatalf("Could not parse -sweeporder: %s", err)
+	}
+
+	points := buildSweep(order, targets, urls, reqs, rates)
+	if *sweepRandom {
+		rand.Shuffle(len(points), func(i, j int) {
+			points[i], points[j] = points[j], points[i]
+		})
+	}
+
+	done, err := readCompletedSweep(*sweepOut)
+	if err != nil {
+		log.Fatalf("Could not read previous sweep results: %s", err)
+	}
+
+	out, err := os.OpenFile(*sweepOut, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		log.Fatalf("Could not open sweep output: %s", err)
+	}
+	defer out.Close()
+
+	if info, err := out.Stat(); err == nil && info.Size() == 0 {
+		writeSweepHeader(out)
+	}
+
+	log.Printf("Sweeping %d combinations, %d already completed", len(points), len(done))
+
+	failed := 0
+	for idx, point := range points {
+		if done[point.Key()] {
+			continue
+		}
+
+		connections := *numConns
+		if *duration > 0 {
+			connections = point.rate * *duration
+		}
+
+		args := &ahpproto.Args{
+			Host:                  point.target.Host,
+			Port:                  point.target.Port,
+			URL:                   point.url,
+			NumConnections:        connections,
+			ConnectionRate:        point.rate,
+			RequestsPerConnection: point.requests,
+			Duration:              *duration,
+			Timeout:               *timeout,
+			Concurrency:           0,
+			ThinkTime:             0,
+			Verbose:               *verbose,
+			Backend:               *backend,
+		}
+
+		log.Printf("Sweep %d/%d: %s", idx+1, len(points), point.Key())
+		data, ok := RunDistributedBenchmark(workers, args)
+		cmp.Add(point.target, args, data, ok)
+
+		if !ok || len(data) == 0 {
+			// Leave it out of the output so a later run will retry it
+			log.Printf("Sweep combination %s did not fully succeed, rerun to resume", point.Key())
+			failed++
+		} else {
+			if AnyUntrustworthy(data) {
+				log.Printf("Sweep combination %s is untrustworthy, see the result errors above", point.Key())
+			}
+			writeSweepRow(out, point, AggregatePerfData(data, len(data)))
+			done[point.Key()] = true
+		}
+
+		if idx < len(points)-1 {
+			sleepBetweenSteps()
+		}
+	}
+
+	if failed > 0 {
+		log.Printf("%d sweep combinations failed, run again with the same -sweepout to resume", failed)
+	}
+}
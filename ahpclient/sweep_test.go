@@ -0,0 +1,126 @@
+package main
+
+import "os"
+import "path/filepath"
+import "reflect"
+import "testing"
+
+func TestParseSweepValues(t *testing.T) {
+	tests := []struct {
+		list     string
+		expected []int
+	}{
+		{"100", []int{100}},
+		{"100, 200,,300", []int{100, 200, 300}},
+		{"1-3", []int{1, 2, 3}},
+		{"100-300:100,500", []int{100, 200, 300, 500}},
+		{"100-250:100", []int{100, 200}},
+		{"5-5", []int{5}},
+	}
+	for _, test := range tests {
+		values, err := ParseSweepValues(test.list)
+		if err != nil || !reflect.DeepEqual(values, test.expected) {
+			t.Errorf("%q: expected %v, got %v (%v)", test.list, test.expected, values, err)
+		}
+	}
+
+	for _, bad := range []string{"", " , ", "fast", "3-1", "1-3:0", "1-3:-1", "1-x", "1-3:x"} {
+		if _, err := ParseSweepValues(bad); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestParseSweepOrder(t *testing.T) {
+	tests := []struct {
+		list     string
+		expected []string
+	}{
+		{"", []string{"target", "url", "requests", "rate"}},
+		{"rate", []string{"rate", "target", "url", "requests"}},
+		{"requests, target", []string{"requests", "target", "url", "rate"}},
+	}
+	for _, test := range tests {
+		order, err := parseSweepOrder(test.list)
+		if err != nil || !reflect.DeepEqual(order, test.expected) {
+			t.Errorf("%q: expected %v, got %v (%v)", test.list, test.expected, order, err)
+		}
+	}
+
+	for _, bad := range []string{"speed", "rate,rate"} {
+		if _, err := parseSweepOrder(bad); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
+
+func sweepKeys(points []*sweepPoint) []string {
+	keys := make([]string, len(points))
+	for i, point := range points {
+		keys[i] = point.Key()
+	}
+	return keys
+}
+
+func TestBuildSweep(t *testing.T) {
+	targets := []*Target{{"a", 80}, {"b", 80}}
+	urls := []string{"/"}
+	requests := []int{1}
+	rates := []int{100, 200}
+
+	// The first dimension changes slowest
+	tests := []struct {
+		order    []string
+		expected []string
+	}{
+		{[]string{"target", "url", "requests", "rate"},
+			[]string{"a:80,100,1,/", "a:80,200,1,/", "b:80,100,1,/", "b:80,200,1,/"}},
+		{[]string{"rate", "target", "url", "requests"},
+			[]string{"a:80,100,1,/", "b:80,100,1,/", "a:80,200,1,/", "b:80,200,1,/"}},
+	}
+	for _, test := range tests {
+		keys := sweepKeys(buildSweep(test.order, targets, urls, requests, rates))
+		if !reflect.DeepEqual(keys, test.expected) {
+			t.Errorf("%v: expected %v, got %v", test.order, test.expected, keys)
+		}
+	}
+
+	points := buildSweep(sweepDimensions, targets, []string{"/", "/big"}, []int{1, 5}, []int{100, 200, 300})
+	if len(points) != 2*2*2*3 {
+		t.Errorf("Expected every combination, got %d", len(points))
+	}
+}
+
+// The combinations written by an interrupted sweep are found again, so that
+// running it again resumes it
+func TestSweepResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sweep.csv")
+
+	done, err := readCompletedSweep(path)
+	if err != nil || len(done) != 0 {
+		t.Fatalf("Expected nothing done without an output file, got %v (%v)", done, err)
+	}
+
+	points := buildSweep(sweepDimensions, []*Target{{"a", 80}}, []string{"/"}, []int{1}, []int{100, 200, 300})
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeSweepHeader(file)
+	values := []float64{100, 99.5, 2}
+	writeSweepRow(file, points[0], values)
+	writeSweepRow(file, points[2], values)
+	file.Close()
+
+	done, err = readCompletedSweep(path)
+	if err != nil {
+		t.Fatalf("Failed to read: %s", err)
+	}
+	expected := map[string]bool{points[0].Key(): true, points[2].Key(): true}
+	if !reflect.DeepEqual(done, expected) {
+		t.Errorf("Expected %v to be done, got %v", expected, done)
+	}
+	if done[points[1].Key()] {
+		t.Errorf("Expected %s to be run again", points[1].Key())
+	}
+}
@@ -1,34 +1,50 @@
 package main
 
+import "net"
 import "net/rpc"
+import "strconv"
 
-type Args struct {
-	Host                  string
-	Port                  int
-	URL                   string
-	NumConnections        int
-	ConnectionRate        int
-	RequestsPerConnection int
-	Duration              int
-	Timeout 			  int
+import "github.com/SpeedyCoder/autohttperf/ahpproto"
+
+// A server to be benchmarked, as given by -server/-port or -targets
+type Target struct {
+	Host string
+	Port int
 }
 
-type Result struct {
-	Stdout     string
-	Stderr     string
-	ExitStatus int
+// The target as "host:port", with an IPv6 host in brackets
+func (t *Target) String() string {
+	return net.JoinHostPort(t.Host, strconv.Itoa(t.Port))
 }
 
 type Worker struct {
-	addr   string // The address of the RPC worker client
-	id     string // A string UID for this worker
-	client *rpc.Client
-	result *Result   // The pending RPC result
-	call   *rpc.Call // The pending RPC call result
-	date   int64     // The time the pending call was started
-	args   *Args     // The arguments passed to the pending call
+	addr      string // The address of the RPC worker client
+	id        string // A string UID for this worker
+	client    *rpc.Client
+	result    *ahpproto.Result  // The pending RPC result
+	call      *rpc.Call         // The pending RPC call result
+	date      int64             // The time the pending call was started
+	args      *ahpproto.Args    // The arguments passed to the pending call
+	weight    float64           // The worker's share of the load, relative to the others
+	saturated string            // Why the worker was the bottleneck of its last benchmark
+	capacity  int               // The highest clean connection rate, 0 if not calibrated
+	dropped   bool              // Left out of the rest of the run by -onfail drop
+	labels    map[string]string // The labels a registered worker gave itself
+	aborted   string            // Why the worker's last step was aborted early
+}
+
+// One bar of the connection lifetime histogram printed by httperf --verbose
+type HistogramBucket struct {
+	Ms    float64 // The middle of the bucket, in milliseconds
+	Count float64
 }
 
+// httperf takes a reply rate sample every five seconds
+const REPLY_RATE_INTERVAL = 5
+
+// The fields of PerfData are described by their struct tags, from which the
+// parser, the TSV output and the aggregation across workers are all derived
+// (see schema.go). The name of each metric is the name of its field.
 type PerfData struct {
 	// These fields MUST be supplied by the implementor, they do not come
 	// from the parsed performance data
@@ -41,29 +57,105 @@ type PerfData struct {
 	ArgConnectionRate        int
 	ArgRequestsPerConnection int
 	ArgDuration              int
+	ArgConcurrency           int
+	Backend                  string
+	FailPolicy               string // The -onfail policy applied to the step, "none" included, empty if no worker failed
+	Labels                   string // The labels of the worker, see ahpproto.FormatLabels
 
 	// The following fields all come from the parsed data and should not
 	// need to be changed.
 
-	Raw string
-	All []float64
-	ConnectionBurstLength,
-	TotalConnections, TotalRequests, TotalReplies, TestDuration,
-	ConnectionsPerSecond, MsPerConnection, ConcurrentConnections,
-	ConnectionTimeMin, ConnectionTimeAvg, ConnectionTimeMax,
-	ConnectionTimeMedian, ConnectionTimeStddev,
-	ConnectionTimeConnect,
-	RepliesPerConnection,
-	RequestsPerSecond, MsPerRequest,
-	RequestSize,
-	RepliesPerSecMin, RepliesPerSecAvg, RepliesPerSecMax,
-	RepliesPerSecStddev, RepliesPerSecNumSamples,
-	ReplyTimeResponse, ReplyTimeTransfer,
-	ReplySizeHeader, ReplySizeContent, ReplySizeFooter, ReplySizeTotal,
-	ReplyStatus_1xx, ReplyStatus_2xx, ReplyStatus_3xx, ReplyStatus_4xx, ReplyStatus_5xx,
-	CpuTimeUser, CpuTimeSystem, CpuPercUser, CpuPercSystem, CpuPercTotal,
-	NetIOValue float64
-	NetIOUnit, NetIOBytesPerSecond string
-	ErrTotal, ErrClientTimeout, ErrSocketTimeout, ErrConnectionRefused,
-	ErrConnectionReset, ErrFdUnavail, ErrAddRunAvail, ErrFtabFull, ErrOther float64
+	Raw     string    `tsv:"-"` // All of the data is already included
+	All     []float64 // The aggregated fields, in schema order
+	Missing []string  // Fields that were absent from the parsed output
+	Issues  []*Issue  // Problems found by Validate
+
+	ConnectionBurstLength float64 `unit:"conns" agg:"max" httperf:"Maximum connect burst length:|length: %v"`
+
+	TotalConnections float64 `unit:"conns" agg:"sum" httperf:"Total:|connections %v"`
+	TotalRequests    float64 `unit:"reqs" agg:"sum" httperf:"Total:|requests %v"`
+	TotalReplies     float64 `unit:"replies" agg:"sum" httperf:"Total:|replies %v"`
+	TestDuration     float64 `unit:"s" agg:"max" httperf:"Total:|test-duration %v"`
+
+	ConnectionsPerSecond  float64 `unit:"conn/s" agg:"sum" httperf:"Connection rate:|rate: %v conn/s"`
+	MsPerConnection       float64 `unit:"ms" agg:"avg" httperf:"Connection rate:|%v ms/conn"`
+	ConcurrentConnections float64 `unit:"conns" agg:"sum" httperf:"Connection rate:|<=%v concurrent"`
+	ConnectionTimeMin     float64 `unit:"ms" agg:"min" httperf:"Connection time [ms]:|min %v"`
+	ConnectionTimeAvg     float64 `unit:"ms" agg:"avg" httperf:"Connection time [ms]:|avg %v"`
+	ConnectionTimeMax     float64 `unit:"ms" agg:"max" httperf:"Connection time [ms]:|max %v"`
+	ConnectionTimeMedian  float64 `unit:"ms" agg:"avg" httperf:"Connection time [ms]:|median %v"`
+	ConnectionTimeStddev  float64 `unit:"ms" agg:"avg" httperf:"Connection time [ms]:|stddev %v"`
+	ConnectionTimeConnect float64 `unit:"ms" agg:"avg" httperf:"Connection time [ms]:|connect %v"`
+
+	// Estimated from the lifetime histogram, so only available when the
+	// benchmark was run with Verbose set. Percentiles cannot be averaged, but
+	// the one of all workers together is no more than the largest of theirs.
+	ConnectionTimeP50 float64 `unit:"ms" agg:"max"`
+	ConnectionTimeP90 float64 `unit:"ms" agg:"max"`
+	ConnectionTimeP99 float64 `unit:"ms" agg:"max"`
+
+	RepliesPerConnection float64 `unit:"replies/conn" agg:"avg" httperf:"Connection length [replies/conn]:|conn]: %v"`
+
+	RequestsPerSecond float64 `unit:"req/s" agg:"sum" httperf:"Request rate:|rate: %v req/s"`
+	MsPerRequest      float64 `unit:"ms" agg:"avg" httperf:"Request rate:|%v ms/req"`
+	RequestSize       float64 `unit:"B" agg:"avg" httperf:"Request size [B]:|[B]: %v"`
+
+	RepliesPerSecMin        float64 `unit:"replies/s" agg:"min" httperf:"Reply rate [replies/s]:|min %v"`
+	RepliesPerSecAvg        float64 `unit:"replies/s" agg:"avg" httperf:"Reply rate [replies/s]:|avg %v"`
+	RepliesPerSecMax        float64 `unit:"replies/s" agg:"max" httperf:"Reply rate [replies/s]:|max %v"`
+	RepliesPerSecStddev     float64 `unit:"replies/s" agg:"avg" httperf:"Reply rate [replies/s]:|stddev %v"`
+	RepliesPerSecNumSamples float64 `unit:"samples" agg:"sum" httperf:"Reply rate [replies/s]:|(%v samples)"`
+	ReplyTimeResponse       float64 `unit:"ms" agg:"avg" httperf:"Reply time [ms]:|response %v"`
+	ReplyTimeTransfer       float64 `unit:"ms" agg:"avg" httperf:"Reply time [ms]:|transfer %v"`
+	ReplySizeHeader         float64 `unit:"B" agg:"avg" httperf:"Reply size [B]:|header %v"`
+	ReplySizeContent        float64 `unit:"B" agg:"avg" httperf:"Reply size [B]:|content %v"`
+	ReplySizeFooter         float64 `unit:"B" agg:"avg" httperf:"Reply size [B]:|footer %v"`
+	ReplySizeTotal          float64 `unit:"B" agg:"avg" httperf:"Reply size [B]:|total %v"`
+	ReplyStatus_1xx         float64 `unit:"replies" agg:"sum" httperf:"Reply status:|1xx=%v"`
+	ReplyStatus_2xx         float64 `unit:"replies" agg:"sum" httperf:"Reply status:|2xx=%v"`
+	ReplyStatus_3xx         float64 `unit:"replies" agg:"sum" httperf:"Reply status:|3xx=%v"`
+	ReplyStatus_4xx         float64 `unit:"replies" agg:"sum" httperf:"Reply status:|4xx=%v"`
+	ReplyStatus_5xx         float64 `unit:"replies" agg:"sum" httperf:"Reply status:|5xx=%v"`
+
+	CpuTimeUser         float64 `unit:"s" agg:"avg" httperf:"CPU time [s]:|[s]: user %v"`
+	CpuTimeSystem       float64 `unit:"s" agg:"avg" httperf:"CPU time [s]:| system %v"`
+	CpuPercUser         float64 `unit:"%" agg:"avg" httperf:"CPU time [s]:|(user %v%"`
+	CpuPercSystem       float64 `unit:"%" agg:"avg" httperf:"CPU time [s]:|% system %v%"`
+	CpuPercTotal        float64 `unit:"%" agg:"avg" httperf:"CPU time [s]:|total %v%"`
+	NetIOValue          float64 `agg:"avg" httperf:"Net I/O:|I/O: %v"` // In the unit given by NetIOUnit
+	NetIOUnit           string  `httperf:"Net I/O:|%v ("`
+	NetIOBytesPerSecond string  `unit:"bps" httperf:"Net I/O:|(%v bps)"`
+
+	ErrTotal             float64 `unit:"errors" agg:"sum" httperf:"Errors:|total %v"`
+	ErrClientTimeout     float64 `unit:"errors" agg:"sum" httperf:"Errors:|client-timo %v"`
+	ErrSocketTimeout     float64 `unit:"errors" agg:"sum" httperf:"Errors:|socket-timo %v"`
+	ErrConnectionRefused float64 `unit:"errors" agg:"sum" httperf:"Errors:|connrefused %v"`
+	ErrConnectionReset   float64 `unit:"errors" agg:"sum" httperf:"Errors:|connreset %v"`
+	ErrFdUnavail         float64 `unit:"errors" agg:"sum" httperf:"Errors:|fd-unavail %v"`
+	ErrAddRunAvail       float64 `unit:"errors" agg:"sum" httperf:"Errors:|addrunavail %v"`
+	ErrFtabFull          float64 `unit:"errors" agg:"sum" httperf:"Errors:|ftab-full %v"`
+	ErrOther             float64 `unit:"errors" agg:"sum" httperf:"Errors:|other %v"`
+
+	// These are only available when the benchmark was run with Verbose set
+	ReplyRateSamples    []float64 // One sample every REPLY_RATE_INTERVAL seconds
+	ConnectionLifetimes []HistogramBucket
+}
+
+// Estimate a percentile (0-100) of the connection lifetime from the
+// histogram, returning 0 when there is no histogram.
+func (d *PerfData) LifetimePercentile(p float64) float64 {
+	var total float64
+	for _, bucket := range d.ConnectionLifetimes {
+		total += bucket.Count
+	}
+
+	var seen float64
+	for _, bucket := range d.ConnectionLifetimes {
+		seen += bucket.Count
+		if seen >= total*p/100 {
+			return bucket.Ms
+		}
+	}
+
+	return 0
 }
@@ -7,18 +7,15 @@ import "strings"
 import "reflect"
 import "os"
 import "math"
-
-// The 'Raw' field is omitted here, since all of the data is already included
-var fieldNames = []string{"BenchmarkId", "BenchmarkDate", "ArgHost", "ArgPort", "ArgURL", "ArgNumConnections", "ArgConnectionRate", "ArgRequestsPerConnection", "ArgDuration", "ConnectionBurstLength", "TotalConnections", "TotalRequests", "TotalReplies", "TestDuration", "ConnectionsPerSecond", "MsPerConnection", "ConcurrentConnections", "ConnectionTimeMin", "ConnectionTimeAvg", "ConnectionTimeMax", "ConnectionTimeMedian", "ConnectionTimeStddev", "ConnectionTimeConnect", "RepliesPerConnection", "RequestsPerSecond", "MsPerRequest", "RequestSize", "RepliesPerSecMin", "RepliesPerSecAvg", "RepliesPerSecMax", "RepliesPerSecStddev", "RepliesPerSecNumSamples", "ReplyTimeResponse", "ReplyTimeTransfer", "ReplySizeHeader", "ReplySizeContent", "ReplySizeFooter", "ReplySizeTotal", "ReplyStatus_1xx", "ReplyStatus_2xx", "ReplyStatus_3xx", "ReplyStatus_4xx", "ReplyStatus_5xx", "CpuTimeUser", "CpuTimeSystem", "CpuPercUser", "CpuPercSystem", "CpuPercTotal", "NetIOValue", "NetIOUnit", "NetIOBytesPerSecond", "ErrTotal", "ErrClientTimeout", "ErrSocketTimeout", "ErrConnectionRefused", "ErrConnectionReset", "ErrFdUnavail", "ErrAddRunAvail", "ErrFtabFull", "ErrOther"}
+import "net"
+import "strconv"
+import "errors"
 
 // Write a CSV header to the given writer including each of the field names
 // above, and an optional list of additional column names specified. In the
 // resulting file, the optional columns are listed first.
 func WriteTSVHeader(w io.Writer) {
-	numColumns := len(fieldNames)
-	columns := make([]string, 0, numColumns)
-
-	columns = append(columns, fieldNames...)
+	columns := metricNames(perfSchema.columns)
 
 	io.WriteString(w, strings.Join(columns, ","))
 	io.WriteString(w, "\n")
@@ -31,8 +28,7 @@ func WriteTSVParseDataSet(w io.Writer, data []*PerfData) {
 }
 
 func WriteTSVParseData(w io.Writer, data *PerfData) {
-	numColumns := len(fieldNames)
-	columns := make([]string, 0, numColumns)
+	columns := make([]string, 0, len(perfSchema.columns))
 
 	// Turn the struct into a Type so we can use reflection
 	ptr := reflect.ValueOf(data)
@@ -52,11 +48,8 @@ func WriteTSVParseData(w io.Writer, data *PerfData) {
 	// Move through every field, fetching the value by name and adding
 	// it to the columns slice
 
-	for _, field := range fieldNames {
-		column := val.FieldByName(field)
-		if !column.IsValid() {
-			log.Fatalf("Failed when reflecting field %s", field)
-		}
+	for _, m := range perfSchema.columns {
+		column := val.Field(m.index)
 
 		t := column.Kind()
 		switch t {
@@ -70,7 +63,7 @@ func WriteTSVParseData(w io.Writer, data *PerfData) {
 			columns = append(columns, fmt.Sprintf("%#v", column.Int()))
 		default:
 			log.Println("Type: ", t.String())
-			log.Fatalf("Got a field we cannot handle: %s", field)
+			log.Fatalf("Got a field we cannot handle: %s", m.name)
 		}
 	}
 
@@ -78,6 +71,41 @@ func WriteTSVParseData(w io.Writer, data *PerfData) {
 	io.WriteString(w, "\n")
 }
 
+// Parse a comma separated list of "host:port" targets. A target without a
+// port uses the given default port.
+func ParseTargets(list string, defport int) ([]*Target, error) {
+	targets := make([]*Target, 0, 4)
+
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		host, sport, err := net.SplitHostPort(entry)
+		if err != nil {
+			// No port given, use the default
+			if strings.HasPrefix(entry, "[") && strings.HasSuffix(entry, "]") {
+				entry = entry[1 : len(entry)-1]
+			}
+			targets = append(targets, &Target{entry, defport})
+			continue
+		}
+
+		port, err := strconv.Atoi(sport)
+		if err != nil || port <= 0 {
+			return nil, errors.New(fmt.Sprintf("Invalid port in target %q", entry))
+		}
+		targets = append(targets, &Target{host, port})
+	}
+
+	if len(targets) == 0 {
+		return nil, errors.New("No targets specified")
+	}
+
+	return targets, nil
+}
+
 func SetHasErrors(perfdata []*PerfData, threshold int) bool {
 	total := 0
 	for _, data := range perfdata {
@@ -103,38 +131,37 @@ func HasClientErrors(perfdata []*PerfData) bool {
 	return total > 0
 }
 
-var iFieldNames = []string{"ConnectionBurstLength", "TotalConnections", "TotalRequests", "TotalReplies", "TestDuration", "ConnectionsPerSecond", "MsPerConnection", "ConcurrentConnections", "ConnectionTimeMin", "ConnectionTimeAvg", "ConnectionTimeMax", "ConnectionTimeMedian", "ConnectionTimeStddev", "ConnectionTimeConnect", "RepliesPerConnection", "RequestsPerSecond", "MsPerRequest", "RequestSize", "RepliesPerSecMin", "RepliesPerSecAvg", "RepliesPerSecMax", "RepliesPerSecStddev", "RepliesPerSecNumSamples", "ReplyTimeResponse", "ReplyTimeTransfer", "ReplySizeHeader", "ReplySizeContent", "ReplySizeFooter", "ReplySizeTotal", "ReplyStatus_1xx", "ReplyStatus_2xx", "ReplyStatus_3xx", "ReplyStatus_4xx", "ReplyStatus_5xx", "CpuTimeUser", "CpuTimeSystem", "CpuPercUser", "CpuPercSystem", "CpuPercTotal", "NetIOValue", "ErrTotal", "ErrClientTimeout", "ErrSocketTimeout", "ErrConnectionRefused", "ErrConnectionReset", "ErrFdUnavail", "ErrAddRunAvail", "ErrFtabFull", "ErrOther"}
-var iType = []string{"max", "sum", "sum", "sum", "max", "sum", "avg", "sum", "min", "avg", "max", "avg", "avg", "avg", "avg", "sum", "avg", "avg", "min", "avg", "max", "avg", "sum", "avg", "avg", "avg", "avg", "avg", "avg", "sum", "sum", "sum", "sum", "sum", "avg", "avg", "avg", "avg", "avg", "avg", "sum", "sum", "sum", "sum", "sum", "sum", "sum", "sum", "sum"}
+// Combine the aggregated values of each worker into a single set of values,
+// using the aggregation declared for each field in the schema.
+func AggregatePerfData(perfdata []*PerfData, workers int) []float64 {
+	res := make([]float64, len(perfSchema.aggregates))
+	copy(res, perfdata[0].All)
 
-func PrintAggregateStats(perfdata []*PerfData, workers int) {
-	var res []float64 = make([]float64, 49)
-	for i, n := range perfdata[0].All {
-		res[i] = n
-	}
-	
 	for _, data := range perfdata[1:] {
 		for i, n := range data.All {
-			switch iType[i] {
-				case "sum", "avg": {
-					res[i] += n
-				}
-				case "min": {
-					res[i] = math.Min(res[i], n)
-				}
-				case "max": {
-					res[i] = math.Max(res[i], n)
-				}
+			switch perfSchema.aggregates[i].agg {
+			case "sum", "avg":
+				res[i] += n
+			case "min":
+				res[i] = math.Min(res[i], n)
+			case "max":
+				res[i] = math.Max(res[i], n)
 			}
-			
 		}
 	}
 
-	for i, t := range iType {
-		if (t == "avg") {
-			res[i] = res[i]/float64(workers)
+	for i, m := range perfSchema.aggregates {
+		if m.agg == "avg" {
+			res[i] = res[i] / float64(workers)
 		}
 	}
 
+	return res
+}
+
+func PrintAggregateStats(perfdata []*PerfData, workers int) {
+	res := AggregatePerfData(perfdata, workers)
+
 	sres := strings.Trim(strings.Join(strings.Fields(fmt.Sprint(res)), "|"), "[]") + "\n"
 	fmt.Println(sres)
 
@@ -0,0 +1,122 @@
+package main
+
+import "fmt"
+
+// How far short of the requested duration or connection rate a benchmark
+// may fall before it is flagged as a warning, and then as an error.
+const (
+	SHORTFALL_WARNING = 0.9
+	SHORTFALL_ERROR   = 0.5
+)
+
+type Severity int
+
+const (
+	Warning Severity = iota
+	Error
+)
+
+func (s Severity) String() string {
+	if s == Error {
+		return "error"
+	}
+	return "warning"
+}
+
+// A problem found with a parsed result. A result with any issue of
+// severity Error should not be trusted.
+type Issue struct {
+	Severity Severity
+	Field    string
+	Text     string
+}
+
+func (i *Issue) String() string {
+	return fmt.Sprintf("%s: %s: %s", i.Severity, i.Field, i.Text)
+}
+
+func (d *PerfData) isMissing(field string) bool {
+	for _, name := range d.Missing {
+		if name == field {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *PerfData) addIssue(severity Severity, field string, format string, args ...interface{}) {
+	d.Issues = append(d.Issues, &Issue{severity, field, fmt.Sprintf(format, args...)})
+}
+
+// Grade how far a value fell short of what was asked for, returning false
+// when it is close enough.
+func shortfall(achieved, requested float64) (Severity, bool) {
+	if achieved < requested*SHORTFALL_ERROR {
+		return Error, true
+	} else if achieved < requested*SHORTFALL_WARNING {
+		return Warning, true
+	}
+	return Warning, false
+}
+
+// The number of seconds a benchmark was expected to run for, or 0 if it was
+// not given a duration or a rate to work it out from.
+func (d *PerfData) expectedDuration() float64 {
+	if d.ArgDuration > 0 {
+		return float64(d.ArgDuration)
+	}
+	if d.ArgConnectionRate > 0 && d.ArgNumConnections > 0 {
+		return float64(d.ArgNumConnections) / float64(d.ArgConnectionRate)
+	}
+	return 0
+}
+
+// Check that a parsed result makes sense for the arguments it was run with,
+// recording anything suspicious in Issues. Fields that were missing from the
+// output are not checked.
+func (d *PerfData) Validate() {
+	d.Issues = nil
+
+	if !d.isMissing("TotalReplies") && !d.isMissing("TotalRequests") && d.TotalReplies > d.TotalRequests {
+		d.addIssue(Error, "TotalReplies", "%.0f replies to only %.0f requests", d.TotalReplies, d.TotalRequests)
+	}
+
+	if expected := d.expectedDuration(); expected > 0 && !d.isMissing("TestDuration") {
+		if severity, short := shortfall(d.TestDuration, expected); short {
+			d.addIssue(severity, "TestDuration", "ran for %.1fs of the %.1fs requested", d.TestDuration, expected)
+		}
+	}
+
+	// An open-loop client that cannot keep up with the rate reports a lower
+	// one. When the server was refusing connections the shortfall is more
+	// likely to be the server's, so it is only a warning.
+	if d.ArgConnectionRate > 0 && !d.isMissing("ConnectionsPerSecond") {
+		if severity, short := shortfall(d.ConnectionsPerSecond, float64(d.ArgConnectionRate)); short {
+			if d.ErrTotal > 0 {
+				severity = Warning
+			}
+			d.addIssue(severity, "ConnectionsPerSecond", "achieved %.1f conn/s of the %d requested",
+				d.ConnectionsPerSecond, d.ArgConnectionRate)
+		}
+	}
+}
+
+// Whether any issue found by Validate makes the result untrustworthy
+func (d *PerfData) Untrustworthy() bool {
+	for _, issue := range d.Issues {
+		if issue.Severity == Error {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether any of a set of results is untrustworthy
+func AnyUntrustworthy(data []*PerfData) bool {
+	for _, perfdata := range data {
+		if perfdata.Untrustworthy() {
+			return true
+		}
+	}
+	return false
+}
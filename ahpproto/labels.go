@@ -0,0 +1,35 @@
+package ahpproto
+
+import "errors"
+import "fmt"
+import "sort"
+import "strings"
+
+// Parse a list of key=value labels, as given to -labels on the daemon and
+// sent by it when it registers with a coordinator
+func ParseLabels(list string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(list, ",") {
+		pair = strings.TrimSpace(pair)
+		if len(pair) == 0 {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || len(strings.TrimSpace(kv[0])) == 0 {
+			return nil, errors.New(fmt.Sprintf("Invalid label %q, expected key=value", pair))
+		}
+		labels[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return labels, nil
+}
+
+// Format labels sorted by key and separated by semicolons, so that they stay
+// in a single CSV column
+func FormatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for key, value := range labels {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ";")
+}
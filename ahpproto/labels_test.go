@@ -0,0 +1,23 @@
+package ahpproto
+
+import "reflect"
+import "testing"
+
+func TestParseLabels(t *testing.T) {
+	labels, err := ParseLabels("zone=eu-west, size = large,")
+	if err != nil {
+		t.Fatalf("Failed to parse: %s", err)
+	}
+	if !reflect.DeepEqual(labels, map[string]string{"zone": "eu-west", "size": "large"}) {
+		t.Errorf("Unexpected labels %v", labels)
+	}
+	if FormatLabels(labels) != "size=large;zone=eu-west" {
+		t.Errorf("Unexpected formatting %q", FormatLabels(labels))
+	}
+
+	for _, bad := range []string{"zone", "=eu-west"} {
+		if _, err := ParseLabels(bad); err == nil {
+			t.Errorf("Expected an error for %q", bad)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+// Package ahpproto holds the messages exchanged between the autohttperf
+// coordinator and its worker daemons over net/rpc. Both sides import it, so
+// that they cannot drift apart, and every change to a message must bump
+// Version: gob quietly drops fields that only one side knows about, so a
+// mismatched pair would otherwise run with wrong settings rather than fail.
+// The JSON tags name the fields in the daemon's HTTP API.
+//
+// The daemon serves these calls on the HTTPerf service:
+//
+//	Hello(*Hello, *Hello)       check that both sides speak the same Version
+//	Benchmark(*Args, *Result)   run a benchmark and return the raw output
+//	Submit(*Args, *string)      start a benchmark as a job, returning its id,
+//	                            which is Args.Job when that is given
+//	Status(string, *JobStatus)  the state of a job
+//	Result(string, *Result)     the output of a job once it is done
+//	Jobs(int, *[]JobStatus)     every job the daemon still knows about
+//	Abort(string, *bool)        stop a queued or running job
+//	Progress(*ProgressRequest, *Progress)
+//	                            wait for news of a running job, answering as
+//	                            soon as there is some or after Wait ms
+//	Info(int, *Info)            describe the worker
+//	Ping(int, *int)             answer a heartbeat with the same number
+//	Renew(string, *bool)        renew the lease of a running job
+//	StartSink(int, *int)        start a sink server for calibration
+package ahpproto
+
+import "errors"
+import "fmt"
+import "time"
+
+// The version of the protocol. Bump it whenever a message changes.
+const Version = 5
+
+const ERR_VERSION = "The %s speaks protocol version %d but the %s speaks version %d, upgrade the older of the two"
+const ERR_BUSY = "The worker is busy with job %q of %q"
+
+// The settings of a benchmark, sent to a worker by the coordinator
+type Args struct {
+	Host                  string `json:"host"`
+	Port                  int    `json:"port"`
+	URL                   string `json:"url"`
+	NumConnections        int    `json:"num_connections"`
+	ConnectionRate        int    `json:"connection_rate"`
+	RequestsPerConnection int    `json:"requests_per_connection"`
+	Duration              int    `json:"duration"`
+	Timeout               int    `json:"timeout"`
+	Concurrency           int    `json:"concurrency"` // Closed-loop clients, 0 for an open-loop httperf run
+	ThinkTime             int    `json:"think_time"`  // Milliseconds between requests (closed-loop only)
+	Verbose               bool   `json:"verbose"`     // Include reply rate samples and the lifetime histogram
+	Backend               string `json:"backend"`     // The load generator to use, empty for the daemon's default
+	Lease                 int    `json:"lease"`       // Seconds the benchmark may run without its lease being renewed, 0 for no lease
+	Job                   string `json:"job"`         // Identifies the benchmark when renewing its lease
+	Owner                 string `json:"owner"`       // Who the benchmark is run for, named to others finding the worker busy
+	QueueWait             int    `json:"queue_wait"`  // Seconds to wait for a busy worker to free up, 0 to be rejected at once
+	Version               int    `json:"-"`           // The protocol version of the coordinator, always Version
+}
+
+// The output of a benchmark, which the coordinator parses
+type Result struct {
+	Stdout     string `json:"stdout"`
+	Stderr     string `json:"stderr"`
+	ExitStatus int    `json:"exit_status"`
+	Backend    string `json:"backend"` // The load generator that produced the output
+}
+
+// What a worker reports about itself to the coordinator
+type Info struct {
+	NumCPU int               `json:"num_cpu"`
+	Procs  int               `json:"procs"`  // The httperf processes a benchmark is split over
+	Labels map[string]string `json:"labels"` // Set with -labels on the daemon
+}
+
+// The handshake the coordinator opens every connection with, each side
+// sending its own protocol version
+type Hello struct {
+	Version int `json:"version"`
+}
+
+// The states of a job. Jobs start out queued and end up done, failed or
+// aborted, after which their output is kept for a while for collection.
+const (
+	JOB_QUEUED  = "queued"
+	JOB_RUNNING = "running"
+	JOB_DONE    = "done"
+	JOB_FAILED  = "failed"
+	JOB_ABORTED = "aborted"
+)
+
+// The state of a job on a worker
+type JobStatus struct {
+	ID        string     `json:"id"`
+	State     string     `json:"state"`
+	Args      *Args      `json:"args"`
+	Error     string     `json:"error,omitempty"` // Why the job failed or was aborted
+	Submitted time.Time  `json:"submitted"`
+	Started   *time.Time `json:"started,omitempty"`
+	Finished  *time.Time `json:"finished,omitempty"`
+}
+
+// Whether the job has finished, one way or another
+func (s *JobStatus) Ended() bool {
+	return s.State == JOB_DONE || s.State == JOB_FAILED || s.State == JOB_ABORTED
+}
+
+// Asks for the progress of a job, once there is more than the caller has
+// already seen
+type ProgressRequest struct {
+	Job   string
+	Since int // The number of lines already seen, Progress.Next of the last answer
+	Wait  int // Milliseconds to wait for news before answering anyway
+}
+
+// The progress of a job while it runs
+type Progress struct {
+	Job     string    `json:"job"`
+	State   string    `json:"state"`
+	Elapsed float64   `json:"elapsed"`         // Seconds since the job started
+	Samples []float64 `json:"samples"`         // Every reply rate sample so far, in replies/s
+	Errors  int       `json:"errors"`          // Errors so far, -1 when the load generator does not report them live
+	Lines   []string  `json:"lines,omitempty"` // Output lines since Since, e.g. from stderr
+	Next    int       `json:"next"`            // The Since of the next request
+}
+
+// The error of a benchmark sent to a worker that is already running as many
+// as its -maxjobs allows, and that could not wait for one to finish. Over
+// net/rpc only the text of an error arrives, see AsBusy.
+type BusyError struct {
+	Job   string `json:"job"`   // A job the worker is busy with
+	Owner string `json:"owner"` // Who that job is run for
+}
+
+func (e *BusyError) Error() string {
+	return fmt.Sprintf(ERR_BUSY, e.Job, e.Owner)
+}
+
+// Recognise a BusyError from its text, e.g. in an rpc.ServerError
+func AsBusy(err error) (*BusyError, bool) {
+	if err == nil {
+		return nil, false
+	}
+	if busy, ok := err.(*BusyError); ok {
+		return busy, true
+	}
+
+	busy := new(BusyError)
+	if _, scanErr := fmt.Sscanf(err.Error(), ERR_BUSY, &busy.Job, &busy.Owner); scanErr != nil {
+		return nil, false
+	}
+	return busy, true
+}
+
+// Check that a version received from the other side matches this one. The
+// names say which side is which in the error, e.g. "coordinator", "daemon".
+func CheckVersion(local string, remote string, version int) error {
+	if version != Version {
+		return errors.New(fmt.Sprintf(ERR_VERSION, remote, version, local, Version))
+	}
+	return nil
+}
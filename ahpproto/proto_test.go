@@ -0,0 +1,148 @@
+package ahpproto
+
+import "bytes"
+import "encoding/gob"
+import "encoding/json"
+import "errors"
+import "reflect"
+import "strings"
+import "testing"
+import "time"
+
+// Encode a message with gob and decode it into a fresh value of the same type
+func roundTrip(t *testing.T, message interface{}) interface{} {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(message); err != nil {
+		t.Fatalf("Failed to encode %T: %s", message, err)
+	}
+
+	decoded := reflect.New(reflect.TypeOf(message).Elem()).Interface()
+	if err := gob.NewDecoder(&buf).Decode(decoded); err != nil {
+		t.Fatalf("Failed to decode %T: %s", message, err)
+	}
+	return decoded
+}
+
+// Every field is set to something other than its zero value, since gob
+// leaves zero values out and would hide a field that does not survive
+func TestRoundTrip(t *testing.T) {
+	// Without a monotonic reading, which gob does not keep
+	submitted := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	started := submitted.Add(time.Second)
+	finished := started.Add(time.Minute)
+
+	messages := []interface{}{
+		&Args{
+			Host:                  "localhost",
+			Port:                  8080,
+			URL:                   "/index.html",
+			NumConnections:        6000,
+			ConnectionRate:        200,
+			RequestsPerConnection: 5,
+			Duration:              60,
+			Timeout:               5,
+			Concurrency:           10,
+			ThinkTime:             100,
+			Verbose:               true,
+			Backend:               "wrk",
+			Lease:                 30,
+			Job:                   "1234-worker:0",
+			Owner:                 "alice@bench1",
+			QueueWait:             120,
+			Version:               Version,
+		},
+		&Result{"Total: connections 1", "warning", 1, "httperf"},
+		&Info{8, 4, map[string]string{"zone": "eu", "size": "large"}},
+		&Hello{Version},
+		&JobStatus{
+			ID:        "1234-worker:0",
+			State:     JOB_FAILED,
+			Args:      &Args{Host: "localhost", Port: 80, Job: "1234-worker:0", Version: Version},
+			Error:     "Job 1234-worker:0 was aborted",
+			Submitted: submitted,
+			Started:   &started,
+			Finished:  &finished,
+		},
+		&ProgressRequest{Job: "1234-worker:0", Since: 3, Wait: 5000},
+		&Progress{
+			Job:     "1234-worker:0",
+			State:   JOB_RUNNING,
+			Elapsed: 12.5,
+			Samples: []float64{1444.8, 1502.2},
+			Errors:  7,
+			Lines:   []string{"httperf: warning: open file limit > FD_SETSIZE"},
+			Next:    4,
+		},
+		&BusyError{Job: "1234-worker:0", Owner: "alice@bench1 (pid 42)"},
+	}
+
+	for _, message := range messages {
+		value := reflect.ValueOf(message).Elem()
+		for i := 0; i < value.NumField(); i++ {
+			if value.Field(i).IsZero() {
+				t.Errorf("%T.%s is not set by the test", message, value.Type().Field(i).Name)
+			}
+		}
+
+		if decoded := roundTrip(t, message); !reflect.DeepEqual(decoded, message) {
+			t.Errorf("%T did not survive a round trip: sent %+v, got %+v", message, message, decoded)
+		}
+	}
+}
+
+func TestCheckVersion(t *testing.T) {
+	if err := CheckVersion("daemon", "coordinator", Version); err != nil {
+		t.Errorf("Expected the same version to be accepted, got %s", err)
+	}
+
+	err := CheckVersion("daemon", "coordinator", Version+1)
+	if err == nil {
+		t.Fatalf("Expected a different version to be refused")
+	}
+	if !strings.Contains(err.Error(), "coordinator speaks protocol version") {
+		t.Errorf("Unclear error %q", err)
+	}
+}
+
+// The JSON names are the daemon's HTTP API, so must not change by accident
+func TestJSONNames(t *testing.T) {
+	data, err := json.Marshal(&Args{Host: "localhost", ConnectionRate: 200, Version: Version})
+	if err != nil {
+		t.Fatalf("Failed to encode: %s", err)
+	}
+	for _, name := range []string{`"host":"localhost"`, `"connection_rate":200`, `"requests_per_connection":0`} {
+		if !strings.Contains(string(data), name) {
+			t.Errorf("Expected %s in %s", name, data)
+		}
+	}
+	if strings.Contains(string(data), "ersion") {
+		t.Errorf("The protocol version should not be part of the JSON: %s", data)
+	}
+}
+
+func TestJobEnded(t *testing.T) {
+	for state, ended := range map[string]bool{JOB_QUEUED: false, JOB_RUNNING: false, JOB_DONE: true, JOB_FAILED: true, JOB_ABORTED: true} {
+		if (&JobStatus{State: state}).Ended() != ended {
+			t.Errorf("Job %s: expected ended to be %v", state, ended)
+		}
+	}
+}
+
+func TestAsBusy(t *testing.T) {
+	sent := &BusyError{Job: "1234-worker:0", Owner: "alice@bench1 (pid 42)"}
+
+	// As the coordinator sees it, with only the text surviving net/rpc
+	busy, ok := AsBusy(errors.New(sent.Error()))
+	if !ok {
+		t.Fatalf("Expected %q to be recognised as busy", sent.Error())
+	}
+	if *busy != *sent {
+		t.Errorf("Expected %+v, got %+v", sent, busy)
+	}
+
+	for _, err := range []error{nil, errors.New("Job 1234-worker:0 was aborted")} {
+		if _, ok := AsBusy(err); ok {
+			t.Errorf("Did not expect %v to be recognised as busy", err)
+		}
+	}
+}
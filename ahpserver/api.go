@@ -0,0 +1,175 @@
+package main
+
+import "encoding/json"
+import "fmt"
+import "log"
+import "net/http"
+import "strings"
+
+import "github.com/SpeedyCoder/autohttperf/ahpproto"
+
+// The HTTPerf service as JSON over HTTP, for tools that cannot speak gob:
+//
+//	POST   /v1/benchmarks             start a benchmark, the body is the
+//	                                  ahpproto.Args as JSON. Answers 202
+//	                                  with the benchmark, whose id is used
+//	                                  in the calls below, or 409 when the
+//	                                  worker is busy
+//	GET    /v1/benchmarks             list the benchmarks
+//	GET    /v1/benchmarks/{id}        the benchmark, with its result once
+//	                                  the state is "done"
+//	DELETE /v1/benchmarks/{id}        abort a queued or running benchmark,
+//	                                  or forget a finished one
+//	POST   /v1/benchmarks/{id}/renew  renew the lease of a benchmark
+//	GET    /v1/benchmarks/{id}/progress
+//	                                  stream the ahpproto.Progress of the
+//	                                  benchmark, one JSON object per line,
+//	                                  until it finishes
+//	GET    /v1/info                   the ahpproto.Info of the worker
+//
+// Each benchmark is a job, as described by ahpproto.JobStatus, and is kept
+// for -retain seconds after it finishes. Errors are answered with
+// {"error": "..."}. The same -token and TLS settings apply as for the RPC.
+const API_PREFIX = "/v1/"
+
+// A job as the HTTP API shows it, with its output once it is done
+type apiBenchmark struct {
+	*ahpproto.JobStatus
+	Result *ahpproto.Result `json:"result,omitempty"`
+}
+
+type apiHandler struct {
+	httperf *HTTPerf
+}
+
+func newAPIHandler(httperf *HTTPerf) *apiHandler {
+	return &apiHandler{httperf}
+}
+
+type apiError struct {
+	Error string              `json:"error"`
+	Busy  *ahpproto.BusyError `json:"busy,omitempty"` // What the worker is busy with, for a 409
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, format string, a ...interface{}) {
+	writeJSON(w, status, &apiError{fmt.Sprintf(format, a...), nil})
+}
+
+func (h *apiHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, API_PREFIX), "/")
+	parts := strings.Split(path, "/")
+
+	switch {
+	case path == "info" && req.Method == "GET":
+		info := new(ahpproto.Info)
+		h.httperf.Info(0, info)
+		writeJSON(w, http.StatusOK, info)
+	case path == "benchmarks" && req.Method == "POST":
+		h.start(w, req)
+	case path == "benchmarks" && req.Method == "GET":
+		h.list(w)
+	case len(parts) == 2 && parts[0] == "benchmarks" && req.Method == "GET":
+		h.get(w, parts[1])
+	case len(parts) == 2 && parts[0] == "benchmarks" && req.Method == "DELETE":
+		h.delete(w, parts[1])
+	case len(parts) == 3 && parts[0] == "benchmarks" && parts[2] == "renew" && req.Method == "POST":
+		h.renew(w, parts[1])
+	case len(parts) == 3 && parts[0] == "benchmarks" && parts[2] == "progress" && req.Method == "GET":
+		h.progress(w, req, parts[1])
+	case path == "info" || path == "benchmarks" || (len(parts) >= 2 && parts[0] == "benchmarks"):
+		writeError(w, http.StatusMethodNotAllowed, "%s is not allowed on %s", req.Method, req.URL.Path)
+	default:
+		writeError(w, http.StatusNotFound, "No such resource %s", req.URL.Path)
+	}
+}
+
+// Start a benchmark as a job
+func (h *apiHandler) start(w http.ResponseWriter, req *http.Request) {
+	args := new(ahpproto.Args)
+	decoder := json.NewDecoder(req.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(args); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid benchmark: %s", err)
+		return
+	}
+
+	if err := targetAllowed(args.Host); err != nil {
+		writeError(w, http.StatusForbidden, "%s", err)
+		return
+	}
+
+	// The API is versioned by its path instead
+	args.Version = ahpproto.Version
+	if len(args.Owner) == 0 {
+		args.Owner = req.RemoteAddr
+	}
+	j, err := submitJob(args)
+	if busy, ok := err.(*ahpproto.BusyError); ok {
+		writeJSON(w, http.StatusConflict, &apiError{err.Error(), busy})
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	log.Printf("Job %s submitted by %s", j.status.ID, req.RemoteAddr)
+
+	jobLock.Lock()
+	defer jobLock.Unlock()
+	w.Header().Set("Location", API_PREFIX+"benchmarks/"+j.status.ID)
+	writeJSON(w, http.StatusAccepted, &apiBenchmark{&j.status, nil})
+}
+
+func (h *apiHandler) list(w http.ResponseWriter) {
+	jobLock.Lock()
+	defer jobLock.Unlock()
+	writeJSON(w, http.StatusOK, listJobs())
+}
+
+func (h *apiHandler) get(w http.ResponseWriter, id string) {
+	jobLock.Lock()
+	defer jobLock.Unlock()
+
+	j, err := findJob(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "%s", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &apiBenchmark{&j.status, j.result})
+}
+
+// Abort a job that has not finished, or forget one that has
+func (h *apiHandler) delete(w http.ResponseWriter, id string) {
+	jobLock.Lock()
+	defer jobLock.Unlock()
+
+	j, err := findJob(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "%s", err)
+		return
+	}
+
+	if j.status.Ended() {
+		delete(jobs, id)
+		writeJSON(w, http.StatusOK, &apiBenchmark{&j.status, j.result})
+		return
+	}
+
+	j.abort()
+	writeJSON(w, http.StatusAccepted, &apiBenchmark{&j.status, nil})
+}
+
+func (h *apiHandler) renew(w http.ResponseWriter, id string) {
+	var renewed bool
+	h.httperf.Renew(id, &renewed)
+	if !renewed {
+		writeError(w, http.StatusNotFound, "No running benchmark %s with a lease", id)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"renewed": true})
+}
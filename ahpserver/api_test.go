@@ -0,0 +1,52 @@
+package main
+
+import "bytes"
+import "encoding/json"
+import "errors"
+import "net/http"
+import "net/http/httptest"
+import "testing"
+
+import "github.com/SpeedyCoder/autohttperf/ahpproto"
+
+func postBenchmark(h http.Handler, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", API_PREFIX+"benchmarks", bytes.NewBufferString(body))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestAPIBusy(t *testing.T) {
+	g := withTestGenerator(t)
+	h := newAPIHandler(new(HTTPerf))
+
+	w := postBenchmark(h, `{"host": "localhost", "port": 80, "backend": "test", "job": "first", "owner": "alice"}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202 for the first benchmark, got %d: %s", w.Code, w.Body)
+	}
+	if location := w.Header().Get("Location"); location != API_PREFIX+"benchmarks/first" {
+		t.Errorf("Unexpected location %q", location)
+	}
+
+	// A second benchmark that will not wait finds the worker busy
+	w = postBenchmark(h, `{"host": "localhost", "port": 80, "backend": "test", "job": "second"}`)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("Expected 409 for the second benchmark, got %d: %s", w.Code, w.Body)
+	}
+	var answer apiError
+	if err := json.Unmarshal(w.Body.Bytes(), &answer); err != nil {
+		t.Fatalf("Invalid error %s: %s", w.Body, err)
+	}
+	if answer.Busy == nil || answer.Busy.Job != "first" || answer.Busy.Owner != "alice" {
+		t.Errorf("Expected to be busy with first for alice, got %+v", answer.Busy)
+	}
+	if busy, ok := ahpproto.AsBusy(errors.New(answer.Error)); !ok || busy.Job != "first" {
+		t.Errorf("Expected the error to read as busy, got %q", answer.Error)
+	}
+
+	jobLock.Lock()
+	first := jobs["first"]
+	jobLock.Unlock()
+	close(g.release)
+	<-first.done
+}
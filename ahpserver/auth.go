@@ -0,0 +1,130 @@
+package main
+
+import "crypto/subtle"
+import "crypto/tls"
+import "crypto/x509"
+import "errors"
+import "fmt"
+import "io/ioutil"
+import "log"
+import "net"
+import "net/http"
+import "strings"
+
+// Checks the pre-shared -token on the HTTP CONNECT that opens every RPC
+// connection, so every call made over the connection is authenticated, and
+// on every request to the HTTP API.
+type authHandler struct {
+	next http.Handler
+}
+
+func (h *authHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if len(*token) > 0 {
+		if !validToken(req.Header.Get("Authorization")) {
+			log.Printf("!! Rejected request from %s: missing or invalid token", req.RemoteAddr)
+			if strings.HasPrefix(req.URL.Path, API_PREFIX) {
+				writeError(w, http.StatusUnauthorized, "missing or invalid token")
+			} else {
+				http.Error(w, "missing or invalid token", http.StatusUnauthorized)
+			}
+			return
+		}
+	}
+
+	h.next.ServeHTTP(w, req)
+}
+
+// Check the bearer token of an Authorization header against -token
+func validToken(authorization string) bool {
+	given := strings.TrimPrefix(authorization, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(given), []byte(*token)) == 1
+}
+
+// Listen for the coordinator, over TLS when -tlscert is given. With -tlsca
+// the coordinator must present a certificate signed by that CA as well.
+func listen(addr string) (net.Listener, error) {
+	if len(*tlsCert) == 0 {
+		return net.Listen("tcp", addr)
+	}
+
+	cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if len(*tlsCA) > 0 {
+		pem, err := ioutil.ReadFile(*tlsCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New(fmt.Sprintf("No certificates found in %s", *tlsCA))
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tls.Listen("tcp", addr, config)
+}
+
+// The targets the daemon may benchmark, from -allow. Both are empty when
+// any target is allowed.
+var allowNets []*net.IPNet
+var allowHosts []string
+
+// Parse a comma separated list of host names, addresses and CIDRs
+func parseAllowlist(list string) error {
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		if _, ipnet, err := net.ParseCIDR(entry); err == nil {
+			allowNets = append(allowNets, ipnet)
+		} else if ip := net.ParseIP(entry); ip != nil {
+			allowNets = append(allowNets, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+		} else if strings.Contains(entry, "/") {
+			return errors.New(fmt.Sprintf("Invalid CIDR %q", entry))
+		} else {
+			allowHosts = append(allowHosts, strings.ToLower(entry))
+		}
+	}
+	return nil
+}
+
+// Check that a target is on the allowlist, either by name or because every
+// address it resolves to is in an allowed network.
+func targetAllowed(host string) error {
+	if len(allowNets) == 0 && len(allowHosts) == 0 {
+		return nil
+	}
+
+	for _, allowed := range allowHosts {
+		if allowed == strings.ToLower(host) {
+			return nil
+		}
+	}
+
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		var err error
+		if ips, err = net.LookupIP(host); err != nil {
+			return errors.New(fmt.Sprintf(ERR_NOTALLOWED, host, err.Error()))
+		}
+	}
+
+	for _, ip := range ips {
+		inside := false
+		for _, ipnet := range allowNets {
+			inside = inside || ipnet.Contains(ip)
+		}
+		if !inside {
+			return errors.New(fmt.Sprintf(ERR_NOTALLOWED, host, ip.String()+" is not in an allowed network"))
+		}
+	}
+
+	return nil
+}
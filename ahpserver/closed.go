@@ -0,0 +1,442 @@
+package main
+
+import "bufio"
+import "bytes"
+import "errors"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "log"
+import "math"
+import "net"
+import "net/http"
+import "sort"
+import "sync"
+import "sync/atomic"
+import "syscall"
+import "time"
+
+import "github.com/SpeedyCoder/autohttperf/ahpproto"
+
+// httperf samples the reply rate every five seconds, do the same here
+const SAMPLE_PERIOD = 5 * time.Second
+
+// A client backs off after each failed connection in a row, from the least
+// to the most, so that a target refusing connections is not dialled in a
+// busy loop
+const MIN_BACKOFF = 10 * time.Millisecond
+const MAX_BACKOFF = time.Second
+
+// A native closed-loop load generator. Each of Concurrency clients opens a
+// connection, sends RequestsPerConnection requests one after another with
+// ThinkTime between them, closes the connection and starts again, until
+// either Duration has passed or NumConnections connections have been made.
+type closedLoop struct {
+	args     *ahpproto.Args
+	addr     string
+	timeout  time.Duration
+	started  int64 // Connections started so far, updated atomically
+	stopped  int32 // Set atomically when the lease lapses or the job is aborted
+	progress *progress
+
+	mu            sync.Mutex
+	connections   int
+	requests      int
+	replies       int
+	concurrent    int
+	maxConcurrent int
+	lifetimes     []float64 // Connection lifetimes in ms
+	connectTotal  float64
+	responseTotal float64
+	transferTotal float64
+	requestBytes  float64
+	headerBytes   float64
+	contentBytes  float64
+	status        [6]int
+	sampleReplies int
+	samples       []float64
+
+	errClientTimeout, errConnRefused, errConnReset int
+	errFdUnavail, errAddrUnavail, errOther         int
+}
+
+func runClosedLoop(args *ahpproto.Args, result *ahpproto.Result) error {
+	if args.Duration <= 0 && args.NumConnections <= 0 {
+		return errors.New(ERR_CLOSEDLIMIT)
+	}
+
+	timeout := time.Duration(args.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+
+	e := &closedLoop{
+		args:      args,
+		addr:      net.JoinHostPort(args.Host, fmt.Sprintf("%d", args.Port)),
+		timeout:   timeout,
+		progress:  jobProgress(args),
+		lifetimes: make([]float64, 0, 1024),
+	}
+
+	log.Printf("++ [%p] Running closed-loop benchmark of %s with %d clients", args, e.addr, args.Concurrency)
+
+	// The clients are goroutines of the daemon, so there is no usage of
+	// their own to measure. The CPU time reported is that of the whole
+	// daemon while the benchmark ran, which includes any other job running
+	// alongside it with -maxjobs above 1.
+	var before, after syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &before)
+
+	start := time.Now()
+	var deadline time.Time
+	if args.Duration > 0 {
+		deadline = start.Add(time.Duration(args.Duration) * time.Second)
+	}
+
+	l := startLease(args, func() {
+		atomic.StoreInt32(&e.stopped, 1)
+	})
+	defer l.stop()
+
+	done := make(chan bool)
+	go e.sample(done)
+
+	var wg sync.WaitGroup
+	for i := 0; i < args.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e.client(deadline)
+		}()
+	}
+	wg.Wait()
+	close(done)
+
+	if err := l.stopped(); err != nil {
+		return err
+	}
+
+	elapsed := time.Since(start)
+	syscall.Getrusage(syscall.RUSAGE_SELF, &after)
+
+	result.Stdout = e.report(elapsed, &before, &after)
+	log.Printf("-- [%p] Closed-loop benchmark finished", args)
+
+	return nil
+}
+
+// Record the number of replies received in each sample period
+func (e *closedLoop) sample(done chan bool) {
+	ticker := time.NewTicker(SAMPLE_PERIOD)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			e.mu.Lock()
+			rate := float64(e.sampleReplies) / SAMPLE_PERIOD.Seconds()
+			e.samples = append(e.samples, rate)
+			e.sampleReplies = 0
+			failures := e.errClientTimeout + e.errConnRefused + e.errConnReset +
+				e.errFdUnavail + e.errAddrUnavail + e.errOther
+			e.mu.Unlock()
+
+			e.progress.sample(rate, failures)
+		}
+	}
+}
+
+// A single client, making one connection after another. It thinks between
+// connections as it does between the requests on one, and after a failed
+// connection it waits at least the backoff before trying again.
+func (e *closedLoop) client(deadline time.Time) {
+	backoff := time.Duration(0)
+	for {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return
+		}
+		if atomic.LoadInt32(&e.stopped) != 0 {
+			return
+		}
+		if e.args.NumConnections > 0 && atomic.AddInt64(&e.started, 1) > int64(e.args.NumConnections) {
+			return
+		}
+
+		wait := time.Duration(e.args.ThinkTime) * time.Millisecond
+		if e.connection(deadline) {
+			backoff = 0
+		} else {
+			backoff *= 2
+			if backoff < MIN_BACKOFF {
+				backoff = MIN_BACKOFF
+			} else if backoff > MAX_BACKOFF {
+				backoff = MAX_BACKOFF
+			}
+			if backoff > wait {
+				wait = backoff
+			}
+		}
+
+		if !deadline.IsZero() && time.Until(deadline) < wait {
+			wait = time.Until(deadline)
+		}
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+}
+
+// Make a connection and its requests, reporting whether it succeeded
+func (e *closedLoop) connection(deadline time.Time) bool {
+	start := time.Now()
+
+	conn, err := net.DialTimeout("tcp", e.addr, e.timeout)
+	if err != nil {
+		e.countError(err)
+		return false
+	}
+	defer conn.Close()
+	connected := time.Now()
+
+	e.mu.Lock()
+	e.connections++
+	e.concurrent++
+	if e.concurrent > e.maxConcurrent {
+		e.maxConcurrent = e.concurrent
+	}
+	e.connectTotal += msSince(start, connected)
+	e.mu.Unlock()
+
+	defer func() {
+		e.mu.Lock()
+		e.concurrent--
+		e.mu.Unlock()
+	}()
+
+	reader := bufio.NewReader(conn)
+	calls := e.args.RequestsPerConnection
+	if calls <= 0 {
+		calls = 1
+	}
+
+	for i := 0; i < calls; i++ {
+		if i > 0 && e.args.ThinkTime > 0 {
+			time.Sleep(time.Duration(e.args.ThinkTime) * time.Millisecond)
+		}
+		if i > 0 && ((!deadline.IsZero() && time.Now().After(deadline)) || atomic.LoadInt32(&e.stopped) != 0) {
+			break
+		}
+
+		var req bytes.Buffer
+		fmt.Fprintf(&req, "GET %s HTTP/1.1\r\nHost: %s\r\nUser-Agent: autohttperf\r\n", e.args.URL, e.args.Host)
+		if i == calls-1 {
+			req.WriteString("Connection: close\r\n")
+		}
+		req.WriteString("\r\n")
+
+		conn.SetDeadline(time.Now().Add(e.timeout))
+		sent := time.Now()
+		if _, err := conn.Write(req.Bytes()); err != nil {
+			e.countError(err)
+			return false
+		}
+
+		e.mu.Lock()
+		e.requests++
+		e.requestBytes += float64(req.Len())
+		e.mu.Unlock()
+
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			e.countError(err)
+			return false
+		}
+		responded := time.Now()
+
+		content, err := io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			e.countError(err)
+			return false
+		}
+		transferred := time.Now()
+
+		header := len(resp.Proto) + len(resp.Status) + 3
+		for key, values := range resp.Header {
+			for _, value := range values {
+				header += len(key) + len(value) + 4
+			}
+		}
+
+		e.mu.Lock()
+		e.replies++
+		e.sampleReplies++
+		e.responseTotal += msSince(sent, responded)
+		e.transferTotal += msSince(responded, transferred)
+		e.headerBytes += float64(header)
+		e.contentBytes += float64(content)
+		if class := resp.StatusCode / 100; class >= 1 && class <= 5 {
+			e.status[class]++
+		}
+		e.mu.Unlock()
+	}
+
+	e.mu.Lock()
+	e.lifetimes = append(e.lifetimes, msSince(start, time.Now()))
+	e.mu.Unlock()
+	return true
+}
+
+// Sort an error into one of the httperf error categories
+func (e *closedLoop) countError(err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var nerr net.Error
+	switch {
+	case errors.As(err, &nerr) && nerr.Timeout():
+		e.errClientTimeout++
+	case errors.Is(err, syscall.ECONNREFUSED):
+		e.errConnRefused++
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE), errors.Is(err, io.ErrUnexpectedEOF):
+		e.errConnReset++
+	case errors.Is(err, syscall.EMFILE), errors.Is(err, syscall.ENFILE):
+		e.errFdUnavail++
+	case errors.Is(err, syscall.EADDRNOTAVAIL):
+		e.errAddrUnavail++
+	default:
+		e.errOther++
+	}
+}
+
+func msSince(from, to time.Time) float64 {
+	return float64(to.Sub(from)) / float64(time.Millisecond)
+}
+
+// Divide, returning zero rather than NaN when there is nothing to divide
+func ratio(a, b float64) float64 {
+	if b == 0 {
+		return 0
+	}
+	return a / b
+}
+
+// Produce a report in the same format as httperf, so that the coordinator can
+// parse it in exactly the same way.
+func (e *closedLoop) report(elapsed time.Duration, before, after *syscall.Rusage) string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	secs := elapsed.Seconds()
+	conns := float64(e.connections)
+	replies := float64(e.replies)
+
+	var lmin, lavg, lmax, lmedian, lstddev float64
+	if n := len(e.lifetimes); n > 0 {
+		sort.Float64s(e.lifetimes)
+		lmin, lmax = e.lifetimes[0], e.lifetimes[n-1]
+		lmedian = e.lifetimes[n/2]
+		for _, l := range e.lifetimes {
+			lavg += l
+		}
+		lavg /= float64(n)
+		for _, l := range e.lifetimes {
+			lstddev += (l - lavg) * (l - lavg)
+		}
+		if n > 1 {
+			lstddev = math.Sqrt(lstddev / float64(n-1))
+		}
+	}
+
+	var smin, savg, smax, sstddev float64
+	if n := len(e.samples); n > 0 {
+		smin, smax = e.samples[0], e.samples[0]
+		for _, s := range e.samples {
+			smin = math.Min(smin, s)
+			smax = math.Max(smax, s)
+			savg += s
+		}
+		savg /= float64(n)
+		for _, s := range e.samples {
+			sstddev += (s - savg) * (s - savg)
+		}
+		if n > 1 {
+			sstddev = math.Sqrt(sstddev / float64(n-1))
+		}
+	}
+
+	user := time.Duration(after.Utime.Nano() - before.Utime.Nano()).Seconds()
+	system := time.Duration(after.Stime.Nano() - before.Stime.Nano()).Seconds()
+
+	connRate := ratio(conns, secs)
+	reqRate := ratio(float64(e.requests), secs)
+	header := ratio(e.headerBytes, replies)
+	content := ratio(e.contentBytes, replies)
+	netBytes := (e.requestBytes + e.headerBytes + e.contentBytes) / secs
+
+	errTotal := e.errClientTimeout + e.errConnRefused + e.errConnReset +
+		e.errFdUnavail + e.errAddrUnavail + e.errOther
+
+	var out bytes.Buffer
+	if e.args.Verbose {
+		// httperf prints these as it goes, before the summary
+		for _, s := range e.samples {
+			fmt.Fprintf(&out, "reply-rate = %-8.1f\n", s)
+		}
+	}
+	fmt.Fprintf(&out, "Maximum connect burst length: %d\n\n", e.args.Concurrency)
+	fmt.Fprintf(&out, "Total: connections %d requests %d replies %d test-duration %.3f s\n\n",
+		e.connections, e.requests, e.replies, secs)
+	fmt.Fprintf(&out, "Connection rate: %.1f conn/s (%.1f ms/conn, <=%d concurrent connections)\n",
+		connRate, ratio(1000, connRate), e.maxConcurrent)
+	fmt.Fprintf(&out, "Connection time [ms]: min %.1f avg %.1f max %.1f median %.1f stddev %.1f\n",
+		lmin, lavg, lmax, lmedian, lstddev)
+	fmt.Fprintf(&out, "Connection time [ms]: connect %.1f\n", ratio(e.connectTotal, conns))
+	fmt.Fprintf(&out, "Connection length [replies/conn]: %.3f\n\n", ratio(replies, conns))
+	fmt.Fprintf(&out, "Request rate: %.1f req/s (%.1f ms/req)\n", reqRate, ratio(1000, reqRate))
+	fmt.Fprintf(&out, "Request size [B]: %.1f\n\n", ratio(e.requestBytes, float64(e.requests)))
+	fmt.Fprintf(&out, "Reply rate [replies/s]: min %.1f avg %.1f max %.1f stddev %.1f (%d samples)\n",
+		smin, savg, smax, sstddev, len(e.samples))
+	fmt.Fprintf(&out, "Reply time [ms]: response %.1f transfer %.1f\n",
+		ratio(e.responseTotal, replies), ratio(e.transferTotal, replies))
+	fmt.Fprintf(&out, "Reply size [B]: header %.1f content %.1f footer 0.0 (total %.1f)\n",
+		header, content, header+content)
+	fmt.Fprintf(&out, "Reply status: 1xx=%d 2xx=%d 3xx=%d 4xx=%d 5xx=%d\n\n",
+		e.status[1], e.status[2], e.status[3], e.status[4], e.status[5])
+	fmt.Fprintf(&out, "CPU time [s]: user %.2f system %.2f (user %.1f%% system %.1f%% total %.1f%%)\n",
+		user, system, 100*user/secs, 100*system/secs, 100*(user+system)/secs)
+	fmt.Fprintf(&out, "Net I/O: %.1f KB/s (%.1f*10^6 bps)\n\n", netBytes/1024, netBytes*8/1e6)
+	fmt.Fprintf(&out, "Errors: total %d client-timo %d socket-timo 0 connrefused %d connreset %d\n",
+		errTotal, e.errClientTimeout, e.errConnRefused, e.errConnReset)
+	fmt.Fprintf(&out, "Errors: fd-unavail %d addrunavail %d ftab-full 0 other %d\n",
+		e.errFdUnavail, e.errAddrUnavail, e.errOther)
+
+	if e.args.Verbose {
+		writeLifetimeHistogram(&out, e.lifetimes)
+	}
+
+	return out.String()
+}
+
+// Write the connection lifetimes as a histogram of 1ms buckets, in the same
+// format as httperf --verbose --verbose. The lifetimes must be sorted.
+func writeLifetimeHistogram(out io.Writer, lifetimes []float64) {
+	fmt.Fprintf(out, "\nConnection lifetime histogram (time in ms):\n")
+
+	last := -1
+	for i := 0; i < len(lifetimes); {
+		bucket := int(lifetimes[i])
+		count := 0
+		for ; i < len(lifetimes) && int(lifetimes[i]) == bucket; i++ {
+			count++
+		}
+
+		if last >= 0 && bucket > last+1 {
+			fmt.Fprintf(out, "%14c\n", ':')
+		}
+		fmt.Fprintf(out, "%16.1f %d\n", float64(bucket)+0.5, count)
+		last = bucket
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import "net"
+import "net/http"
+import "net/http/httptest"
+import "strings"
+import "testing"
+
+import "github.com/SpeedyCoder/autohttperf/ahpproto"
+
+// The native engine makes exactly the connections and requests it was asked
+// for and reports them in httperf's format
+func TestClosedLoop(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+	addr := server.Listener.Addr().(*net.TCPAddr)
+
+	args := &ahpproto.Args{Host: "127.0.0.1", Port: addr.Port, URL: "/", NumConnections: 20, RequestsPerConnection: 2, Timeout: 5, Concurrency: 2}
+	result := new(ahpproto.Result)
+	if err := runClosedLoop(args, result); err != nil {
+		t.Fatalf("Failed to run: %s", err)
+	}
+
+	for _, line := range []string{
+		"Total: connections 20 requests 40 replies 40 ",
+		"Connection length [replies/conn]: 2.000",
+		"Reply status: 1xx=0 2xx=40 3xx=0 4xx=0 5xx=0",
+		"Errors: total 0 ",
+	} {
+		if !strings.Contains(result.Stdout, line) {
+			t.Errorf("Expected %q in the report:\n%s", line, result.Stdout)
+		}
+	}
+}
+
+// A target that refuses every connection is retried with a growing backoff
+// rather than dialled in a busy loop
+func TestClosedLoopBackoff(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	args := &ahpproto.Args{Host: "127.0.0.1", Port: port, URL: "/", RequestsPerConnection: 1, Duration: 1, Concurrency: 2}
+	result := new(ahpproto.Result)
+	if err := runClosedLoop(args, result); err != nil {
+		t.Fatalf("Failed to run: %s", err)
+	}
+	s, err := parseHTTPerfSummary(result.Stdout)
+	if err != nil {
+		t.Fatalf("Failed to parse the report: %s\n%s", err, result.Stdout)
+	}
+
+	// 10, 20, 40, ... 640ms make 7 attempts a second for each client
+	if s.connRefused == 0 || s.connRefused > 20 {
+		t.Errorf("Expected a few refused connections in a second, got %.0f", s.connRefused)
+	}
+	if s.connections != 0 {
+		t.Errorf("Expected no connections, got %.0f", s.connections)
+	}
+}
+
+// A client thinks before each new connection, not only between the requests
+// on one
+func TestClosedLoopThinkTime(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+	addr := server.Listener.Addr().(*net.TCPAddr)
+
+	args := &ahpproto.Args{Host: "127.0.0.1", Port: addr.Port, URL: "/", RequestsPerConnection: 1, Duration: 1, Concurrency: 1, ThinkTime: 200}
+	result := new(ahpproto.Result)
+	if err := runClosedLoop(args, result); err != nil {
+		t.Fatalf("Failed to run: %s", err)
+	}
+	s, err := parseHTTPerfSummary(result.Stdout)
+	if err != nil {
+		t.Fatalf("Failed to parse the report: %s\n%s", err, result.Stdout)
+	}
+
+	// About one connection every 200ms for a second
+	if s.connections < 2 || s.connections > 6 {
+		t.Errorf("Expected about 5 connections, got %.0f", s.connections)
+	}
+}
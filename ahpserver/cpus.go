@@ -0,0 +1,92 @@
+package main
+
+import "bufio"
+import "errors"
+import "fmt"
+import "os"
+import "runtime"
+import "strconv"
+import "strings"
+import "sync"
+
+// The cores that the httperf processes of running jobs are pinned to with
+// -pin, so that jobs running side by side never share one
+var cpuLock sync.Mutex
+var cpusInUse = make(map[int]bool)
+
+// The cores the daemon may run on, as restricted by its affinity and cpuset.
+// Every core is allowed when the list cannot be read.
+func allowedCPUs() []int {
+	if file, err := os.Open("/proc/self/status"); err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(line, "Cpus_allowed_list:") {
+				cpus, err := parseCPUList(strings.TrimPrefix(line, "Cpus_allowed_list:"))
+				if err == nil && len(cpus) > 0 {
+					return cpus
+				}
+				break
+			}
+		}
+	}
+
+	cpus := make([]int, runtime.NumCPU())
+	for i := range cpus {
+		cpus[i] = i
+	}
+	return cpus
+}
+
+// Parse a list of cores in the format of the kernel and taskset, e.g.
+// "0-3,8,10-11"
+func parseCPUList(list string) ([]int, error) {
+	cpus := []int{}
+	for _, part := range strings.Split(strings.TrimSpace(list), ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid core %q", part))
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil || last < first {
+				return nil, errors.New(fmt.Sprintf("invalid range of cores %q", part))
+			}
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+// Reserve up to n of the allowed cores that no running job is pinned to,
+// which may be none at all
+func reserveCPUs(n int) []int {
+	cpuLock.Lock()
+	defer cpuLock.Unlock()
+
+	reserved := []int{}
+	for _, cpu := range allowedCPUs() {
+		if len(reserved) == n {
+			break
+		}
+		if !cpusInUse[cpu] {
+			cpusInUse[cpu] = true
+			reserved = append(reserved, cpu)
+		}
+	}
+	return reserved
+}
+
+// Hand back cores reserved with reserveCPUs
+func releaseCPUs(cpus []int) {
+	cpuLock.Lock()
+	defer cpuLock.Unlock()
+
+	for _, cpu := range cpus {
+		delete(cpusInUse, cpu)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import "reflect"
+import "testing"
+
+func TestParseCPUList(t *testing.T) {
+	for _, test := range []struct {
+		list     string
+		expected []int
+	}{
+		{"0", []int{0}},
+		{"\t0-3\n", []int{0, 1, 2, 3}},
+		{"0-1,4,6-7", []int{0, 1, 4, 6, 7}},
+	} {
+		cpus, err := parseCPUList(test.list)
+		if err != nil || !reflect.DeepEqual(cpus, test.expected) {
+			t.Errorf("%q: expected %v, got %v (%v)", test.list, test.expected, cpus, err)
+		}
+	}
+
+	for _, list := range []string{"", "a", "3-1", "0-", "0,,1"} {
+		if _, err := parseCPUList(list); err == nil {
+			t.Errorf("Expected %q to be rejected", list)
+		}
+	}
+}
+
+// Jobs running side by side are never pinned to the same core, and only to
+// cores the daemon is allowed
+func TestReserveCPUs(t *testing.T) {
+	allowed := make(map[int]bool)
+	for _, cpu := range allowedCPUs() {
+		allowed[cpu] = true
+	}
+
+	first := reserveCPUs(1)
+	second := reserveCPUs(len(allowed))
+	defer releaseCPUs(second)
+	if len(first) != 1 || len(second) != len(allowed)-1 {
+		t.Fatalf("Expected 1 and %d of the %d allowed cores, got %v and %v", len(allowed)-1, len(allowed), first, second)
+	}
+	for _, cpu := range append(append([]int{}, first...), second...) {
+		if !allowed[cpu] {
+			t.Errorf("Core %d is not allowed", cpu)
+		}
+	}
+	for _, cpu := range second {
+		if cpu == first[0] {
+			t.Errorf("Core %d was reserved twice", cpu)
+		}
+	}
+	if third := reserveCPUs(1); len(third) != 0 {
+		t.Errorf("Expected no free cores, got %v", third)
+	}
+
+	releaseCPUs(first)
+	if again := reserveCPUs(1); !reflect.DeepEqual(again, first) {
+		t.Errorf("Expected the released core %v, got %v", first, again)
+	} else {
+		releaseCPUs(again)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import "errors"
+import "fmt"
+import "log"
+import "os/exec"
+import "runtime"
+import "strings"
+
+import "github.com/SpeedyCoder/autohttperf/ahpproto"
+
+// httperf is single-threaded, so on a worker with many cores it runs a
+// benchmark as -procs httperf processes side by side, each with its share of
+// the connections and the rate, and merges their outputs into the output of
+// a single httperf that did all of the work. With -pin each process is kept
+// to a core of its own, out of those the daemon is allowed and no other
+// running job is pinned to.
+type httperfGenerator struct{}
+
+func (g *httperfGenerator) Name() string {
+	return "httperf"
+}
+
+func (g *httperfGenerator) Run(args *ahpproto.Args, result *ahpproto.Result) error {
+	path, err := exec.LookPath("httperf")
+	if err != nil {
+		return errors.New(fmt.Sprintf(ERR_EXECNOTFOUND, "httperf", err.Error()))
+	}
+	taskset := ""
+	if *pin {
+		if taskset, err = exec.LookPath("taskset"); err != nil {
+			return errors.New(fmt.Sprintf(ERR_EXECNOTFOUND, "taskset", err.Error()))
+		}
+	}
+
+	// Pinned, there is one process for each core that no other job has
+	procs := httperfProcs(args)
+	var cpus []int
+	if *pin {
+		cpus = reserveCPUs(procs)
+		defer releaseCPUs(cpus)
+		if len(cpus) == 0 {
+			return errors.New(fmt.Sprintf(ERR_NOCPUS, len(allowedCPUs())))
+		}
+		procs = len(cpus)
+	}
+
+	shares := splitArgs(args, procs)
+	commands := make([]command, len(shares))
+	for i, share := range shares {
+		program, argv, stdin := httperfCommand(path, share)
+		program, argv = lineBuffered(program, argv)
+		if *pin {
+			cpu := fmt.Sprintf("%d", cpus[i])
+			argv = append([]string{"--cpu-list", cpu, program}, argv...)
+			program = taskset
+		}
+		commands[i] = command{program, argv, stdin}
+	}
+
+	outputs, err := runCommands(args, commands)
+	if err != nil {
+		return err
+	}
+	if len(outputs) == 1 {
+		result.Stdout = outputs[0].Stdout
+		result.Stderr = outputs[0].Stderr
+		return nil
+	}
+
+	stdout := make([]string, len(outputs))
+	stderr := make([]string, 0, len(outputs))
+	for i, output := range outputs {
+		stdout[i] = output.Stdout
+		if len(output.Stderr) > 0 {
+			stderr = append(stderr, fmt.Sprintf("[%d] %s", i, output.Stderr))
+		}
+	}
+	merged, left, err := mergeHTTPerf(stdout, args.Verbose)
+	if err != nil {
+		return err
+	}
+	for _, reason := range left {
+		log.Printf("!! [%p] %s", args, reason)
+		stderr = append(stderr, reason+"\n")
+	}
+	result.Stdout = merged
+	result.Stderr = strings.Join(stderr, "")
+	return nil
+}
+
+// The number of httperf processes a benchmark is split over at most: -procs,
+// or one per core when that is 0
+func workerProcs() int {
+	if *procs <= 0 {
+		return runtime.NumCPU()
+	}
+	return *procs
+}
+
+// The number of httperf processes to split a benchmark over, but no more
+// than there are connections or connections per second to go round
+func httperfProcs(args *ahpproto.Args) int {
+	procs := workerProcs()
+	if args.NumConnections > 0 && procs > args.NumConnections {
+		procs = args.NumConnections
+	}
+	if args.ConnectionRate > 0 && procs > args.ConnectionRate {
+		procs = args.ConnectionRate
+	}
+	if procs < 1 {
+		procs = 1
+	}
+	return procs
+}
+
+// Split a benchmark into n, each with its share of the connections and the
+// rate. The remainders go to the first shares.
+func splitArgs(args *ahpproto.Args, n int) []*ahpproto.Args {
+	shares := make([]*ahpproto.Args, n)
+	for i := range shares {
+		share := *args
+		share.NumConnections = args.NumConnections / n
+		if i < args.NumConnections%n {
+			share.NumConnections++
+		}
+		share.ConnectionRate = args.ConnectionRate / n
+		if i < args.ConnectionRate%n {
+			share.ConnectionRate++
+		}
+		shares[i] = &share
+	}
+	return shares
+}
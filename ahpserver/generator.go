@@ -0,0 +1,392 @@
+package main
+
+import "bufio"
+import "bytes"
+import "errors"
+import "fmt"
+import "io"
+import "log"
+import "os/exec"
+import "strings"
+import "sync"
+import "syscall"
+
+import "github.com/SpeedyCoder/autohttperf/ahpproto"
+
+// A load generator that the daemon can run a benchmark with. The name is
+// returned to the coordinator in the Result, which uses it to pick the
+// parser for the output.
+type Generator interface {
+	Name() string
+	Run(args *ahpproto.Args, result *ahpproto.Result) error
+}
+
+// A generator that runs an external tool. The command function is given
+// the full path of the executable and builds the program to run, its
+// arguments and anything to be written to its stdin.
+type commandGenerator struct {
+	name       string
+	executable string
+	command    func(path string, args *ahpproto.Args) (string, []string, string)
+}
+
+func (g *commandGenerator) Name() string {
+	return g.name
+}
+
+func (g *commandGenerator) Run(args *ahpproto.Args, result *ahpproto.Result) error {
+	// The tool must exist in the PATH of the current user/environment
+	path, err := exec.LookPath(g.executable)
+	if err != nil {
+		return errors.New(fmt.Sprintf(ERR_EXECNOTFOUND, g.executable, err.Error()))
+	}
+
+	program, argv, stdin := g.command(path, args)
+	return runCommand(args, program, argv, stdin, result)
+}
+
+// The native closed-loop engine
+type nativeGenerator struct{}
+
+func (g *nativeGenerator) Name() string {
+	return "native"
+}
+
+func (g *nativeGenerator) Run(args *ahpproto.Args, result *ahpproto.Result) error {
+	return runClosedLoop(args, result)
+}
+
+var generators = map[string]Generator{
+	"httperf": &httperfGenerator{},
+	"wrk":     &commandGenerator{"wrk", "wrk", wrkCommand},
+	"ab":      &commandGenerator{"ab", "ab", abCommand},
+	"vegeta":  &commandGenerator{"vegeta", "vegeta", vegetaCommand},
+	"native":  &nativeGenerator{},
+}
+
+// Pick the generator for a benchmark, using the one requested by the
+// coordinator or the daemon's default. httperf only generates open-loop
+// load, so closed-loop benchmarks it would have run use the native engine.
+func selectGenerator(args *ahpproto.Args) (Generator, error) {
+	name := args.Backend
+	if len(name) == 0 {
+		name = *backend
+	}
+
+	if name == "httperf" && args.Concurrency > 0 {
+		name = "native"
+	}
+
+	gen, ok := generators[name]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf(ERR_BACKEND, name))
+	}
+	return gen, nil
+}
+
+func httperfCommand(path string, args *ahpproto.Args) (string, []string, string) {
+	argv := []string{
+		"--server", args.Host,
+		"--port", fmt.Sprintf("%d", args.Port),
+		"--uri", args.URL,
+		"--num-conns", fmt.Sprintf("%d", args.NumConnections),
+		"--rate", fmt.Sprintf("%d", args.ConnectionRate),
+		"--num-calls", fmt.Sprintf("%d", args.RequestsPerConnection),
+		"--timeout", fmt.Sprintf("%d", args.Timeout),
+		"--hog",
+	}
+
+	// The reply rate samples the progress of the job is made of are only
+	// printed at verbosity 1, and the connection lifetime histogram at 2
+	argv = append(argv, "--verbose")
+	if args.Verbose {
+		argv = append(argv, "--verbose")
+	}
+
+	return path, argv, ""
+}
+
+// Run a program with its stdout line buffered when stdbuf is available.
+// Otherwise stdio buffers a pipe in blocks, holding back the lines the
+// progress of the job is made of until the program exits.
+func lineBuffered(program string, argv []string) (string, []string) {
+	stdbuf, err := exec.LookPath("stdbuf")
+	if err != nil {
+		return program, argv
+	}
+	return stdbuf, append([]string{"-oL", program}, argv...)
+}
+
+func targetURL(args *ahpproto.Args) string {
+	return fmt.Sprintf("http://%s:%d%s", args.Host, args.Port, args.URL)
+}
+
+// The duration of a benchmark in seconds, working it out from the number of
+// connections and the rate for tools that cannot stop after N connections.
+func benchmarkSeconds(args *ahpproto.Args) int {
+	if args.Duration > 0 {
+		return args.Duration
+	}
+	if args.ConnectionRate > 0 {
+		if secs := args.NumConnections / args.ConnectionRate; secs > 0 {
+			return secs
+		}
+	}
+	return 1
+}
+
+// wrk and ab are closed-loop tools. When the coordinator asked for an
+// open-loop rate instead, use one client per connection per second, which is
+// the number of connections httperf would have open if each took a second.
+func closedLoopClients(args *ahpproto.Args) int {
+	if args.Concurrency > 0 {
+		return args.Concurrency
+	}
+	if args.ConnectionRate > 0 {
+		return args.ConnectionRate
+	}
+	return 1
+}
+
+func wrkCommand(path string, args *ahpproto.Args) (string, []string, string) {
+	argv := []string{
+		"--threads", "1",
+		"--connections", fmt.Sprintf("%d", closedLoopClients(args)),
+		"--duration", fmt.Sprintf("%ds", benchmarkSeconds(args)),
+		"--latency",
+	}
+	if args.Timeout > 0 {
+		argv = append(argv, "--timeout", fmt.Sprintf("%ds", args.Timeout))
+	}
+	argv = append(argv, targetURL(args))
+
+	return path, argv, ""
+}
+
+func abCommand(path string, args *ahpproto.Args) (string, []string, string) {
+	clients := closedLoopClients(args)
+
+	calls := args.RequestsPerConnection
+	if calls <= 0 {
+		calls = 1
+	}
+	requests := args.NumConnections * calls
+	if requests < clients {
+		requests = clients
+	}
+
+	// ab sets -n to 50000 when it reads -t, so -t goes first. A timed run
+	// without a number of connections leaves it at that.
+	argv := []string{}
+	if args.Duration > 0 {
+		argv = append(argv, "-t", fmt.Sprintf("%d", args.Duration))
+	}
+	if args.Duration <= 0 || args.NumConnections > 0 {
+		argv = append(argv, "-n", fmt.Sprintf("%d", requests))
+	}
+	argv = append(argv, "-c", fmt.Sprintf("%d", clients))
+	if args.Timeout > 0 {
+		argv = append(argv, "-s", fmt.Sprintf("%d", args.Timeout))
+	}
+	if calls > 1 {
+		argv = append(argv, "-k")
+	}
+	argv = append(argv, targetURL(args))
+
+	return path, argv, ""
+}
+
+// vegeta needs its attack piped into its report, so it is run through the
+// shell with the target given on stdin. Without a rate it attacks as fast as
+// a fixed number of workers can, which makes it closed-loop.
+func vegetaCommand(path string, args *ahpproto.Args) (string, []string, string) {
+	attack := []string{path, "attack"}
+	if args.ConnectionRate > 0 {
+		attack = append(attack, fmt.Sprintf("-rate=%d/1s", args.ConnectionRate))
+	} else {
+		clients := closedLoopClients(args)
+		attack = append(attack, "-rate=0", fmt.Sprintf("-workers=%d", clients), fmt.Sprintf("-max-workers=%d", clients))
+	}
+	attack = append(attack, fmt.Sprintf("-duration=%ds", benchmarkSeconds(args)))
+	if args.Timeout > 0 {
+		attack = append(attack, fmt.Sprintf("-timeout=%ds", args.Timeout))
+	}
+
+	pipeline := fmt.Sprintf("%s | %s report -type=text", strings.Join(attack, " "), path)
+	return "/bin/sh", []string{"-c", pipeline}, fmt.Sprintf("GET %s\n", targetURL(args))
+}
+
+// A process for runCommands to run, with anything to be written to its stdin
+type command struct {
+	program string
+	argv    []string
+	stdin   string
+}
+
+// Run a command to completion, collecting its stdout and stderr
+func runCommand(args *ahpproto.Args, program string, argv []string, stdin string, result *ahpproto.Result) error {
+	outputs, err := runCommands(args, []command{{program, argv, stdin}})
+	if err != nil {
+		return err
+	}
+
+	result.Stdout = outputs[0].Stdout
+	result.Stderr = outputs[0].Stderr
+	return nil
+}
+
+// Run commands side by side to completion, collecting the stdout and stderr
+// of each. They share the lease of the benchmark, and their reply rate
+// samples are added up into the samples of the benchmark as a whole.
+func runCommands(args *ahpproto.Args, commands []command) ([]*ahpproto.Result, error) {
+	log.Printf("++ [%p] Running benchmark of %s on port %d", args, args.Host, args.Port)
+	log.Printf("   [%p] Input arguments: %#v", args, args)
+
+	cmds := make([]*exec.Cmd, 0, len(commands))
+	kill := func() {
+		for _, cmd := range cmds {
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		}
+	}
+
+	outpipes := make([]io.Reader, len(commands))
+	errpipes := make([]io.Reader, len(commands))
+	for i, c := range commands {
+		log.Printf("   [%p] Commandline arguments: %#v", args, c.argv)
+
+		// Run the command in a process group of its own, so that everything
+		// it starts (e.g. vegeta under the shell) can be killed along with it
+		cmd := exec.Command(c.program, c.argv...)
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		if len(c.stdin) > 0 {
+			cmd.Stdin = strings.NewReader(c.stdin)
+		}
+		outpipe, err := cmd.StdoutPipe()
+		if err != nil {
+			kill()
+			return nil, errors.New(fmt.Sprintf(ERR_READOUT, err.Error()))
+		}
+		errpipe, err := cmd.StderrPipe()
+		if err != nil {
+			kill()
+			return nil, errors.New(fmt.Sprintf(ERR_READOUT, err.Error()))
+		}
+
+		err = cmd.Start()
+		if err != nil {
+			kill()
+			return nil, errors.New(fmt.Sprintf(ERR_RUNFAILED, err.Error()))
+		}
+
+		log.Printf("   [%p] Process successfully started with PID: %d", args, cmd.Process.Pid)
+		cmds = append(cmds, cmd)
+		outpipes[i], errpipes[i] = outpipe, errpipe
+	}
+
+	l := startLease(args, kill)
+	defer l.stop()
+
+	// Both are read as the commands run, passing on their stderr and the
+	// reply rate samples of httperf --verbose as progress. A sample of the
+	// benchmark is reported once every command has reported it.
+	p := jobProgress(args)
+	var sampleLock sync.Mutex
+	samples := make([][]float64, len(commands))
+	reported := 0
+	sample := func(i int, rate float64) {
+		sampleLock.Lock()
+		defer sampleLock.Unlock()
+
+		samples[i] = append(samples[i], rate)
+		for {
+			var sum float64
+			for _, s := range samples {
+				if len(s) <= reported {
+					return
+				}
+				sum += s[reported]
+			}
+			reported++
+			p.sample(sum, -1)
+		}
+	}
+
+	outputs := make([]*ahpproto.Result, len(commands))
+	readErrs := make([]error, len(commands))
+	var wg sync.WaitGroup
+	for i := range commands {
+		outputs[i] = new(ahpproto.Result)
+		prefix := ""
+		if len(commands) > 1 {
+			prefix = fmt.Sprintf("[%d] ", i)
+		}
+
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			errout, err := readLines(errpipes[i], func(line string) {
+				p.line(prefix + line)
+			})
+			outputs[i].Stderr = string(errout)
+			if err != nil {
+				readErrs[i] = errors.New(fmt.Sprintf(ERR_READERR, err.Error()))
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			output, err := readLines(outpipes[i], func(line string) {
+				if rate, ok := replyRateSample(line); ok {
+					sample(i, rate)
+				}
+			})
+			outputs[i].Stdout = string(output)
+			if err != nil {
+				readErrs[i] = errors.New(fmt.Sprintf(ERR_READOUT, err.Error()))
+			}
+		}(i)
+	}
+	wg.Wait()
+	log.Printf("   [%p] Finished reading stdout and stderr", args)
+
+	var waitErr error
+	for _, cmd := range cmds {
+		if err := cmd.Wait(); err != nil && waitErr == nil {
+			log.Println("Error:", err)
+			waitErr = errors.New(fmt.Sprintf(ERR_WAIT, cmd.Process.Pid))
+		}
+	}
+	log.Printf("-- [%p] Command joined and finished", args)
+
+	if err := l.stopped(); err != nil {
+		return nil, err
+	}
+	for _, err := range readErrs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	if waitErr != nil {
+		return nil, waitErr
+	}
+
+	return outputs, nil
+}
+
+// Read everything from r, calling fn with each line as it arrives
+func readLines(r io.Reader, fn func(line string)) ([]byte, error) {
+	var all bytes.Buffer
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		all.WriteString(line)
+		if len(line) > 0 {
+			fn(strings.TrimRight(line, "\r\n"))
+		}
+		if err == io.EOF {
+			return all.Bytes(), nil
+		}
+		if err != nil {
+			return all.Bytes(), err
+		}
+	}
+}
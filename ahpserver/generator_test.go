@@ -0,0 +1,116 @@
+package main
+
+import "os/exec"
+import "reflect"
+import "testing"
+
+import "github.com/SpeedyCoder/autohttperf/ahpproto"
+
+func countArg(argv []string, arg string) int {
+	n := 0
+	for _, a := range argv {
+		if a == arg {
+			n++
+		}
+	}
+	return n
+}
+
+// Every argument ends up behind its own option, in particular the timeout
+// and the requests per connection
+func TestHTTPerfCommand(t *testing.T) {
+	args := &ahpproto.Args{Host: "localhost", Port: 8080, URL: "/index.html", NumConnections: 100, ConnectionRate: 10, RequestsPerConnection: 3, Timeout: 7}
+	program, argv, _ := httperfCommand("/usr/bin/httperf", args)
+	expected := []string{
+		"--server", "localhost",
+		"--port", "8080",
+		"--uri", "/index.html",
+		"--num-conns", "100",
+		"--rate", "10",
+		"--num-calls", "3",
+		"--timeout", "7",
+		"--hog",
+		"--verbose",
+	}
+	if program != "/usr/bin/httperf" || !reflect.DeepEqual(argv, expected) {
+		t.Errorf("Expected %v, got %s %v", expected, program, argv)
+	}
+}
+
+// The reply rate samples are needed for the progress of every job, the
+// lifetime histogram only when asked for
+func TestHTTPerfVerbosity(t *testing.T) {
+	for _, test := range []struct {
+		verbose bool
+		want    int
+	}{
+		{false, 1},
+		{true, 2},
+	} {
+		args := &ahpproto.Args{Host: "localhost", Port: 80, URL: "/", NumConnections: 100, ConnectionRate: 10, Verbose: test.verbose}
+		_, argv, _ := httperfCommand("/usr/bin/httperf", args)
+		if n := countArg(argv, "--verbose"); n != test.want {
+			t.Errorf("Verbose %v: expected --verbose %d times, got %d in %v", test.verbose, test.want, n, argv)
+		}
+	}
+}
+
+func TestLineBuffered(t *testing.T) {
+	stdbuf, err := exec.LookPath("stdbuf")
+	if err != nil {
+		t.Skip("No stdbuf to test with")
+	}
+
+	program, argv := lineBuffered("/usr/bin/httperf", []string{"--server", "localhost"})
+	if program != stdbuf {
+		t.Errorf("Expected the program to be run by %s, got %s", stdbuf, program)
+	}
+	if want := []string{"-oL", "/usr/bin/httperf", "--server", "localhost"}; !reflect.DeepEqual(argv, want) {
+		t.Errorf("Expected %v, got %v", want, argv)
+	}
+}
+
+func TestABCommand(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		args ahpproto.Args
+		want []string
+	}{
+		{"connections", ahpproto.Args{NumConnections: 100, ConnectionRate: 10, RequestsPerConnection: 1},
+			[]string{"-n", "100", "-c", "10"}},
+		{"timed closed-loop", ahpproto.Args{Duration: 30, Concurrency: 20, RequestsPerConnection: 1},
+			[]string{"-t", "30", "-c", "20"}},
+		{"timed with connections", ahpproto.Args{NumConnections: 300, ConnectionRate: 10, Duration: 30, RequestsPerConnection: 2},
+			[]string{"-t", "30", "-n", "600", "-c", "10", "-k"}},
+	} {
+		args := test.args
+		args.Host, args.Port, args.URL = "localhost", 80, "/"
+		_, argv, _ := abCommand("/usr/bin/ab", &args)
+		if want := append(test.want, "http://localhost:80/"); !reflect.DeepEqual(argv, want) {
+			t.Errorf("%s: expected %v, got %v", test.name, want, argv)
+		}
+	}
+}
+
+func TestVegetaCommand(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		args ahpproto.Args
+		want string
+	}{
+		{"open-loop", ahpproto.Args{ConnectionRate: 50, Duration: 10},
+			"/usr/bin/vegeta attack -rate=50/1s -duration=10s | /usr/bin/vegeta report -type=text"},
+		{"closed-loop", ahpproto.Args{Concurrency: 8, Duration: 10},
+			"/usr/bin/vegeta attack -rate=0 -workers=8 -max-workers=8 -duration=10s | /usr/bin/vegeta report -type=text"},
+	} {
+		args := test.args
+		args.Host, args.Port, args.URL = "localhost", 80, "/"
+		_, argv, stdin := vegetaCommand("/usr/bin/vegeta", &args)
+		if argv[len(argv)-1] != test.want {
+			t.Errorf("%s: expected %q, got %q", test.name, test.want, argv[len(argv)-1])
+		}
+		if stdin != "GET http://localhost:80/\n" {
+			t.Errorf("%s: unexpected target %q", test.name, stdin)
+		}
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import "crypto/rand"
+import "encoding/hex"
+import "errors"
+import "fmt"
+import "log"
+import "sort"
+import "sync"
+import "time"
+
+import "github.com/SpeedyCoder/autohttperf/ahpproto"
+
+// A benchmark run by the daemon. Every benchmark is a job, whether it was
+// submitted over the RPC, started by the blocking Benchmark call or through
+// the HTTP API, so that its output can be collected by id after it finishes.
+// A coordinator that lost its connection in the meantime can then reconnect
+// and collect the result, rather than losing the step.
+type job struct {
+	status   ahpproto.JobStatus
+	result   *ahpproto.Result
+	progress *progress
+	done     chan bool // Closed when the job has finished
+	aborting bool      // Aborted while running, but the benchmark has not exited yet
+}
+
+var jobLock sync.Mutex
+var jobs = make(map[string]*job)
+
+// The jobs waiting for one of the -maxjobs slots, in the order they were
+// submitted, and the number of jobs holding one. The slots channel is closed
+// and replaced whenever either changes, so that queued jobs can wait for
+// their turn.
+var queue []*job
+var running int
+var slots = make(chan bool)
+
+// Must be called with the lock held
+func notifySlots() {
+	close(slots)
+	slots = make(chan bool)
+}
+
+// Drop a job from the queue. Must be called with the lock held.
+func dequeue(j *job) {
+	for i, queued := range queue {
+		if queued == j {
+			queue = append(queue[:i], queue[i+1:]...)
+			notifySlots()
+			return
+		}
+	}
+}
+
+// The error for a benchmark that cannot start at once, or nil when there is
+// a free slot. Must be called with the lock held.
+func busy() error {
+	if *maxJobs <= 0 || running+len(queue) < *maxJobs {
+		return nil
+	}
+	return busyWith(nil)
+}
+
+// Name the oldest job other than except that is running or queued, which is
+// the one in the way. Must be called with the lock held.
+func busyWith(except *job) *ahpproto.BusyError {
+	var oldest *job
+	for _, j := range jobs {
+		if j == except || (j.status.State != ahpproto.JOB_RUNNING && j.status.State != ahpproto.JOB_QUEUED) {
+			continue
+		}
+		if oldest == nil || j.status.Submitted.Before(oldest.status.Submitted) {
+			oldest = j
+		}
+	}
+	if oldest == nil {
+		return &ahpproto.BusyError{}
+	}
+	return &ahpproto.BusyError{Job: oldest.status.ID, Owner: oldest.status.Args.Owner}
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Check a benchmark and start it as a job. A job that was already submitted
+// with the same Args.Job and is still queued or running is returned as it is
+// rather than started again, so that a coordinator can safely submit again
+// when it is unsure whether its first attempt arrived. A job that has ended
+// is replaced, since submitting it again means running the step again.
+func submitJob(args *ahpproto.Args) (*job, error) {
+	if err := ahpproto.CheckVersion("daemon", "coordinator", args.Version); err != nil {
+		return nil, err
+	}
+	if err := targetAllowed(args.Host); err != nil {
+		return nil, err
+	}
+	if _, err := selectGenerator(args); err != nil {
+		return nil, err
+	}
+
+	jobLock.Lock()
+	defer jobLock.Unlock()
+	pruneJobs()
+
+	if len(args.Job) == 0 {
+		args.Job = newJobID()
+	} else if j, ok := jobs[args.Job]; ok && !j.status.Ended() {
+		log.Printf("Job %s was submitted again, it is %s", args.Job, j.status.State)
+		return j, nil
+	}
+
+	// Rather than two benchmarks fighting over the CPU and spoiling both
+	// results, one that cannot wait for the other is turned away
+	if err := busy(); err != nil && args.QueueWait <= 0 {
+		return nil, err
+	}
+
+	j := &job{
+		status: ahpproto.JobStatus{
+			ID:        args.Job,
+			State:     ahpproto.JOB_QUEUED,
+			Args:      args,
+			Submitted: time.Now(),
+		},
+		progress: newProgress(),
+		done:     make(chan bool),
+	}
+	jobs[j.status.ID] = j
+	queue = append(queue, j)
+
+	go j.run()
+	return j, nil
+}
+
+// Wait for the job's turn, which comes once it is first in the queue and a
+// slot is free, and mark it running. Gives up after Args.QueueWait seconds,
+// failing the job as busy, and reports whether the job may run.
+func (j *job) waitForSlot() bool {
+	timeout := time.After(time.Duration(j.status.Args.QueueWait) * time.Second)
+
+	jobLock.Lock()
+	defer jobLock.Unlock()
+
+	for timedOut := false; ; {
+		if j.status.State != ahpproto.JOB_QUEUED {
+			// Aborted before it could start
+			dequeue(j)
+			return false
+		}
+
+		if queue[0] == j && (*maxJobs <= 0 || running < *maxJobs) {
+			dequeue(j)
+			running++
+			now := time.Now()
+			j.status.State = ahpproto.JOB_RUNNING
+			j.status.Started = &now
+			return true
+		}
+
+		if timedOut {
+			j.status.State = ahpproto.JOB_FAILED
+			j.status.Error = busyWith(j).Error()
+			dequeue(j)
+			j.finish()
+			return false
+		}
+
+		changed := slots
+		jobLock.Unlock()
+		select {
+		case <-changed:
+		case <-timeout:
+			timedOut = true
+		}
+		jobLock.Lock()
+	}
+}
+
+func (j *job) run() {
+	if !j.waitForSlot() {
+		return
+	}
+
+	log.Printf("Running job %s", j.status.ID)
+	result := new(ahpproto.Result)
+	gen, err := selectGenerator(j.status.Args)
+	if err == nil {
+		result.Backend = gen.Name()
+		err = gen.Run(j.status.Args, result)
+	}
+	forgetAbort(j.status.ID)
+
+	jobLock.Lock()
+	defer jobLock.Unlock()
+	running--
+	notifySlots()
+
+	switch {
+	case err == nil:
+		j.status.State = ahpproto.JOB_DONE
+		j.result = result
+	case j.aborting:
+		j.status.State = ahpproto.JOB_ABORTED
+		j.status.Error = err.Error()
+	default:
+		j.status.State = ahpproto.JOB_FAILED
+		j.status.Error = err.Error()
+	}
+	j.finish()
+}
+
+// Mark the job as finished. Must be called with the lock held.
+func (j *job) finish() {
+	now := time.Now()
+	j.status.Finished = &now
+	close(j.done)
+	log.Printf("Job %s is %s", j.status.ID, j.status.State)
+}
+
+// Stop a queued or running job. A running job stays running until its
+// benchmark has exited, so that it keeps its slot and a coordinator that
+// submits it again meanwhile gets it back rather than a second benchmark.
+// Must be called with the lock held.
+func (j *job) abort() {
+	switch j.status.State {
+	case ahpproto.JOB_QUEUED:
+		j.status.State = ahpproto.JOB_ABORTED
+		j.status.Error = fmt.Sprintf(ERR_ABORTED, j.status.ID)
+		j.finish()
+		// Wake it up to leave the queue
+		notifySlots()
+	case ahpproto.JOB_RUNNING:
+		if !j.aborting {
+			j.aborting = true
+			abortJob(j.status.ID)
+		}
+	}
+}
+
+// The output of a finished job, or why there is none
+func (j *job) output() (*ahpproto.Result, error) {
+	switch j.status.State {
+	case ahpproto.JOB_DONE:
+		return j.result, nil
+	case ahpproto.JOB_FAILED, ahpproto.JOB_ABORTED:
+		return nil, errors.New(j.status.Error)
+	}
+	return nil, errors.New(fmt.Sprintf(ERR_NOTFINISHED, j.status.ID, j.status.State))
+}
+
+// Look up a job. Must be called with the lock held.
+func findJob(id string) (*job, error) {
+	pruneJobs()
+	j, ok := jobs[id]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf(ERR_NOJOB, id))
+	}
+	return j, nil
+}
+
+// Forget the jobs that finished more than -retain seconds ago. Must be called
+// with the lock held.
+func pruneJobs() {
+	cutoff := time.Now().Add(-time.Duration(*retain) * time.Second)
+	for id, j := range jobs {
+		if j.status.Finished != nil && j.status.Finished.Before(cutoff) {
+			delete(jobs, id)
+		}
+	}
+}
+
+// The status of every job, oldest first. Must be called with the lock held.
+func listJobs() []ahpproto.JobStatus {
+	pruneJobs()
+	list := make([]ahpproto.JobStatus, 0, len(jobs))
+	for _, j := range jobs {
+		list = append(list, j.status)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Submitted.Before(list[j].Submitted)
+	})
+	return list
+}
+
+// Run a benchmark and wait for its output. This is the call coordinators
+// from before the job model use, and it still runs the benchmark as a job.
+func (h *HTTPerf) Benchmark(args *ahpproto.Args, result *ahpproto.Result) error {
+	j, err := submitJob(args)
+	if err != nil {
+		log.Printf("!! Rejected benchmark: %s", err)
+		return err
+	}
+	<-j.done
+
+	jobLock.Lock()
+	defer jobLock.Unlock()
+	output, err := j.output()
+	if err != nil {
+		return err
+	}
+	*result = *output
+	return nil
+}
+
+func (h *HTTPerf) Submit(args *ahpproto.Args, id *string) error {
+	j, err := submitJob(args)
+	if err != nil {
+		log.Printf("!! Rejected job: %s", err)
+		return err
+	}
+	*id = j.status.ID
+	return nil
+}
+
+func (h *HTTPerf) Status(id string, status *ahpproto.JobStatus) error {
+	jobLock.Lock()
+	defer jobLock.Unlock()
+
+	j, err := findJob(id)
+	if err != nil {
+		return err
+	}
+	*status = j.status
+	return nil
+}
+
+func (h *HTTPerf) Result(id string, result *ahpproto.Result) error {
+	jobLock.Lock()
+	defer jobLock.Unlock()
+
+	j, err := findJob(id)
+	if err != nil {
+		return err
+	}
+	output, err := j.output()
+	if err != nil {
+		return err
+	}
+	*result = *output
+	return nil
+}
+
+func (h *HTTPerf) Jobs(unused int, list *[]ahpproto.JobStatus) error {
+	jobLock.Lock()
+	defer jobLock.Unlock()
+
+	*list = listJobs()
+	return nil
+}
+
+// Stop a job, reporting false if it had already finished
+func (h *HTTPerf) Abort(id string, aborted *bool) error {
+	jobLock.Lock()
+	defer jobLock.Unlock()
+
+	j, err := findJob(id)
+	if err != nil {
+		return err
+	}
+	*aborted = !j.status.Ended()
+	j.abort()
+	return nil
+}
@@ -0,0 +1,332 @@
+package main
+
+import "errors"
+import "strings"
+import "sync"
+import "testing"
+import "time"
+
+import "github.com/SpeedyCoder/autohttperf/ahpproto"
+
+// A load generator for the tests, which runs until it is released or killed
+type testGenerator struct {
+	mu      sync.Mutex
+	runs    int
+	release chan bool
+	exit    chan bool // When set, a killed run only returns once it is closed
+}
+
+func (g *testGenerator) Name() string {
+	return "test"
+}
+
+func (g *testGenerator) Run(args *ahpproto.Args, result *ahpproto.Result) error {
+	g.mu.Lock()
+	g.runs++
+	release := g.release
+	exit := g.exit
+	g.mu.Unlock()
+
+	killed := make(chan bool)
+	l := startLease(args, func() { close(killed) })
+	defer l.stop()
+
+	select {
+	case <-release:
+	case <-killed:
+		if exit != nil {
+			<-exit
+		}
+		return l.stopped()
+	}
+	result.Stdout = "Total: connections 1 requests 1 replies 1 test-duration 1.000 s"
+	return nil
+}
+
+func (g *testGenerator) Runs() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.runs
+}
+
+// Install a fresh test generator, with a clean job table and a single slot,
+// for the length of a test
+func withTestGenerator(t *testing.T) *testGenerator {
+	g := &testGenerator{release: make(chan bool)}
+	generators["test"] = g
+
+	jobLock.Lock()
+	jobs = make(map[string]*job)
+	queue = nil
+	running = 0
+	jobLock.Unlock()
+
+	limit := *maxJobs
+	*maxJobs = 1
+	t.Cleanup(func() {
+		g.mu.Lock()
+		select {
+		case <-g.release:
+		default:
+			close(g.release)
+		}
+		g.mu.Unlock()
+
+		// Leave no job queued or running into the next test
+		jobLock.Lock()
+		left := make([]*job, 0, len(jobs))
+		for _, j := range jobs {
+			j.abort()
+			left = append(left, j)
+		}
+		jobLock.Unlock()
+		for _, j := range left {
+			<-j.done
+		}
+
+		*maxJobs = limit
+		delete(generators, "test")
+	})
+	return g
+}
+
+func testArgs(job string) *ahpproto.Args {
+	return &ahpproto.Args{Host: "localhost", Port: 80, Backend: "test", Job: job, Version: ahpproto.Version}
+}
+
+// Wait for a job to reach a state, failing the test if it does not
+func waitForState(t *testing.T, j *job, state string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		jobLock.Lock()
+		current := j.status.State
+		jobLock.Unlock()
+		if current == state {
+			return
+		}
+	}
+	t.Fatalf("Job %s never became %s", j.status.ID, state)
+}
+
+func TestResubmit(t *testing.T) {
+	g := withTestGenerator(t)
+
+	first, err := submitJob(testArgs("step-worker:0"))
+	if err != nil {
+		t.Fatalf("Failed to submit: %s", err)
+	}
+	waitForState(t, first, ahpproto.JOB_RUNNING)
+
+	// A job that is still running is not started again
+	again, err := submitJob(testArgs("step-worker:0"))
+	if err != nil {
+		t.Fatalf("Failed to submit again: %s", err)
+	}
+	if again != first {
+		t.Errorf("Expected the running job to be returned when submitted again")
+	}
+
+	close(g.release)
+	<-first.done
+	if first.status.State != ahpproto.JOB_DONE {
+		t.Fatalf("Expected the job to be done, it is %s", first.status.State)
+	}
+
+	// A job that has ended is run again, e.g. for -onfail retry
+	rerun, err := submitJob(testArgs("step-worker:0"))
+	if err != nil {
+		t.Fatalf("Failed to submit the ended job again: %s", err)
+	}
+	if rerun == first {
+		t.Fatalf("Expected an ended job to be replaced rather than returned")
+	}
+	<-rerun.done
+	if runs := g.Runs(); runs != 2 {
+		t.Errorf("Expected the generator to run twice, it ran %d times", runs)
+	}
+}
+
+// Submit a job and wait for it to start running
+func startTestJob(t *testing.T, id string) *job {
+	t.Helper()
+	j, err := submitJob(testArgs(id))
+	if err != nil {
+		t.Fatalf("Failed to submit %s: %s", id, err)
+	}
+	waitForState(t, j, ahpproto.JOB_RUNNING)
+	return j
+}
+
+func TestBusy(t *testing.T) {
+	withTestGenerator(t)
+
+	args := testArgs("first")
+	args.Owner = "alice"
+	first, err := submitJob(args)
+	if err != nil {
+		t.Fatalf("Failed to submit: %s", err)
+	}
+	waitForState(t, first, ahpproto.JOB_RUNNING)
+
+	// A job that will not wait is turned away, naming the job in its way
+	_, err = submitJob(testArgs("second"))
+	busy, ok := err.(*ahpproto.BusyError)
+	if !ok {
+		t.Fatalf("Expected a BusyError, got %v", err)
+	}
+	if busy.Job != "first" || busy.Owner != "alice" {
+		t.Errorf("Expected to be busy with first for alice, got %s for %s", busy.Job, busy.Owner)
+	}
+
+	jobLock.Lock()
+	_, kept := jobs["second"]
+	jobLock.Unlock()
+	if kept {
+		t.Errorf("Expected the rejected job not to be kept")
+	}
+}
+
+func TestQueueTimeout(t *testing.T) {
+	g := withTestGenerator(t)
+	first := startTestJob(t, "first")
+
+	args := testArgs("second")
+	args.QueueWait = 1
+	second, err := submitJob(args)
+	if err != nil {
+		t.Fatalf("Failed to queue: %s", err)
+	}
+	jobLock.Lock()
+	state := second.status.State
+	jobLock.Unlock()
+	if state != ahpproto.JOB_QUEUED {
+		t.Fatalf("Expected the job to be queued, it is %s", state)
+	}
+
+	<-second.done
+	if second.status.State != ahpproto.JOB_FAILED {
+		t.Fatalf("Expected the job to fail when its wait ran out, it is %s", second.status.State)
+	}
+	if busy, ok := ahpproto.AsBusy(errors.New(second.status.Error)); !ok || busy.Job != "first" {
+		t.Errorf("Expected the job to fail as busy with first, got %q", second.status.Error)
+	}
+	waitForQueue(t, 0)
+
+	close(g.release)
+	<-first.done
+	if runs := g.Runs(); runs != 1 {
+		t.Errorf("Expected only the first job to run, the generator ran %d times", runs)
+	}
+}
+
+func TestAbortQueued(t *testing.T) {
+	g := withTestGenerator(t)
+	first := startTestJob(t, "first")
+
+	args := testArgs("second")
+	args.QueueWait = 60
+	second, err := submitJob(args)
+	if err != nil {
+		t.Fatalf("Failed to queue: %s", err)
+	}
+
+	jobLock.Lock()
+	second.abort()
+	jobLock.Unlock()
+	<-second.done
+	if second.status.State != ahpproto.JOB_ABORTED {
+		t.Fatalf("Expected the queued job to be aborted, it is %s", second.status.State)
+	}
+
+	// It leaves the queue, so the next job is not held up by it
+	waitForQueue(t, 0)
+	close(g.release)
+	<-first.done
+	if runs := g.Runs(); runs != 1 {
+		t.Errorf("Expected the aborted job never to run, the generator ran %d times", runs)
+	}
+}
+
+func TestAbortRunning(t *testing.T) {
+	g := withTestGenerator(t)
+	first := startTestJob(t, "first")
+
+	jobLock.Lock()
+	first.abort()
+	jobLock.Unlock()
+
+	select {
+	case <-first.done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The aborted job never finished")
+	}
+	if first.status.State != ahpproto.JOB_ABORTED {
+		t.Fatalf("Expected the running job to be aborted, it is %s", first.status.State)
+	}
+	if !strings.Contains(first.status.Error, "first") {
+		t.Errorf("Expected the error to name the job, got %q", first.status.Error)
+	}
+
+	// Its slot is free again
+	second := startTestJob(t, "second")
+	close(g.release)
+	<-second.done
+}
+
+// A job submitted again while its abort is under way is the same job, still
+// holding its slot, rather than a second benchmark next to the first
+func TestResubmitAborting(t *testing.T) {
+	g := withTestGenerator(t)
+	g.exit = make(chan bool)
+	t.Cleanup(func() {
+		select {
+		case <-g.exit:
+		default:
+			close(g.exit)
+		}
+	})
+
+	first := startTestJob(t, "step-worker:0")
+	jobLock.Lock()
+	first.abort()
+	state := first.status.State
+	jobLock.Unlock()
+	if state != ahpproto.JOB_RUNNING {
+		t.Fatalf("Expected the job to run until its benchmark exits, it is %s", state)
+	}
+
+	again, err := submitJob(testArgs("step-worker:0"))
+	if err != nil {
+		t.Fatalf("Failed to submit again: %s", err)
+	}
+	if again != first {
+		t.Errorf("Expected the job being aborted back")
+	}
+	_, err = submitJob(testArgs("other"))
+	if busy, ok := err.(*ahpproto.BusyError); !ok || busy.Job != "step-worker:0" {
+		t.Errorf("Expected to be busy with the job being aborted, got %v", err)
+	}
+
+	close(g.exit)
+	<-first.done
+	if first.status.State != ahpproto.JOB_ABORTED {
+		t.Errorf("Expected the job to be aborted once its benchmark exited, it is %s", first.status.State)
+	}
+	if g.Runs() != 1 {
+		t.Errorf("Expected a single run, got %d", g.Runs())
+	}
+}
+
+// Wait for the queue to hold n jobs, failing the test if it does not
+func waitForQueue(t *testing.T, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		jobLock.Lock()
+		length := len(queue)
+		jobLock.Unlock()
+		if length == n {
+			return
+		}
+	}
+	t.Fatalf("The queue never held %d jobs", n)
+}
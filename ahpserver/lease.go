@@ -0,0 +1,167 @@
+package main
+
+import "errors"
+import "fmt"
+import "log"
+import "sync"
+import "time"
+
+import "github.com/SpeedyCoder/autohttperf/ahpproto"
+
+// A benchmark only keeps running while the coordinator renews its lease, so
+// that load stops soon after the coordinator crashes or the network to it
+// goes down, rather than carrying on against the target unattended. Every
+// benchmark with a job id is registered here, so it can be aborted as well.
+type lease struct {
+	job     string
+	period  time.Duration // 0 when the benchmark has no lease
+	kill    func()
+	done    chan bool
+	mu      sync.Mutex
+	expires time.Time
+	lapsed  bool
+	aborted bool
+}
+
+var leaseLock sync.Mutex
+var leases = make(map[string]*lease)
+
+// Jobs aborted before their benchmark started, stopped as soon as it does
+var pendingAborts = make(map[string]bool)
+
+// Start the lease of a benchmark, calling kill if it is not renewed within
+// args.Lease seconds or it is aborted. Returns nil when the benchmark has no
+// job id, e.g. because the coordinator is too old to send one.
+func startLease(args *ahpproto.Args, kill func()) *lease {
+	if len(args.Job) == 0 {
+		return nil
+	}
+
+	period := time.Duration(args.Lease) * time.Second
+	l := &lease{
+		job:     args.Job,
+		period:  period,
+		kill:    kill,
+		done:    make(chan bool),
+		expires: time.Now().Add(period),
+	}
+
+	// Set before the lease is shared, abortJob only sets it under l.mu
+	leaseLock.Lock()
+	aborted := pendingAborts[l.job]
+	l.aborted = aborted
+	leases[l.job] = l
+	delete(pendingAborts, l.job)
+	leaseLock.Unlock()
+
+	if aborted {
+		log.Printf("!! Job %s was aborted before it started, stopping the benchmark", l.job)
+		kill()
+	} else if period > 0 {
+		go l.watch()
+	}
+	return l
+}
+
+// Check the lease every second until it lapses or the benchmark finishes
+func (l *lease) watch() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.done:
+			return
+		case now := <-ticker.C:
+			l.mu.Lock()
+			lapsed := now.After(l.expires)
+			l.lapsed = lapsed
+			l.mu.Unlock()
+
+			if lapsed {
+				log.Printf("!! Lease of job %s lapsed, stopping the benchmark", l.job)
+				l.kill()
+				return
+			}
+		}
+	}
+}
+
+// End the lease once the benchmark has finished
+func (l *lease) stop() {
+	if l == nil {
+		return
+	}
+
+	leaseLock.Lock()
+	delete(leases, l.job)
+	leaseLock.Unlock()
+	close(l.done)
+}
+
+// Why the benchmark was stopped before it finished, or nil if it was not
+func (l *lease) stopped() error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.lapsed {
+		return errors.New(fmt.Sprintf(ERR_LEASE, l.job))
+	}
+	if l.aborted {
+		return errors.New(fmt.Sprintf(ERR_ABORTED, l.job))
+	}
+	return nil
+}
+
+// Stop a running benchmark. A benchmark that has not started its generator
+// yet is stopped as soon as it does, see forgetAbort.
+func abortJob(job string) {
+	leaseLock.Lock()
+	l, ok := leases[job]
+	if !ok {
+		pendingAborts[job] = true
+	}
+	leaseLock.Unlock()
+
+	if !ok {
+		return
+	}
+
+	l.mu.Lock()
+	l.aborted = true
+	l.mu.Unlock()
+
+	log.Printf("!! Job %s aborted, stopping the benchmark", job)
+	l.kill()
+}
+
+// Drop the abort of a job that finished without ever starting its generator
+func forgetAbort(job string) {
+	leaseLock.Lock()
+	delete(pendingAborts, job)
+	leaseLock.Unlock()
+}
+
+// Extend the lease of a running benchmark by another lease period. Reports
+// false when there is no such benchmark, because it has finished or its
+// lease already lapsed.
+func (h *HTTPerf) Renew(job string, renewed *bool) error {
+	leaseLock.Lock()
+	l, ok := leases[job]
+	leaseLock.Unlock()
+
+	*renewed = false
+	if ok {
+		l.mu.Lock()
+		if !l.lapsed && !l.aborted {
+			l.expires = time.Now().Add(l.period)
+			*renewed = true
+		}
+		l.mu.Unlock()
+	}
+
+	return nil
+}
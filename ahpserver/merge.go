@@ -0,0 +1,344 @@
+package main
+
+import "bufio"
+import "bytes"
+import "errors"
+import "fmt"
+import "math"
+import "sort"
+import "strings"
+
+// The summary httperf prints when it finishes, as far as the coordinator
+// reads it, along with the reply rate samples and lifetime histogram of
+// --verbose
+type httperfSummary struct {
+	burst                                       int
+	connections, requests, replies, duration    float64
+	connRate, concurrent                        float64
+	connMin, connAvg, connMax, connMedian       float64
+	connStddev, connect                         float64
+	reqRate, reqSize                            float64
+	rateMin, rateAvg, rateMax, rateStddev       float64
+	rateSamples                                 int
+	response, transfer                          float64
+	header, content, footer, size               float64
+	status                                      [6]float64
+	user, system, userPerc, systemPerc, cpuPerc float64
+	netKB, netMbps                              float64
+	errTotal, clientTimo, socketTimo            float64
+	connRefused, connReset, fdUnavail           float64
+	addrUnavail, ftabFull, other                float64
+	samples                                     []float64
+	histogram                                   map[float64]float64 // Connections by the middle of their 1ms bucket
+}
+
+// Read the summary out of the output of httperf, line by line as the
+// coordinator does. Lines that are not part of it are ignored.
+func parseHTTPerfSummary(output string) (*httperfSummary, error) {
+	s := &httperfSummary{histogram: make(map[float64]float64)}
+	found := false
+	inHistogram := false
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if inHistogram {
+			var ms, count float64
+			if _, err := fmt.Sscanf(line, "%f %f", &ms, &count); err == nil {
+				s.histogram[ms] += count
+				continue
+			}
+			inHistogram = line == ":"
+			if inHistogram || len(line) == 0 {
+				continue
+			}
+		}
+
+		var err error
+		switch {
+		case strings.HasPrefix(line, "Connection lifetime histogram"):
+			inHistogram = true
+		case strings.HasPrefix(line, "reply-rate ="):
+			rate, ok := replyRateSample(line)
+			if !ok {
+				err = errors.New("invalid reply rate sample")
+			}
+			s.samples = append(s.samples, rate)
+		case strings.HasPrefix(line, "Maximum connect burst length:"):
+			_, err = fmt.Sscanf(line, "Maximum connect burst length: %d", &s.burst)
+		case strings.HasPrefix(line, "Total:"):
+			_, err = fmt.Sscanf(line, "Total: connections %f requests %f replies %f test-duration %f s",
+				&s.connections, &s.requests, &s.replies, &s.duration)
+			found = err == nil
+		case strings.HasPrefix(line, "Connection rate:"):
+			_, err = fmt.Sscanf(line, "Connection rate: %f conn/s (%f ms/conn, <=%f concurrent connections)",
+				&s.connRate, new(float64), &s.concurrent)
+		case strings.HasPrefix(line, "Connection time [ms]: min"):
+			_, err = fmt.Sscanf(line, "Connection time [ms]: min %f avg %f max %f median %f stddev %f",
+				&s.connMin, &s.connAvg, &s.connMax, &s.connMedian, &s.connStddev)
+		case strings.HasPrefix(line, "Connection time [ms]: connect"):
+			_, err = fmt.Sscanf(line, "Connection time [ms]: connect %f", &s.connect)
+		case strings.HasPrefix(line, "Request rate:"):
+			_, err = fmt.Sscanf(line, "Request rate: %f req/s", &s.reqRate)
+		case strings.HasPrefix(line, "Request size [B]:"):
+			_, err = fmt.Sscanf(line, "Request size [B]: %f", &s.reqSize)
+		case strings.HasPrefix(line, "Reply rate [replies/s]:"):
+			_, err = fmt.Sscanf(line, "Reply rate [replies/s]: min %f avg %f max %f stddev %f (%d samples)",
+				&s.rateMin, &s.rateAvg, &s.rateMax, &s.rateStddev, &s.rateSamples)
+		case strings.HasPrefix(line, "Reply time [ms]:"):
+			_, err = fmt.Sscanf(line, "Reply time [ms]: response %f transfer %f", &s.response, &s.transfer)
+		case strings.HasPrefix(line, "Reply size [B]:"):
+			_, err = fmt.Sscanf(line, "Reply size [B]: header %f content %f footer %f (total %f)",
+				&s.header, &s.content, &s.footer, &s.size)
+		case strings.HasPrefix(line, "Reply status:"):
+			_, err = fmt.Sscanf(line, "Reply status: 1xx=%f 2xx=%f 3xx=%f 4xx=%f 5xx=%f",
+				&s.status[1], &s.status[2], &s.status[3], &s.status[4], &s.status[5])
+		case strings.HasPrefix(line, "CPU time [s]:"):
+			_, err = fmt.Sscanf(line, "CPU time [s]: user %f system %f (user %f%% system %f%% total %f%%)",
+				&s.user, &s.system, &s.userPerc, &s.systemPerc, &s.cpuPerc)
+		case strings.HasPrefix(line, "Net I/O:"):
+			_, err = fmt.Sscanf(line, "Net I/O: %f KB/s (%f*10^6 bps)", &s.netKB, &s.netMbps)
+		case strings.HasPrefix(line, "Errors: total"):
+			_, err = fmt.Sscanf(line, "Errors: total %f client-timo %f socket-timo %f connrefused %f connreset %f",
+				&s.errTotal, &s.clientTimo, &s.socketTimo, &s.connRefused, &s.connReset)
+		case strings.HasPrefix(line, "Errors: fd-unavail"):
+			_, err = fmt.Sscanf(line, "Errors: fd-unavail %f addrunavail %f ftab-full %f other %f",
+				&s.fdUnavail, &s.addrUnavail, &s.ftabFull, &s.other)
+		}
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%s (%q)", err, line))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if !found {
+		return nil, errors.New("no httperf summary in the output")
+	}
+	return s, nil
+}
+
+// The mean of values, each counting weights times
+func weightedMean(values, weights []float64) float64 {
+	var sum, total float64
+	for i := range values {
+		sum += values[i] * weights[i]
+		total += weights[i]
+	}
+	return ratio(sum, total)
+}
+
+// Merge the outputs of httperf processes that ran side by side into the
+// output of a single httperf that did all of their work. Counts and rates
+// add up, times and sizes are averaged over what they were measured on and
+// the connection time stddev is pooled. The median is only approximated by
+// the mean of the medians. CPU times add up, but the percentages are those
+// of the busiest process, since httperf is saturated once any one process
+// runs out of its core. An output that cannot be read is left out and the
+// reason returned with the merged output, so that one broken process costs
+// its share of the load, which the coordinator flags as a shortfall, rather
+// than the whole benchmark. Fails only when none of the outputs can be read.
+func mergeHTTPerf(outputs []string, verbose bool) (string, []string, error) {
+	parts := make([]*httperfSummary, 0, len(outputs))
+	left := make([]string, 0)
+	for i, output := range outputs {
+		s, err := parseHTTPerfSummary(output)
+		if err != nil {
+			left = append(left, fmt.Sprintf(ERR_MERGE, i, err))
+			continue
+		}
+		parts = append(parts, s)
+	}
+	if len(parts) == 0 {
+		return "", left, errors.New(left[0])
+	}
+
+	m := &httperfSummary{histogram: make(map[float64]float64)}
+	n := len(parts)
+	connections := make([]float64, n)
+	requests := make([]float64, n)
+	replies := make([]float64, n)
+	field := func(get func(s *httperfSummary) float64) []float64 {
+		values := make([]float64, n)
+		for i, s := range parts {
+			values[i] = get(s)
+		}
+		return values
+	}
+
+	m.connMin = math.Inf(1)
+	samples := -1
+	busiest := parts[0]
+	for i, s := range parts {
+		connections[i], requests[i], replies[i] = s.connections, s.requests, s.replies
+
+		if s.burst > m.burst {
+			m.burst = s.burst
+		}
+		m.connections += s.connections
+		m.requests += s.requests
+		m.replies += s.replies
+		m.duration = math.Max(m.duration, s.duration)
+		m.connRate += s.connRate
+		m.concurrent += s.concurrent
+		m.connMax = math.Max(m.connMax, s.connMax)
+		if s.connections > 0 {
+			m.connMin = math.Min(m.connMin, s.connMin)
+		}
+		m.reqRate += s.reqRate
+		m.rateMin += s.rateMin
+		m.rateAvg += s.rateAvg
+		m.rateMax += s.rateMax
+		for class := range s.status {
+			m.status[class] += s.status[class]
+		}
+		m.user += s.user
+		m.system += s.system
+		if s.cpuPerc > busiest.cpuPerc {
+			busiest = s
+		}
+		m.netKB += s.netKB
+		m.netMbps += s.netMbps
+		m.errTotal += s.errTotal
+		m.clientTimo += s.clientTimo
+		m.socketTimo += s.socketTimo
+		m.connRefused += s.connRefused
+		m.connReset += s.connReset
+		m.fdUnavail += s.fdUnavail
+		m.addrUnavail += s.addrUnavail
+		m.ftabFull += s.ftabFull
+		m.other += s.other
+
+		for ms, count := range s.histogram {
+			m.histogram[ms] += count
+		}
+		if samples < 0 || len(s.samples) < samples {
+			samples = len(s.samples)
+		}
+	}
+	if math.IsInf(m.connMin, 1) {
+		m.connMin = 0
+	}
+
+	m.connAvg = weightedMean(field(func(s *httperfSummary) float64 { return s.connAvg }), connections)
+	m.connMedian = weightedMean(field(func(s *httperfSummary) float64 { return s.connMedian }), connections)
+	m.connect = weightedMean(field(func(s *httperfSummary) float64 { return s.connect }), connections)
+	m.reqSize = weightedMean(field(func(s *httperfSummary) float64 { return s.reqSize }), requests)
+	m.response = weightedMean(field(func(s *httperfSummary) float64 { return s.response }), replies)
+	m.transfer = weightedMean(field(func(s *httperfSummary) float64 { return s.transfer }), replies)
+	m.header = weightedMean(field(func(s *httperfSummary) float64 { return s.header }), replies)
+	m.content = weightedMean(field(func(s *httperfSummary) float64 { return s.content }), replies)
+	m.footer = weightedMean(field(func(s *httperfSummary) float64 { return s.footer }), replies)
+	m.size = m.header + m.content + m.footer
+	m.userPerc, m.systemPerc, m.cpuPerc = busiest.userPerc, busiest.systemPerc, busiest.cpuPerc
+
+	// The pooled stddev of the connection times of every process together
+	var squares float64
+	for _, s := range parts {
+		if s.connections > 1 {
+			squares += (s.connections - 1) * s.connStddev * s.connStddev
+		}
+		squares += s.connections * (s.connAvg - m.connAvg) * (s.connAvg - m.connAvg)
+	}
+	if m.connections > 1 {
+		m.connStddev = math.Sqrt(squares / (m.connections - 1))
+	}
+
+	// The processes sample their reply rates at the same intervals, so the
+	// worker's samples are the sums of theirs. Without the samples, the sums
+	// of the minimums and maximums are the best there is.
+	for i := 0; i < samples; i++ {
+		var sum float64
+		for _, s := range parts {
+			sum += s.samples[i]
+		}
+		m.samples = append(m.samples, sum)
+	}
+	if len(m.samples) > 0 {
+		m.rateSamples = len(m.samples)
+		m.rateMin, m.rateMax, m.rateAvg = m.samples[0], m.samples[0], 0
+		for _, sample := range m.samples {
+			m.rateMin = math.Min(m.rateMin, sample)
+			m.rateMax = math.Max(m.rateMax, sample)
+			m.rateAvg += sample
+		}
+		m.rateAvg /= float64(len(m.samples))
+		for _, sample := range m.samples {
+			m.rateStddev += (sample - m.rateAvg) * (sample - m.rateAvg)
+		}
+		if len(m.samples) > 1 {
+			m.rateStddev = math.Sqrt(m.rateStddev / float64(len(m.samples)-1))
+		}
+	} else {
+		m.rateSamples = parts[0].rateSamples
+		for _, s := range parts {
+			if s.rateSamples < m.rateSamples {
+				m.rateSamples = s.rateSamples
+			}
+			m.rateStddev += s.rateStddev * s.rateStddev
+		}
+		m.rateStddev = math.Sqrt(m.rateStddev)
+	}
+
+	return m.String(verbose), left, nil
+}
+
+// The summary in the format httperf prints it in
+func (s *httperfSummary) String(verbose bool) string {
+	var out bytes.Buffer
+	if verbose {
+		for _, sample := range s.samples {
+			fmt.Fprintf(&out, "reply-rate = %-8.1f\n", sample)
+		}
+	}
+	fmt.Fprintf(&out, "Maximum connect burst length: %d\n\n", s.burst)
+	fmt.Fprintf(&out, "Total: connections %.0f requests %.0f replies %.0f test-duration %.3f s\n\n",
+		s.connections, s.requests, s.replies, s.duration)
+	fmt.Fprintf(&out, "Connection rate: %.1f conn/s (%.1f ms/conn, <=%.0f concurrent connections)\n",
+		s.connRate, ratio(1000, s.connRate), s.concurrent)
+	fmt.Fprintf(&out, "Connection time [ms]: min %.1f avg %.1f max %.1f median %.1f stddev %.1f\n",
+		s.connMin, s.connAvg, s.connMax, s.connMedian, s.connStddev)
+	fmt.Fprintf(&out, "Connection time [ms]: connect %.1f\n", s.connect)
+	fmt.Fprintf(&out, "Connection length [replies/conn]: %.3f\n\n", ratio(s.replies, s.connections))
+	fmt.Fprintf(&out, "Request rate: %.1f req/s (%.1f ms/req)\n", s.reqRate, ratio(1000, s.reqRate))
+	fmt.Fprintf(&out, "Request size [B]: %.1f\n\n", s.reqSize)
+	fmt.Fprintf(&out, "Reply rate [replies/s]: min %.1f avg %.1f max %.1f stddev %.1f (%d samples)\n",
+		s.rateMin, s.rateAvg, s.rateMax, s.rateStddev, s.rateSamples)
+	fmt.Fprintf(&out, "Reply time [ms]: response %.1f transfer %.1f\n", s.response, s.transfer)
+	fmt.Fprintf(&out, "Reply size [B]: header %.1f content %.1f footer %.1f (total %.1f)\n",
+		s.header, s.content, s.footer, s.size)
+	fmt.Fprintf(&out, "Reply status: 1xx=%.0f 2xx=%.0f 3xx=%.0f 4xx=%.0f 5xx=%.0f\n\n",
+		s.status[1], s.status[2], s.status[3], s.status[4], s.status[5])
+	fmt.Fprintf(&out, "CPU time [s]: user %.2f system %.2f (user %.1f%% system %.1f%% total %.1f%%)\n",
+		s.user, s.system, s.userPerc, s.systemPerc, s.cpuPerc)
+	fmt.Fprintf(&out, "Net I/O: %.1f KB/s (%.1f*10^6 bps)\n\n", s.netKB, s.netMbps)
+	fmt.Fprintf(&out, "Errors: total %.0f client-timo %.0f socket-timo %.0f connrefused %.0f connreset %.0f\n",
+		s.errTotal, s.clientTimo, s.socketTimo, s.connRefused, s.connReset)
+	fmt.Fprintf(&out, "Errors: fd-unavail %.0f addrunavail %.0f ftab-full %.0f other %.0f\n",
+		s.fdUnavail, s.addrUnavail, s.ftabFull, s.other)
+
+	if verbose && len(s.histogram) > 0 {
+		writeMergedHistogram(&out, s.histogram)
+	}
+	return out.String()
+}
+
+// Write a histogram of 1ms buckets in the format of httperf --verbose
+// --verbose, marking each run of empty buckets with ":"
+func writeMergedHistogram(out *bytes.Buffer, histogram map[float64]float64) {
+	buckets := make([]float64, 0, len(histogram))
+	for ms := range histogram {
+		buckets = append(buckets, ms)
+	}
+	sort.Float64s(buckets)
+
+	fmt.Fprintf(out, "\nConnection lifetime histogram (time in ms):\n")
+	for i, ms := range buckets {
+		if i > 0 && ms > buckets[i-1]+1 {
+			fmt.Fprintf(out, "%14c\n", ':')
+		}
+		fmt.Fprintf(out, "%16.1f %.0f\n", ms, histogram[ms])
+	}
+}
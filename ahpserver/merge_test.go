@@ -0,0 +1,186 @@
+package main
+
+import "io/ioutil"
+import "math"
+import "reflect"
+import "strings"
+import "testing"
+
+var processA = `reply-rate = 55.0
+reply-rate = 65.0
+Maximum connect burst length: 1
+
+Total: connections 600 requests 600 replies 600 test-duration 10.000 s
+
+Connection rate: 60.0 conn/s (16.7 ms/conn, <=2 concurrent connections)
+Connection time [ms]: min 1.0 avg 2.0 max 10.0 median 1.5 stddev 1.0
+Connection time [ms]: connect 0.5
+Connection length [replies/conn]: 1.000
+
+Request rate: 60.0 req/s (16.7 ms/req)
+Request size [B]: 72.0
+
+Reply rate [replies/s]: min 55.0 avg 60.0 max 65.0 stddev 7.1 (2 samples)
+Reply time [ms]: response 1.5 transfer 0.1
+Reply size [B]: header 170.0 content 4109.0 footer 2.0 (total 4281.0)
+Reply status: 1xx=0 2xx=600 3xx=0 4xx=0 5xx=0
+
+CPU time [s]: user 1.00 system 2.00 (user 10.0% system 20.0% total 30.0%)
+Net I/O: 250.0 KB/s (2.0*10^6 bps)
+
+Errors: total 2 client-timo 1 socket-timo 0 connrefused 1 connreset 0
+Errors: fd-unavail 0 addrunavail 0 ftab-full 0 other 0
+
+Connection lifetime histogram (time in ms):
+             1.5 400
+             2.5 200
+`
+
+var processB = `reply-rate = 35.0
+reply-rate = 45.0
+Maximum connect burst length: 2
+
+Total: connections 400 requests 400 replies 400 test-duration 10.500 s
+
+Connection rate: 40.0 conn/s (25.0 ms/conn, <=3 concurrent connections)
+Connection time [ms]: min 0.5 avg 4.5 max 20.0 median 3.0 stddev 2.0
+Connection time [ms]: connect 1.0
+Connection length [replies/conn]: 1.000
+
+Request rate: 40.0 req/s (25.0 ms/req)
+Request size [B]: 72.0
+
+Reply rate [replies/s]: min 35.0 avg 40.0 max 45.0 stddev 7.1 (2 samples)
+Reply time [ms]: response 4.0 transfer 0.2
+Reply size [B]: header 170.0 content 4109.0 footer 2.0 (total 4281.0)
+Reply status: 1xx=0 2xx=390 3xx=0 4xx=0 5xx=10
+
+CPU time [s]: user 2.00 system 3.00 (user 20.0% system 30.0% total 50.0%)
+Net I/O: 150.0 KB/s (1.2*10^6 bps)
+
+Errors: total 10 client-timo 10 socket-timo 0 connrefused 0 connreset 0
+Errors: fd-unavail 0 addrunavail 0 ftab-full 0 other 0
+
+Connection lifetime histogram (time in ms):
+             2.5 100
+             :
+             5.5 300
+`
+
+func TestMergeHTTPerf(t *testing.T) {
+	merged, left, err := mergeHTTPerf([]string{processA, processB}, true)
+	if err != nil || len(left) > 0 {
+		t.Fatalf("Failed to merge: %v %q", err, left)
+	}
+	m, err := parseHTTPerfSummary(merged)
+	if err != nil {
+		t.Fatalf("Failed to parse the merged output: %s\n%s", err, merged)
+	}
+
+	for _, test := range []struct {
+		name     string
+		got      float64
+		expected float64
+	}{
+		// Counts and rates add up
+		{"connections", m.connections, 1000},
+		{"requests", m.requests, 1000},
+		{"replies", m.replies, 1000},
+		{"connection rate", m.connRate, 100},
+		{"request rate", m.reqRate, 100},
+		{"concurrent connections", m.concurrent, 5},
+		{"2xx", m.status[2], 990},
+		{"5xx", m.status[5], 10},
+		{"errors", m.errTotal, 12},
+		{"client timeouts", m.clientTimo, 11},
+		{"refused connections", m.connRefused, 1},
+		{"net I/O", m.netKB, 400},
+		{"CPU user time", m.user, 3},
+		{"CPU system time", m.system, 5},
+
+		// The longest process, the extremes and the busiest process
+		{"burst", float64(m.burst), 2},
+		{"duration", m.duration, 10.5},
+		{"connection time min", m.connMin, 0.5},
+		{"connection time max", m.connMax, 20},
+		{"CPU total", m.cpuPerc, 50},
+		{"CPU user", m.userPerc, 20},
+
+		// Averaged over the connections or replies they were measured on
+		{"connection time avg", m.connAvg, 3},
+		{"connection time median", m.connMedian, 2.1},
+		{"connect time", m.connect, 0.7},
+		{"response time", m.response, 2.5},
+		{"reply size", m.size, 4281},
+
+		// Pooled: sqrt((599*1 + 600*1^2 + 399*4 + 400*1.5^2) / 999)
+		{"connection time stddev", m.connStddev, 1.9},
+
+		// Taken from the summed samples, 90 and 110
+		{"reply rate samples", float64(m.rateSamples), 2},
+		{"reply rate min", m.rateMin, 90},
+		{"reply rate avg", m.rateAvg, 100},
+		{"reply rate max", m.rateMax, 110},
+		{"reply rate stddev", m.rateStddev, 14.1},
+	} {
+		if math.Abs(test.got-test.expected) > 1e-9 {
+			t.Errorf("Expected %g for the merged %s, got %g", test.expected, test.name, test.got)
+		}
+	}
+
+	if !reflect.DeepEqual(m.samples, []float64{90, 110}) {
+		t.Errorf("Expected the summed samples [90 110], got %v", m.samples)
+	}
+	expected := map[float64]float64{1.5: 400, 2.5: 300, 5.5: 300}
+	if !reflect.DeepEqual(m.histogram, expected) {
+		t.Errorf("Expected the histogram %v, got %v", expected, m.histogram)
+	}
+	if !strings.Contains(merged, "2.5 300\n             :\n") {
+		t.Errorf("Expected the empty buckets after 2.5ms to be marked:\n%s", merged)
+	}
+
+	// The coordinator parses testdata/merged.txt in its own tests, so it has
+	// to be exactly what the worker sends
+	golden, err := ioutil.ReadFile("testdata/merged.txt")
+	if err != nil {
+		t.Fatalf("Failed to read the merged output: %s", err)
+	}
+	if merged != string(golden) {
+		t.Errorf("Expected the merged output in testdata/merged.txt, got:\n%s", merged)
+	}
+}
+
+func TestMergeHTTPerfQuiet(t *testing.T) {
+	merged, _, err := mergeHTTPerf([]string{processA, processB}, false)
+	if err != nil {
+		t.Fatalf("Failed to merge: %s", err)
+	}
+	if strings.Contains(merged, "reply-rate") || strings.Contains(merged, "histogram") {
+		t.Errorf("Expected no samples or histogram without -verbose:\n%s", merged)
+	}
+}
+
+// A process whose output cannot be read is left out rather than failing the
+// benchmark, unless there is nothing left to merge
+func TestMergeHTTPerfInvalid(t *testing.T) {
+	for _, broken := range []string{
+		"httperf: command not found",
+		strings.Replace(processB, "requests 400", "requests many", 1),
+	} {
+		merged, left, err := mergeHTTPerf([]string{processA, broken}, false)
+		if err != nil {
+			t.Errorf("Failed to merge around %q: %s", broken, err)
+			continue
+		}
+		if !strings.Contains(merged, "Total: connections 600 requests 600 replies 600 ") {
+			t.Errorf("Expected the output of the first process alone:\n%s", merged)
+		}
+		if len(left) != 1 || !strings.Contains(left[0], "process 1") {
+			t.Errorf("Expected the second process to be reported as left out, got %q", left)
+		}
+	}
+
+	if _, _, err := mergeHTTPerf([]string{"", "httperf: command not found"}, false); err == nil {
+		t.Errorf("Expected an error with no output to merge")
+	}
+}
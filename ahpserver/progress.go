@@ -0,0 +1,183 @@
+package main
+
+import "encoding/json"
+import "net/http"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+import "github.com/SpeedyCoder/autohttperf/ahpproto"
+
+// The longest a Progress call may wait for news
+const MAX_PROGRESS_WAIT = 30 * time.Second
+
+// What a job has reported while running, which the load generators add to
+// as they go. The changed channel is closed and replaced on every change, so
+// that callers can wait for news.
+type progress struct {
+	mu      sync.Mutex
+	lines   []string
+	samples []float64
+	errors  int
+	changed chan bool
+}
+
+func newProgress() *progress {
+	return &progress{errors: -1, changed: make(chan bool)}
+}
+
+// Must be called with the lock held
+func (p *progress) notify() {
+	close(p.changed)
+	p.changed = make(chan bool)
+}
+
+// Add a line of output, e.g. from stderr
+func (p *progress) line(line string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lines = append(p.lines, line)
+	p.notify()
+}
+
+// Add a reply rate sample, along with the errors so far or -1 if unknown
+func (p *progress) sample(rate float64, errors int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.samples = append(p.samples, rate)
+	p.errors = errors
+	p.notify()
+}
+
+// A line of httperf --verbose output that is a reply rate sample
+func replyRateSample(line string) (float64, bool) {
+	const prefix = "reply-rate ="
+	if !strings.HasPrefix(line, prefix) {
+		return 0, false
+	}
+	rate, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimPrefix(line, prefix)), 64)
+	return rate, err == nil
+}
+
+// The progress of the job a benchmark runs as, for the load generator to
+// report to. Nil, which ignores reports, when there is no such job.
+func jobProgress(args *ahpproto.Args) *progress {
+	jobLock.Lock()
+	defer jobLock.Unlock()
+
+	if j, ok := jobs[args.Job]; ok {
+		return j.progress
+	}
+	return nil
+}
+
+// Wait until the job has lines beyond since, a new sample or has finished,
+// or until wait has passed, and describe its progress
+func waitForProgress(id string, since int, wait time.Duration) (*ahpproto.Progress, error) {
+	if wait > MAX_PROGRESS_WAIT {
+		wait = MAX_PROGRESS_WAIT
+	}
+	timeout := time.After(wait)
+
+	jobLock.Lock()
+	j, err := findJob(id)
+	jobLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	p := j.progress
+
+	p.mu.Lock()
+	samples := len(p.samples)
+wait:
+	for len(p.lines) <= since && len(p.samples) == samples {
+		changed := p.changed
+		p.mu.Unlock()
+
+		select {
+		case <-changed:
+			p.mu.Lock()
+		case <-j.done:
+			p.mu.Lock()
+			break wait
+		case <-timeout:
+			p.mu.Lock()
+			break wait
+		}
+	}
+
+	report := &ahpproto.Progress{
+		Job:     id,
+		Samples: append([]float64(nil), p.samples...),
+		Errors:  p.errors,
+		Next:    len(p.lines),
+	}
+	if since < len(p.lines) {
+		report.Lines = append([]string(nil), p.lines[since:]...)
+	}
+	p.mu.Unlock()
+
+	jobLock.Lock()
+	defer jobLock.Unlock()
+
+	report.State = j.status.State
+	if j.status.Started != nil {
+		end := time.Now()
+		if j.status.Finished != nil {
+			end = *j.status.Finished
+		}
+		report.Elapsed = end.Sub(*j.status.Started).Seconds()
+	}
+	return report, nil
+}
+
+func (h *HTTPerf) Progress(req *ahpproto.ProgressRequest, report *ahpproto.Progress) error {
+	p, err := waitForProgress(req.Job, req.Since, time.Duration(req.Wait)*time.Millisecond)
+	if err != nil {
+		return err
+	}
+	*report = *p
+	return nil
+}
+
+// Stream the progress of a job as one JSON object per line, at least every
+// ?interval= seconds (1 by default), until it finishes
+func (h *apiHandler) progress(w http.ResponseWriter, req *http.Request, id string) {
+	interval := time.Second
+	if secs, err := strconv.ParseFloat(req.URL.Query().Get("interval"), 64); err == nil && secs > 0 {
+		interval = time.Duration(secs * float64(time.Second))
+	}
+
+	since := 0
+	for streaming := false; ; streaming = true {
+		report, err := waitForProgress(id, since, interval)
+		if err != nil {
+			if !streaming {
+				writeError(w, http.StatusNotFound, "%s", err)
+			}
+			return
+		}
+		if !streaming {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+		}
+		since = report.Next
+
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			return
+		}
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+
+		if report.State != ahpproto.JOB_QUEUED && report.State != ahpproto.JOB_RUNNING {
+			return
+		}
+	}
+}
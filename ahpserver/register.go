@@ -0,0 +1,133 @@
+package main
+
+import "bufio"
+import "crypto/tls"
+import "crypto/x509"
+import "errors"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "log"
+import "net"
+import "net/http"
+import "net/rpc"
+import "os"
+import "time"
+
+// The longest wait between attempts to register with the coordinator
+const MAX_REGISTER_BACKOFF = 30 * time.Second
+
+// A connection whose reads go through a buffered reader, so nothing that was
+// read ahead while reading the coordinator's response is lost
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// The name this worker registers with, which the coordinator uses as its
+// address in the config
+func workerName() string {
+	if len(*name) > 0 {
+		return *name
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	return fmt.Sprintf("%s:%d", hostname, *port)
+}
+
+// Dial the coordinator, over TLS when -tlscert is given, presenting the
+// certificate and checking the coordinator's against -tlsca
+func dialCoordinator() (net.Conn, error) {
+	if len(*tlsCert) == 0 {
+		return net.Dial("tcp", *coordinator)
+	}
+
+	cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if len(*tlsCA) > 0 {
+		pem, err := ioutil.ReadFile(*tlsCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New(fmt.Sprintf("No certificates found in %s", *tlsCA))
+		}
+		config.RootCAs = pool
+	}
+
+	return tls.Dial("tcp", *coordinator, config)
+}
+
+// Register with the coordinator and serve its RPC calls over the same
+// connection until it is closed. With a -token the coordinator must answer
+// with it, as it would present it on a CONNECT. The registration is an HTTP style request,
+// the reverse of the CONNECT a coordinator sends to a listening daemon.
+func register() error {
+	conn, err := dialCoordinator()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	request := fmt.Sprintf("REGISTER /_ahpRegister HTTP/1.0\r\nX-Worker-Name: %s\r\n", workerName())
+	if len(*labels) > 0 {
+		request += fmt.Sprintf("X-Worker-Labels: %s\r\n", *labels)
+	}
+	if len(*token) > 0 {
+		request += fmt.Sprintf("Authorization: Bearer %s\r\n", *token)
+	}
+	io.WriteString(conn, request+"\r\n")
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: "REGISTER"})
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("coordinator refused the registration: %s", resp.Status))
+	}
+
+	// The calls come in over this connection rather than through the
+	// authHandler, so the coordinator has to present the token in its answer
+	if len(*token) > 0 && !validToken(resp.Header.Get("Authorization")) {
+		return errors.New("coordinator did not present the token")
+	}
+
+	log.Printf("Registered with the coordinator at %s as %s", *coordinator, workerName())
+	rpc.ServeConn(&bufferedConn{conn, reader})
+	return errors.New("connection closed")
+}
+
+// Keep registering with the coordinator, backing off while it cannot be
+// reached, so that a worker can be started before its coordinator.
+func registerLoop() {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := register()
+		log.Printf("Not registered with the coordinator at %s: %s", *coordinator, err)
+
+		// A registration that lasted a while was a success, start over
+		if time.Since(start) > MAX_REGISTER_BACKOFF {
+			backoff = time.Second
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > MAX_REGISTER_BACKOFF {
+			backoff = MAX_REGISTER_BACKOFF
+		}
+	}
+}
+
+// The labels of this worker, from -labels
+var workerLabels map[string]string
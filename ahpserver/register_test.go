@@ -0,0 +1,62 @@
+package main
+
+import "bufio"
+import "io"
+import "net"
+import "net/http"
+import "testing"
+import "time"
+
+// A coordinator that does not answer the registration with the token is not
+// served, since its calls never pass the authHandler
+func TestRegisterToken(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	savedCoordinator, savedToken := *coordinator, *token
+	*coordinator, *token = l.Addr().String(), "secret"
+	t.Cleanup(func() {
+		*coordinator, *token = savedCoordinator, savedToken
+	})
+
+	tests := []struct {
+		answer   string
+		expected string
+	}{
+		{"HTTP/1.0 200 Registered\r\n\r\n", "coordinator did not present the token"},
+		{"HTTP/1.0 200 Registered\r\nAuthorization: Bearer wrong\r\n\r\n", "coordinator did not present the token"},
+		{"HTTP/1.0 200 Registered\r\nAuthorization: Bearer secret\r\n\r\n", "connection closed"},
+	}
+	for _, test := range tests {
+		errs := make(chan error, 1)
+		go func() {
+			errs <- register()
+		}()
+
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			t.Fatalf("Failed to read the registration: %s", err)
+		}
+		if auth := req.Header.Get("Authorization"); auth != "Bearer secret" {
+			t.Errorf("Expected the worker to present its token, got %q", auth)
+		}
+		io.WriteString(conn, test.answer)
+		conn.Close()
+
+		select {
+		case err := <-errs:
+			if err == nil || err.Error() != test.expected {
+				t.Errorf("%q: expected %q, got %v", test.answer, test.expected, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q: the registration never ended", test.answer)
+		}
+	}
+}
@@ -2,123 +2,113 @@ package main
 
 import "flag"
 import "fmt"
-import "os/exec"
 import "net/http"
-import "io/ioutil"
 import "log"
-import "net"
 import "net/rpc"
-import "errors"
-
-type Args struct {
-	Host                  string
-	Port                  int
-	URL                   string
-	NumConnections        int
-	ConnectionRate        int
-	RequestsPerConnection int
-	Duration              int
-	Timeout				  int
-}
+import "runtime"
 
-type Result struct {
-	Stdout     string
-	Stderr     string
-	ExitStatus int
-}
+import "github.com/SpeedyCoder/autohttperf/ahpproto"
 
 type HTTPerf int
 
 const (
-	ERR_EXECNOTFOUND = "Could not find the 'httperf' executable: %s"
+	ERR_EXECNOTFOUND = "Could not find the '%s' executable: %s"
 	ERR_RUNFAILED    = "Failed to run command: %s"
 	ERR_WAIT         = "Failed when waiting on pid %d"
 	ERR_NOTEXITED    = "Command did not properly exit: %s"
 	ERR_READOUT      = "Could not read stdout: %s"
 	ERR_READERR      = "Could not read stderr: %s"
+	ERR_CLOSEDLIMIT  = "A closed-loop benchmark needs either a duration or a number of connections"
+	ERR_BACKEND      = "Unknown load generator %q"
+	ERR_LEASE        = "The lease of job %s lapsed and the benchmark was stopped"
+	ERR_ABORTED      = "Job %s was aborted"
+	ERR_NOJOB        = "No job %s, it may have finished more than -retain seconds ago"
+	ERR_NOTFINISHED  = "Job %s has not finished, it is %s"
+	ERR_NOTALLOWED   = "Target %s is not on the daemon's allowlist: %s"
+	ERR_MERGE        = "Could not merge the output of httperf process %d: %s"
+	ERR_NOCPUS       = "No core to pin httperf to, running jobs are pinned to all %d allowed"
 )
 
-func (h *HTTPerf) Benchmark(args *Args, result *Result) error {
-	// Try to find the 'httpperf' command, which must exist in the PATH
-	// of the current user/environment.
-
-	perfexec, err := exec.LookPath("httperf")
-	if err != nil {
-		return errors.New(fmt.Sprintf(ERR_EXECNOTFOUND, err.Error()))
-	}
-
-	// Build the httperf commandline and build a result to return
-	argv := []string{
-		"--server", args.Host,
-		"--port", fmt.Sprintf("%d", args.Port),
-		"--uri", args.URL,
-		"--num-conns", fmt.Sprintf("%d", args.NumConnections),
-		"--rate", fmt.Sprintf("%d", args.ConnectionRate),
-		"--num-calls", fmt.Sprintf("%d", args.RequestsPerConnection),
-		"--timeout", fmt.Sprintf("%d", args.RequestsPerConnection),
-		"--hog",
-	}
-
-	log.Printf("++ [%p] Running benchmark of %s on port %d", args, args.Host, args.Port)
-	log.Printf("   [%p] Input arguments: %#v", args, args)
-	log.Printf("   [%p] Commandline arguments: %#v", args, argv)
-
-	cmd := exec.Command(perfexec, argv...)
-	outpipe, err := cmd.StdoutPipe()
-	if err != nil {
-		return errors.New(fmt.Sprintf(ERR_READOUT, err.Error()))
-	}
-	errpipe, err := cmd.StderrPipe()
-	if err != nil {
-		return errors.New(fmt.Sprintf(ERR_READOUT, err.Error()))
-	}
-
-	err = cmd.Start()
-	if err != nil {
-		return errors.New(fmt.Sprintf(ERR_RUNFAILED, err.Error()))
-	}
-
-	log.Printf("   [%p] Process successfully started with PID: %d", args, cmd.Process.Pid)
-
-	output, err := ioutil.ReadAll(outpipe)
-	log.Println("Finished reading stdout.")
-	if err != nil {
-		return errors.New(fmt.Sprintf(ERR_READOUT, err.Error()))
-	}
-	errout, err := ioutil.ReadAll(errpipe)
-	log.Println("Finished reading stderr.")
-	if err != nil {
-		return errors.New(fmt.Sprintf(ERR_READERR, err.Error()))
-	}
-
-	log.Printf("   [%p] Finished reading stdout and stderr", args)
-
-	err = cmd.Wait()
-	log.Printf("-- [%p] Command joined and finished", args)
-
-	if err != nil {
-		log.Println("Error:", err)
-		return errors.New(fmt.Sprintf(ERR_WAIT, cmd.Process.Pid))
+// Answer the coordinator's handshake, refusing a coordinator that speaks a
+// different version of the protocol
+func (h *HTTPerf) Hello(hello *ahpproto.Hello, reply *ahpproto.Hello) error {
+	reply.Version = ahpproto.Version
+	if err := ahpproto.CheckVersion("daemon", "coordinator", hello.Version); err != nil {
+		log.Printf("!! Rejected handshake: %s", err)
+		return err
 	}
+	return nil
+}
 
-	result.Stdout = string(output)
-	result.Stderr = string(errout)
+// Report the capacity of this worker, which the coordinator can use to give
+// it a larger or smaller share of the load, and the labels it selects by
+func (h *HTTPerf) Info(unused int, info *ahpproto.Info) error {
+	info.NumCPU = runtime.NumCPU()
+	info.Procs = workerProcs()
+	info.Labels = workerLabels
+	return nil
+}
 
+// Answer a heartbeat from the coordinator, which polls this while a long
+// benchmark is running to check the worker is still reachable
+func (h *HTTPerf) Ping(seq int, reply *int) error {
+	*reply = seq
 	return nil
 }
 
 var host *string = flag.String("host", "", "The host on which to bind the server")
 var port *int = flag.Int("port", 1717, "The port on which to bind the server")
+var maxJobs *int = flag.Int("maxjobs", 1, "The number of benchmarks run at once, 0 for no limit. Further ones wait for their turn if they ask to, or are turned away as busy")
+var retain *int = flag.Int("retain", 600, "Seconds the output of a finished job is kept for the coordinator to collect")
+var procs *int = flag.Int("procs", 1, "The number of httperf processes to split each benchmark over, 0 for one per core")
+var pin *bool = flag.Bool("pin", false, "Pin each httperf process to a core of its own with taskset")
+var backend *string = flag.String("backend", "httperf", "The load generator used when the coordinator does not ask for one: httperf, wrk, ab, vegeta or native")
+
+// Security options
+var token *string = flag.String("token", "", "A pre-shared token the coordinator must present, empty to accept any coordinator")
+var tlsCert *string = flag.String("tlscert", "", "Certificate to serve the RPC over TLS with")
+var tlsKey *string = flag.String("tlskey", "", "Private key of the -tlscert certificate")
+var tlsCA *string = flag.String("tlsca", "", "CA the coordinator's client certificate must be signed by, for mutual TLS")
+var allow *string = flag.String("allow", "", "Comma separated host names, addresses and CIDRs the daemon may benchmark, empty to allow any target")
+
+// Registration options, for workers that dial in to the coordinator rather
+// than waiting for it to connect. The labels are reported by Info as well.
+var coordinator *string = flag.String("coordinator", "", "The host:port of a coordinator to register with, as well as listening")
+var name *string = flag.String("name", "", "The name to register with, defaults to hostname:port")
+var labels *string = flag.String("labels", "", "Comma separated key=value labels the coordinator can select this worker by, e.g. region=eu,size=large")
 
 func main() {
 	flag.Parse()
 
+	if err := parseAllowlist(*allow); err != nil {
+		log.Fatalf("Could not parse -allow: %s", err)
+	}
+	if len(allowNets) == 0 && len(allowHosts) == 0 {
+		log.Printf("Warning: no -allow list, any target may be benchmarked")
+	}
+
+	var err error
+	if workerLabels, err = ahpproto.ParseLabels(*labels); err != nil {
+		log.Fatalf("Could not parse -labels: %s", err)
+	}
+
 	httperf := new(HTTPerf)
 	rpc.Register(httperf)
-	rpc.HandleHTTP()
-	l, e := net.Listen("tcp", fmt.Sprintf("%s:%d", *host, *port))
+
+	if len(*coordinator) > 0 {
+		// Nothing would stop anyone listening at the address from using the
+		// daemon otherwise
+		if len(*token) == 0 && len(*tlsCert) == 0 {
+			log.Fatalf("Registering with -coordinator needs a -token or -tlscert")
+		}
+		go registerLoop()
+	}
+
+	http.Handle(rpc.DefaultRPCPath, &authHandler{rpc.DefaultServer})
+	http.Handle(API_PREFIX, &authHandler{newAPIHandler(httperf)})
+	l, e := listen(fmt.Sprintf("%s:%d", *host, *port))
 	if e != nil {
-		log.Fatalf("listen error:", e)
+		log.Fatalf("listen error: %s", e)
 	}
 
 	log.Printf("Now listening for requests on %s:%d", *host, *port)
@@ -0,0 +1,39 @@
+package main
+
+import "fmt"
+import "log"
+import "net"
+import "net/http"
+import "sync"
+
+// A minimal HTTP server that answers every request with a short fixed reply,
+// for calibrating workers against a server that will not be the bottleneck.
+var sinkLock sync.Mutex
+var sinkPort int
+
+func sinkHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("OK\n"))
+}
+
+// Start the sink on the given port, or any free port when it is 0, and
+// return the port it is listening on. The sink keeps running until the
+// daemon exits, and later calls return the port of the running sink.
+func (h *HTTPerf) StartSink(port int, listening *int) error {
+	sinkLock.Lock()
+	defer sinkLock.Unlock()
+
+	if sinkPort == 0 {
+		l, err := net.Listen("tcp", fmt.Sprintf("%s:%d", *host, port))
+		if err != nil {
+			return err
+		}
+		sinkPort = l.Addr().(*net.TCPAddr).Port
+
+		go http.Serve(l, http.HandlerFunc(sinkHandler))
+		log.Printf("Started a calibration sink on port %d", sinkPort)
+	}
+
+	*listening = sinkPort
+	return nil
+}